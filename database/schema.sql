@@ -112,6 +112,11 @@ CREATE TABLE IF NOT EXISTS chat_messages (
     message TEXT NOT NULL,
     created_at INTEGER NOT NULL,
     is_read BOOLEAN DEFAULT 0,
+    edited_at INTEGER,
+    deleted_at INTEGER,
+    delivered_at INTEGER,
+    read_at INTEGER,
+    client_msg_id TEXT,
     FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE
 );
@@ -135,4 +140,183 @@ CREATE TABLE IF NOT EXISTS user_profiles (
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-);
\ No newline at end of file
+);
+-- Group conversations
+CREATE TABLE IF NOT EXISTS chat_rooms (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    owner_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS chat_room_members (
+    room_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    joined_at INTEGER NOT NULL,
+    PRIMARY KEY (room_id, user_id),
+    FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_room_members_user
+ON chat_room_members (user_id);
+
+CREATE TABLE IF NOT EXISTS chat_room_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    room_id INTEGER NOT NULL,
+    sender_id INTEGER NOT NULL,
+    message TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    edited_at INTEGER,
+    deleted_at INTEGER,
+    client_msg_id TEXT,
+    FOREIGN KEY (room_id) REFERENCES chat_rooms(id) ON DELETE CASCADE,
+    FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_room_messages_room
+ON chat_room_messages (room_id, created_at);
+
+-- Notification events kept for offline catch-up (private messages are replayed from chat_messages)
+CREATE TABLE IF NOT EXISTS chat_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_events_user
+ON chat_events (user_id, id);
+
+-- Users hidden from each other: no private chat either way, and the blocker
+-- no longer sees the blocked user's posts, comments or presence
+CREATE TABLE IF NOT EXISTS blocked_users (
+    blocker_id INTEGER NOT NULL,
+    blocked_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (blocker_id, blocked_id),
+    FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_blocked_users_blocked
+ON blocked_users (blocked_id);
+
+-- Notification preferences; users without a row get the defaults
+CREATE TABLE IF NOT EXISTS notification_settings (
+    user_id INTEGER PRIMARY KEY,
+    do_not_disturb BOOLEAN NOT NULL DEFAULT 0,
+    quiet_start INTEGER, -- minutes after midnight in the user's timezone
+    quiet_end INTEGER,
+    timezone TEXT NOT NULL DEFAULT 'UTC',
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS notification_disabled_events (
+    user_id INTEGER NOT NULL,
+    event_type TEXT NOT NULL,
+    PRIMARY KEY (user_id, event_type),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Muted private ('user') or group ('room') conversations
+CREATE TABLE IF NOT EXISTS conversation_mutes (
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,
+    target_id INTEGER NOT NULL,
+    muted_until INTEGER, -- Unix milliseconds; NULL mutes until unmuted
+    PRIMARY KEY (user_id, kind, target_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Per-conversation retention of private messages, keyed by the ordered user
+-- pair. A change only takes effect once both participants asked for it.
+CREATE TABLE IF NOT EXISTS chat_retention (
+    user_low INTEGER NOT NULL,
+    user_high INTEGER NOT NULL,
+    ttl_seconds INTEGER NOT NULL DEFAULT 0, -- 0 keeps messages forever
+    pending_ttl_seconds INTEGER,            -- proposal awaiting the other participant
+    proposed_by INTEGER,
+    updated_at INTEGER NOT NULL,
+    PRIMARY KEY (user_low, user_high),
+    FOREIGN KEY (user_low) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_high) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Moderation decisions other than a plain allow, for moderators to review
+CREATE TABLE IF NOT EXISTS moderation_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL,     -- chat, post, title or comment
+    action TEXT NOT NULL,   -- flag, mask or reject
+    reasons TEXT NOT NULL,  -- JSON array of {filter, action, reason}
+    content TEXT NOT NULL,  -- the content as submitted
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_moderation_log_created ON moderation_log(created_at);
+
+-- Forum activity for a user: comments on their posts, replies in threads they
+-- commented in, likes of their posts and comments, and mentions of them
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,  -- recipient
+    actor_id INTEGER NOT NULL,
+    type TEXT NOT NULL,        -- comment, reply, post_like, comment_like or mention
+    post_id INTEGER NOT NULL,
+    comment_id INTEGER,        -- NULL for post likes
+    created_at INTEGER NOT NULL,
+    read_at INTEGER,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY (comment_id) REFERENCES comments(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_id, id);
+
+-- @username references to users in posts, comments and chat messages
+CREATE TABLE IF NOT EXISTS mentions (
+    source TEXT NOT NULL,        -- post, comment, message or room_message
+    source_id INTEGER NOT NULL,  -- id of the row in that table
+    user_id INTEGER NOT NULL,    -- the mentioned user
+    author_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (source, source_id, user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_mentions_user ON mentions(user_id, created_at);
+
+-- Private messages a user starred for themselves
+CREATE TABLE IF NOT EXISTS starred_messages (
+    user_id INTEGER NOT NULL,
+    message_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (user_id, message_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (message_id) REFERENCES chat_messages(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_starred_messages_message ON starred_messages(message_id);
+
+-- Private messages pinned for both participants of their conversation
+CREATE TABLE IF NOT EXISTS pinned_messages (
+    message_id INTEGER PRIMARY KEY,
+    pinned_by INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (message_id) REFERENCES chat_messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (pinned_by) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Expired messages take their stars and pin along, whether or not the
+-- connection enforces foreign keys
+CREATE TRIGGER IF NOT EXISTS chat_messages_marks_delete AFTER DELETE ON chat_messages BEGIN
+    DELETE FROM starred_messages WHERE message_id = old.id;
+    DELETE FROM pinned_messages WHERE message_id = old.id;
+END;
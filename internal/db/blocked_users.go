@@ -0,0 +1,105 @@
+package db
+
+import (
+	repo "forum/internal/repository"
+	"time"
+)
+
+// BlockedUser is an entry of a user's block list
+type BlockedUser struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	BlockedAt string `json:"blocked_at"`
+}
+
+// BlockUser adds blockedID to the block list of blockerID; blocking twice is a no-op
+func BlockUser(blockerID, blockedID int) error {
+	query := `INSERT OR IGNORE INTO blocked_users (blocker_id, blocked_id, created_at) VALUES (?, ?, ?)`
+
+	_, err := repo.DB.Exec(query, blockerID, blockedID, time.Now().UnixMilli())
+	return err
+}
+
+// UnblockUser removes blockedID from the block list, reporting whether it was on it
+func UnblockUser(blockerID, blockedID int) (bool, error) {
+	res, err := repo.DB.Exec(`DELETE FROM blocked_users WHERE blocker_id = ? AND blocked_id = ?`, blockerID, blockedID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetBlockedUsers returns the block list of a user, most recent first
+func GetBlockedUsers(blockerID int) ([]BlockedUser, error) {
+	query := `SELECT u.id, u.username, b.created_at
+			  FROM blocked_users b
+			  JOIN users u ON u.id = b.blocked_id
+			  WHERE b.blocker_id = ?
+			  ORDER BY b.created_at DESC`
+
+	rows, err := repo.DB.Query(query, blockerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocked := []BlockedUser{}
+	for rows.Next() {
+		var user BlockedUser
+		var blockedAt int64
+		if err := rows.Scan(&user.ID, &user.Username, &blockedAt); err != nil {
+			return nil, err
+		}
+		user.BlockedAt = formatMillis(blockedAt)
+		blocked = append(blocked, user)
+	}
+	return blocked, rows.Err()
+}
+
+// GetBlockedUsernames returns the usernames a user has blocked, for filtering user lists
+func GetBlockedUsernames(blockerID int) (map[string]bool, error) {
+	blocked, err := GetBlockedUsers(blockerID)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(blocked))
+	for _, user := range blocked {
+		names[user.Username] = true
+	}
+	return names, nil
+}
+
+// GetBlockedPeerIDs returns the users who blocked userID or were blocked by
+// them, for hiding a user's frames in shared rooms
+func GetBlockedPeerIDs(userID int) (map[int]bool, error) {
+	rows, err := repo.DB.Query(`SELECT blocked_id FROM blocked_users WHERE blocker_id = ?1
+			  UNION
+			  SELECT blocker_id FROM blocked_users WHERE blocked_id = ?1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	peers := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		peers[id] = true
+	}
+	return peers, rows.Err()
+}
+
+// IsBlockedBetween reports whether either user has blocked the other
+func IsBlockedBetween(userID1, userID2 int) (bool, error) {
+	var blocked bool
+	query := `SELECT EXISTS (
+				SELECT 1 FROM blocked_users
+				WHERE (blocker_id = ?1 AND blocked_id = ?2) OR (blocker_id = ?2 AND blocked_id = ?1)
+			  )`
+
+	err := repo.DB.QueryRow(query, userID1, userID2).Scan(&blocked)
+	return blocked, err
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	repo "forum/internal/repository"
+	"math"
+)
+
+// ChatCursor is a position in a private conversation. Messages are ordered by
+// (created_at, id) so that two messages saved in the same millisecond still
+// have a stable order.
+type ChatCursor struct {
+	CreatedAt int64
+	ID        int
+}
+
+// ErrInvalidCursor is returned when a client sends a cursor we did not issue
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// latestChatCursor sorts after every stored message
+var latestChatCursor = ChatCursor{CreatedAt: math.MaxInt64, ID: math.MaxInt64}
+
+// String encodes the cursor as the opaque token handed to clients
+func (c ChatCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.CreatedAt, c.ID)))
+}
+
+// ParseChatCursor decodes a token produced by ChatCursor.String. ID 0 is
+// accepted: it sorts before every message of its millisecond, which is where
+// a search hit on message 1 jumps to.
+func ParseChatCursor(token string) (ChatCursor, error) {
+	var c ChatCursor
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if _, err := fmt.Sscanf(string(raw), "%d:%d", &c.CreatedAt, &c.ID); err != nil || c.ID < 0 {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// ChatCursorForMessage returns the cursor of a message, provided it belongs to
+// the conversation between the two users
+func ChatCursorForMessage(userID1, userID2, messageID int) (ChatCursor, error) {
+	c := ChatCursor{ID: messageID}
+	query := `SELECT created_at FROM chat_messages
+			  WHERE id = ? AND ((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))`
+
+	err := repo.DB.QueryRow(query, messageID, userID1, userID2, userID2, userID1).Scan(&c.CreatedAt)
+	return c, err
+}
+
+// GetChatMessagesBefore returns up to limit messages older than the cursor, in
+// chronological order, and whether even older messages exist. Pass nil for the
+// newest page.
+//
+// Each direction of the conversation is read separately so that both halves
+// walk idx_chat_messages_participants (sender_id, receiver_id, created_at)
+// instead of sorting the whole history.
+func GetChatMessagesBefore(userID1, userID2 int, before *ChatCursor, limit int) ([]ChatMessage, bool, error) {
+	cursor := latestChatCursor
+	if before != nil {
+		cursor = *before
+	}
+	query := `
+		SELECT ` + chatMessageColumns + `
+		FROM chat_messages cm
+		JOIN users u ON cm.sender_id = u.id
+		WHERE cm.id IN (
+			SELECT id FROM (
+				SELECT id FROM chat_messages
+				WHERE sender_id = ?1 AND receiver_id = ?2 AND (created_at, id) < (?3, ?4)
+				ORDER BY created_at DESC, id DESC LIMIT ?5
+			)
+			UNION ALL
+			SELECT id FROM (
+				SELECT id FROM chat_messages
+				WHERE sender_id = ?2 AND receiver_id = ?1 AND (created_at, id) < (?3, ?4)
+				ORDER BY created_at DESC, id DESC LIMIT ?5
+			)
+		)
+		ORDER BY cm.created_at DESC, cm.id DESC
+		LIMIT ?5
+	`
+
+	messages, hasMore, err := queryChatPage(query, userID1, userID2, cursor, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	reverseChatMessages(messages)
+	return messages, hasMore, nil
+}
+
+// GetChatMessagesAfter returns up to limit messages newer than the cursor, in
+// chronological order, and whether even newer messages exist
+func GetChatMessagesAfter(userID1, userID2 int, after ChatCursor, limit int) ([]ChatMessage, bool, error) {
+	query := `
+		SELECT ` + chatMessageColumns + `
+		FROM chat_messages cm
+		JOIN users u ON cm.sender_id = u.id
+		WHERE cm.id IN (
+			SELECT id FROM (
+				SELECT id FROM chat_messages
+				WHERE sender_id = ?1 AND receiver_id = ?2 AND (created_at, id) > (?3, ?4)
+				ORDER BY created_at ASC, id ASC LIMIT ?5
+			)
+			UNION ALL
+			SELECT id FROM (
+				SELECT id FROM chat_messages
+				WHERE sender_id = ?2 AND receiver_id = ?1 AND (created_at, id) > (?3, ?4)
+				ORDER BY created_at ASC, id ASC LIMIT ?5
+			)
+		)
+		ORDER BY cm.created_at ASC, cm.id ASC
+		LIMIT ?5
+	`
+
+	return queryChatPage(query, userID1, userID2, after, limit)
+}
+
+// queryChatPage runs a keyset query, fetching one extra row to learn whether
+// another page follows
+func queryChatPage(query string, userID1, userID2 int, cursor ChatCursor, limit int) ([]ChatMessage, bool, error) {
+	rows, err := repo.DB.Query(query, userID1, userID2, cursor.CreatedAt, cursor.ID, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	messages := []ChatMessage{}
+	for rows.Next() {
+		msg, err := scanChatMessage(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	return messages, hasMore, attachChatMessageMentions(messages)
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"encoding/json"
+	repo "forum/internal/repository"
+	"time"
+)
+
+// ChatEvent is a notification recorded so that it can be replayed to a client
+// that was offline when it was pushed
+type ChatEvent struct {
+	ID        int
+	Type      string
+	Payload   json.RawMessage
+	CreatedAt int64 // Unix milliseconds
+}
+
+// SaveChatEvent records a notification for userID and returns its id
+func SaveChatEvent(userID int, eventType string, payload []byte) (int, error) {
+	query := `INSERT INTO chat_events (user_id, type, payload, created_at) VALUES (?, ?, ?, ?)`
+
+	res, err := repo.DB.Exec(query, userID, eventType, string(payload), time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// GetChatEventsSince returns the user's events after afterID, oldest first
+func GetChatEventsSince(userID, afterID, limit int) ([]ChatEvent, error) {
+	query := `SELECT id, type, payload, created_at FROM chat_events
+			  WHERE user_id = ? AND id > ?
+			  ORDER BY id ASC
+			  LIMIT ?`
+
+	rows, err := repo.DB.Query(query, userID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []ChatEvent
+	for rows.Next() {
+		var event ChatEvent
+		var payload string
+		if err := rows.Scan(&event.ID, &event.Type, &payload, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.Payload = json.RawMessage(payload)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// GetMissedChatMessages returns private messages received by the user after
+// afterID, oldest first. Deleted messages are skipped.
+func GetMissedChatMessages(receiverID, afterID, limit int) ([]ChatMessage, error) {
+	query := `
+		SELECT ` + chatMessageColumns + `
+		FROM chat_messages cm
+		JOIN users u ON cm.sender_id = u.id
+		WHERE cm.receiver_id = ? AND cm.id > ? AND cm.deleted_at IS NULL
+		ORDER BY cm.id ASC
+		LIMIT ?
+	`
+
+	rows, err := repo.DB.Query(query, receiverID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []ChatMessage
+	for rows.Next() {
+		msg, err := scanChatMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, attachChatMessageMentions(messages)
+}
+
+// LatestChatPositions returns the newest received message id and event id of
+// a user, the baseline for a client connecting for the first time
+func LatestChatPositions(userID int) (int, int, error) {
+	var lastMessageID, lastEventID int
+	err := repo.DB.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM chat_messages WHERE receiver_id = ?`, userID).Scan(&lastMessageID)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = repo.DB.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM chat_events WHERE user_id = ?`, userID).Scan(&lastEventID)
+	return lastMessageID, lastEventID, err
+}
+
+// PruneChatEvents deletes events older than the retention period
+func PruneChatEvents(olderThan time.Time) (int64, error) {
+	res, err := repo.DB.Exec(`DELETE FROM chat_events WHERE created_at < ?`, olderThan.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
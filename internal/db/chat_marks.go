@@ -0,0 +1,243 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	repo "forum/internal/repository"
+	"time"
+)
+
+// ErrTooManyPins refuses a pin past CHAT_PINNED_MAX_PER_CONVERSATION
+var ErrTooManyPins = errors.New("too many pinned messages")
+
+// StarredMessage is a private message the user starred for themselves
+type StarredMessage struct {
+	ChatMessage
+	StarredAt string `json:"starred_at"`
+}
+
+// PinnedMessage is a private message pinned for both participants
+type PinnedMessage struct {
+	ChatMessage
+	PinnedBy     int    `json:"pinned_by"`
+	PinnedByName string `json:"pinned_by_name"`
+	PinnedAt     string `json:"pinned_at"`
+}
+
+// StarChatMessage stars a message the user sent or received. It reports
+// whether the message was not starred yet; sql.ErrNoRows means the message is
+// not the user's or was deleted.
+func StarChatMessage(userID, messageID int) (bool, error) {
+	res, err := repo.DB.Exec(`INSERT OR IGNORE INTO starred_messages (user_id, message_id, created_at)
+		SELECT ?1, id, ?3 FROM chat_messages
+		WHERE id = ?2 AND (sender_id = ?1 OR receiver_id = ?1) AND deleted_at IS NULL`,
+		userID, messageID, time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if affected > 0 {
+		return true, nil
+	}
+	var starred bool
+	err = repo.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM starred_messages WHERE user_id = ? AND message_id = ?)`,
+		userID, messageID).Scan(&starred)
+	if err != nil {
+		return false, err
+	}
+	if !starred {
+		return false, sql.ErrNoRows
+	}
+	return false, nil
+}
+
+// UnstarChatMessage removes the user's star from a message, if any
+func UnstarChatMessage(userID, messageID int) error {
+	_, err := repo.DB.Exec(`DELETE FROM starred_messages WHERE user_id = ? AND message_id = ?`, userID, messageID)
+	return err
+}
+
+// GetStarredChatMessages returns the messages the user starred in their
+// conversation with otherUserID, most recently starred first
+func GetStarredChatMessages(userID, otherUserID int) ([]StarredMessage, error) {
+	query := `
+		SELECT ` + chatMessageColumns + `, s.created_at
+		FROM starred_messages s
+		JOIN chat_messages cm ON cm.id = s.message_id
+		JOIN users u ON cm.sender_id = u.id
+		WHERE s.user_id = ?1
+		  AND ((cm.sender_id = ?1 AND cm.receiver_id = ?2) OR (cm.sender_id = ?2 AND cm.receiver_id = ?1))
+		ORDER BY s.created_at DESC, cm.id DESC`
+
+	rows, err := repo.DB.Query(query, userID, otherUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	starred := []StarredMessage{}
+	var messages []ChatMessage
+	for rows.Next() {
+		var s StarredMessage
+		var starredAt int64
+		s.ChatMessage, err = scanChatMessage(markedRow{rows, []any{&starredAt}})
+		if err != nil {
+			return nil, err
+		}
+		s.StarredAt = formatMillis(starredAt)
+		starred = append(starred, s)
+		messages = append(messages, s.ChatMessage)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := attachChatMessageMentions(messages); err != nil {
+		return nil, err
+	}
+	for i := range starred {
+		starred[i].Mentions = messages[i].Mentions
+	}
+	return starred, nil
+}
+
+// PinChatMessage pins a message of the conversation between userID and
+// peerID for both of them. It reports whether the message was not pinned yet;
+// sql.ErrNoRows means the message is not in the conversation or was deleted.
+func PinChatMessage(messageID, userID, peerID int) (PinnedMessage, bool, error) {
+	msg, err := GetChatMessageByID(messageID)
+	if err != nil {
+		return PinnedMessage{}, false, err
+	}
+	inConversation := (msg.SenderID == userID && msg.ReceiverID == peerID) || (msg.SenderID == peerID && msg.ReceiverID == userID)
+	if !inConversation || msg.IsDeleted {
+		return PinnedMessage{}, false, sql.ErrNoRows
+	}
+	if pinned, err := GetPinnedChatMessage(messageID); err == nil {
+		return pinned, false, nil
+	} else if err != sql.ErrNoRows {
+		return PinnedMessage{}, false, err
+	}
+
+	// Counting and inserting in one statement keeps two nodes pinning at once
+	// from both passing the limit
+	res, err := repo.DB.Exec(`INSERT OR IGNORE INTO pinned_messages (message_id, pinned_by, created_at)
+		SELECT ?1, ?2, ?3
+		WHERE (
+			SELECT COUNT(*) FROM pinned_messages p
+			JOIN chat_messages cm ON cm.id = p.message_id
+			WHERE (cm.sender_id = ?2 AND cm.receiver_id = ?4) OR (cm.sender_id = ?4 AND cm.receiver_id = ?2)
+		) < ?5`,
+		messageID, userID, time.Now().UnixMilli(), peerID, repo.CHAT_PINNED_MAX_PER_CONVERSATION)
+	if err != nil {
+		return PinnedMessage{}, false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return PinnedMessage{}, false, err
+	}
+	pinned, err := GetPinnedChatMessage(messageID)
+	if err == sql.ErrNoRows {
+		return PinnedMessage{}, false, ErrTooManyPins
+	}
+	if err != nil {
+		return PinnedMessage{}, false, err
+	}
+	return pinned, inserted > 0, nil
+}
+
+// UnpinChatMessage unpins a message of the conversation between userID and
+// peerID; either participant may unpin. It reports whether it was pinned.
+func UnpinChatMessage(messageID, userID, peerID int) (bool, error) {
+	res, err := repo.DB.Exec(`DELETE FROM pinned_messages WHERE message_id = (
+			SELECT id FROM chat_messages
+			WHERE id = ?1 AND ((sender_id = ?2 AND receiver_id = ?3) OR (sender_id = ?3 AND receiver_id = ?2))
+		)`, messageID, userID, peerID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// GetPinnedChatMessage returns a pinned message; sql.ErrNoRows means it is not pinned
+func GetPinnedChatMessage(messageID int) (PinnedMessage, error) {
+	pinned, err := queryPinnedChatMessages(`p.message_id = ?1`, messageID)
+	if err != nil {
+		return PinnedMessage{}, err
+	}
+	if len(pinned) == 0 {
+		return PinnedMessage{}, sql.ErrNoRows
+	}
+	return pinned[0], nil
+}
+
+// GetPinnedChatMessages returns the pinned messages of the conversation
+// between the two users, most recently pinned first
+func GetPinnedChatMessages(userID, otherUserID int) ([]PinnedMessage, error) {
+	return queryPinnedChatMessages(
+		`(cm.sender_id = ?1 AND cm.receiver_id = ?2) OR (cm.sender_id = ?2 AND cm.receiver_id = ?1)`,
+		userID, otherUserID)
+}
+
+// queryPinnedChatMessages loads the pinned messages matching where
+func queryPinnedChatMessages(where string, args ...any) ([]PinnedMessage, error) {
+	query := `
+		SELECT ` + chatMessageColumns + `, p.created_at, p.pinned_by, pu.username
+		FROM pinned_messages p
+		JOIN chat_messages cm ON cm.id = p.message_id
+		JOIN users u ON cm.sender_id = u.id
+		JOIN users pu ON p.pinned_by = pu.id
+		WHERE ` + where + `
+		ORDER BY p.created_at DESC, cm.id DESC`
+
+	rows, err := repo.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pinned := []PinnedMessage{}
+	var messages []ChatMessage
+	for rows.Next() {
+		var p PinnedMessage
+		var pinnedAt int64
+		p.ChatMessage, err = scanChatMessage(markedRow{rows, []any{&pinnedAt, &p.PinnedBy, &p.PinnedByName}})
+		if err != nil {
+			return nil, err
+		}
+		p.PinnedAt = formatMillis(pinnedAt)
+		pinned = append(pinned, p)
+		messages = append(messages, p.ChatMessage)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := attachChatMessageMentions(messages); err != nil {
+		return nil, err
+	}
+	for i := range pinned {
+		pinned[i].Mentions = messages[i].Mentions
+	}
+	return pinned, nil
+}
+
+// clearChatMessageMarks unstars and unpins a deleted message
+func clearChatMessageMarks(messageID int) error {
+	if _, err := repo.DB.Exec(`DELETE FROM starred_messages WHERE message_id = ?`, messageID); err != nil {
+		return err
+	}
+	_, err := repo.DB.Exec(`DELETE FROM pinned_messages WHERE message_id = ?`, messageID)
+	return err
+}
+
+// markedRow scans a row of chatMessageColumns followed by the extra columns
+// of a star or pin
+type markedRow struct {
+	rows  *sql.Rows
+	extra []any
+}
+
+func (m markedRow) Scan(dest ...any) error {
+	return m.rows.Scan(append(dest, m.extra...)...)
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"database/sql"
+	repo "forum/internal/repository"
+	"time"
+)
+
+// RetentionPolicy is how long a private conversation keeps its messages
+type RetentionPolicy struct {
+	TTLSeconds        int // 0 keeps messages forever
+	PendingTTLSeconds int // meaningful only when ProposedBy is set
+	ProposedBy        int // user whose change awaits the other participant, or 0
+}
+
+// ExpiredChatMessages lists the messages of one conversation removed by a sweep
+type ExpiredChatMessages struct {
+	UserID1 int
+	UserID2 int
+	IDs     []int
+}
+
+// orderedPair keys a conversation independently of who is asking
+func orderedPair(userID1, userID2 int) (int, int) {
+	if userID1 > userID2 {
+		return userID2, userID1
+	}
+	return userID1, userID2
+}
+
+// GetRetentionPolicy returns the policy of the conversation between two users
+func GetRetentionPolicy(userID1, userID2 int) (RetentionPolicy, error) {
+	low, high := orderedPair(userID1, userID2)
+	return getRetentionPolicy(repo.DB, low, high)
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func getRetentionPolicy(q queryRower, low, high int) (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	var pending, proposedBy sql.NullInt64
+	err := q.QueryRow(`SELECT ttl_seconds, pending_ttl_seconds, proposed_by FROM chat_retention WHERE user_low = ? AND user_high = ?`,
+		low, high).Scan(&policy.TTLSeconds, &pending, &proposedBy)
+	if err == sql.ErrNoRows {
+		return policy, nil
+	}
+	if proposedBy.Valid {
+		policy.ProposedBy = int(proposedBy.Int64)
+		policy.PendingTTLSeconds = int(pending.Int64)
+	}
+	return policy, err
+}
+
+// ProposeRetention records that userID wants messages with otherUserID kept
+// for ttlSeconds. If the other participant already asked for the same value
+// it takes effect and applied is true; asking for the current value withdraws
+// or declines a pending change.
+func ProposeRetention(userID, otherUserID, ttlSeconds int) (RetentionPolicy, bool, error) {
+	low, high := orderedPair(userID, otherUserID)
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return RetentionPolicy{}, false, err
+	}
+	defer tx.Rollback()
+
+	policy, err := getRetentionPolicy(tx, low, high)
+	if err != nil {
+		return policy, false, err
+	}
+	applied := false
+	switch {
+	case ttlSeconds == policy.TTLSeconds:
+		policy.ProposedBy, policy.PendingTTLSeconds = 0, 0
+	case policy.ProposedBy == otherUserID && policy.PendingTTLSeconds == ttlSeconds:
+		policy = RetentionPolicy{TTLSeconds: ttlSeconds}
+		applied = true
+	default:
+		policy.ProposedBy, policy.PendingTTLSeconds = userID, ttlSeconds
+	}
+
+	var pending, proposedBy sql.NullInt64
+	if policy.ProposedBy != 0 {
+		pending = sql.NullInt64{Int64: int64(policy.PendingTTLSeconds), Valid: true}
+		proposedBy = sql.NullInt64{Int64: int64(policy.ProposedBy), Valid: true}
+	}
+	_, err = tx.Exec(`INSERT INTO chat_retention (user_low, user_high, ttl_seconds, pending_ttl_seconds, proposed_by, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_low, user_high) DO UPDATE SET
+				ttl_seconds = excluded.ttl_seconds,
+				pending_ttl_seconds = excluded.pending_ttl_seconds,
+				proposed_by = excluded.proposed_by,
+				updated_at = excluded.updated_at`,
+		low, high, policy.TTLSeconds, pending, proposedBy, time.Now().UnixMilli())
+	if err != nil {
+		return policy, false, err
+	}
+	return policy, applied, tx.Commit()
+}
+
+// DeleteExpiredChatMessages hard-deletes messages older than their
+// conversation's retention, at most limit per conversation, and reports what
+// was removed so clients can be told
+func DeleteExpiredChatMessages(now time.Time, limit int) ([]ExpiredChatMessages, error) {
+	rows, err := repo.DB.Query(`SELECT user_low, user_high, ttl_seconds FROM chat_retention WHERE ttl_seconds > 0`)
+	if err != nil {
+		return nil, err
+	}
+	type policy struct{ low, high, ttl int }
+	var policies []policy
+	for rows.Next() {
+		var p policy
+		if err := rows.Scan(&p.low, &p.high, &p.ttl); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var expired []ExpiredChatMessages
+	for _, p := range policies {
+		cutoff := now.Add(-time.Duration(p.ttl) * time.Second).UnixMilli()
+		ids, err := deleteChatMessagesBefore(p.low, p.high, cutoff, limit)
+		if err != nil {
+			return expired, err
+		}
+		if len(ids) > 0 {
+			expired = append(expired, ExpiredChatMessages{UserID1: p.low, UserID2: p.high, IDs: ids})
+		}
+	}
+	return expired, nil
+}
+
+// deleteChatMessagesBefore removes up to limit messages of a conversation
+// created before cutoff, together with the copies of their text kept for
+// catch-up replay and mentions
+func deleteChatMessagesBefore(userID1, userID2 int, cutoff int64, limit int) ([]int, error) {
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		DELETE FROM chat_messages WHERE id IN (
+			SELECT id FROM chat_messages
+			WHERE ((sender_id = ?1 AND receiver_id = ?2) OR (sender_id = ?2 AND receiver_id = ?1))
+			  AND created_at < ?3
+			ORDER BY created_at, id
+			LIMIT ?4
+		)
+		RETURNING id`, userID1, userID2, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		// Events about a private message (edits, mentions, pins) carry its id
+		// and no room_id, and are only ever recorded for its participants
+		if _, err := tx.Exec(`DELETE FROM chat_events
+				WHERE user_id IN (?1, ?2)
+				  AND type IN ('edit', 'delete', 'mention', 'pin', 'unpin')
+				  AND json_extract(payload, '$.id') = ?3
+				  AND json_extract(payload, '$.room_id') IS NULL`,
+			userID1, userID2, id); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`DELETE FROM mentions WHERE source = ? AND source_id = ?`, MentionMessage, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
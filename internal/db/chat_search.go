@@ -0,0 +1,281 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	repo "forum/internal/repository"
+	"html"
+	"log"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// chatSearchFTS reports whether chat_messages_fts is available. The FTS5
+// module is only compiled into go-sqlite3 with the sqlite_fts5 build tag;
+// without it search falls back to a LIKE scan.
+var chatSearchFTS bool
+
+// Snippet delimiters, taken from the Unicode private use area so they do not clash with message text
+const (
+	markStart = "\uE000"
+	markEnd   = "\uE001"
+)
+
+// ChatSearchResult is a private message matching a search query
+type ChatSearchResult struct {
+	ID          int    `json:"id"`
+	OtherUserID int    `json:"other_user_id"`
+	OtherName   string `json:"other_username"`
+	SenderID    int    `json:"sender_id"`
+	SenderName  string `json:"sender_name"`
+	CreatedAt   string `json:"created_at"`
+	Snippet     string `json:"snippet"` // HTML-escaped, matches wrapped in <mark>
+	Cursor      string `json:"cursor"`
+	JumpCursor  string `json:"jump_cursor"` // after_id for a history page starting at this message
+}
+
+// initChatSearch creates the FTS5 index and the triggers keeping it in sync
+// with chat_messages. The index is rebuilt whenever the sync triggers were
+// missing, e.g. after the server ran without FTS5 support.
+func initChatSearch(db *sql.DB) {
+	var triggers int
+	db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'chat_messages_fts_%'`).Scan(&triggers)
+
+	_, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS chat_messages_fts USING fts5(message, tokenize = 'unicode61 remove_diacritics 2')`)
+	if err == nil {
+		// IF NOT EXISTS succeeds without the module when an earlier build created the table
+		_, err = db.Exec(`SELECT rowid FROM chat_messages_fts LIMIT 0`)
+	}
+	if err != nil {
+		// Triggers referencing the index would make every insert fail
+		db.Exec(`DROP TRIGGER IF EXISTS chat_messages_fts_insert`)
+		db.Exec(`DROP TRIGGER IF EXISTS chat_messages_fts_update`)
+		db.Exec(`DROP TRIGGER IF EXISTS chat_messages_fts_delete`)
+		log.Printf("Chat search: FTS5 unavailable (%v), using LIKE fallback", err)
+		chatSearchFTS = false
+		return
+	}
+
+	if triggers < 3 {
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Chat search: failed to rebuild index: %v", err)
+			return
+		}
+		defer tx.Rollback()
+		statements := []string{
+			`DELETE FROM chat_messages_fts`,
+			`INSERT INTO chat_messages_fts (rowid, message)
+			 SELECT id, message FROM chat_messages WHERE deleted_at IS NULL`,
+			`CREATE TRIGGER IF NOT EXISTS chat_messages_fts_insert AFTER INSERT ON chat_messages BEGIN
+				INSERT INTO chat_messages_fts (rowid, message) VALUES (new.id, new.message);
+			 END`,
+			`CREATE TRIGGER IF NOT EXISTS chat_messages_fts_update AFTER UPDATE OF message, deleted_at ON chat_messages BEGIN
+				DELETE FROM chat_messages_fts WHERE rowid = old.id;
+				INSERT INTO chat_messages_fts (rowid, message) SELECT new.id, new.message WHERE new.deleted_at IS NULL;
+			 END`,
+			`CREATE TRIGGER IF NOT EXISTS chat_messages_fts_delete AFTER DELETE ON chat_messages BEGIN
+				DELETE FROM chat_messages_fts WHERE rowid = old.id;
+			 END`,
+		}
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				log.Printf("Chat search: failed to rebuild index: %v", err)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Chat search: failed to rebuild index: %v", err)
+			return
+		}
+	}
+	chatSearchFTS = true
+}
+
+// searchTerms splits a query into words
+func searchTerms(query string) []string {
+	return strings.Fields(strings.ToLower(query))
+}
+
+// ftsMatchQuery quotes every term so user input is never parsed as FTS5
+// syntax; the last term also matches as a prefix for search-as-you-type
+func ftsMatchQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	quoted[len(quoted)-1] += "*"
+	return strings.Join(quoted, " ")
+}
+
+// SearchChatMessages returns the caller's private messages matching query,
+// newest first, optionally limited to the conversation with otherUserID.
+// Pass the cursor of the last result as before to get the next page.
+func SearchChatMessages(userID, otherUserID int, query string, before *ChatCursor, limit int) ([]ChatSearchResult, bool, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []ChatSearchResult{}, false, nil
+	}
+	cursor := latestChatCursor
+	if before != nil {
+		cursor = *before
+	}
+
+	var rows *sql.Rows
+	var err error
+	if chatSearchFTS {
+		rows, err = repo.DB.Query(`
+			SELECT cm.id, cm.sender_id, cm.receiver_id, u.username, cm.created_at,
+			       snippet(chat_messages_fts, 0, ?1, ?2, '…', 16)
+			FROM chat_messages_fts
+			JOIN chat_messages cm ON cm.id = chat_messages_fts.rowid
+			JOIN users u ON u.id = cm.sender_id
+			WHERE chat_messages_fts MATCH ?3
+			  AND (cm.sender_id = ?4 OR cm.receiver_id = ?4)
+			  AND (?5 = 0 OR cm.sender_id = ?5 OR cm.receiver_id = ?5)
+			  AND cm.deleted_at IS NULL
+			  AND (cm.created_at, cm.id) < (?6, ?7)
+			ORDER BY cm.created_at DESC, cm.id DESC
+			LIMIT ?8
+		`, markStart, markEnd, ftsMatchQuery(terms), userID, otherUserID, cursor.CreatedAt, cursor.ID, limit+1)
+	} else {
+		where := []string{}
+		args := []any{userID, otherUserID, cursor.CreatedAt, cursor.ID, limit + 1}
+		for _, term := range terms {
+			args = append(args, "%"+escapeLike(term)+"%")
+			where = append(where, fmt.Sprintf(`AND LOWER(cm.message) LIKE ?%d ESCAPE '\'`, len(args)))
+		}
+		rows, err = repo.DB.Query(`
+			SELECT cm.id, cm.sender_id, cm.receiver_id, u.username, cm.created_at, cm.message
+			FROM chat_messages cm
+			JOIN users u ON u.id = cm.sender_id
+			WHERE (cm.sender_id = ?1 OR cm.receiver_id = ?1)
+			  AND (?2 = 0 OR cm.sender_id = ?2 OR cm.receiver_id = ?2)
+			  AND cm.deleted_at IS NULL
+			  AND (cm.created_at, cm.id) < (?3, ?4)
+			  `+strings.Join(where, " ")+`
+			ORDER BY cm.created_at DESC, cm.id DESC
+			LIMIT ?5
+		`, args...)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	results := []ChatSearchResult{}
+	for rows.Next() {
+		var result ChatSearchResult
+		var receiverID int
+		var createdAtMs int64
+		var text string
+		if err := rows.Scan(&result.ID, &result.SenderID, &receiverID, &result.SenderName, &createdAtMs, &text); err != nil {
+			return nil, false, err
+		}
+		if !chatSearchFTS {
+			text = markTerms(text, terms)
+		}
+		result.Snippet = highlightSnippet(text)
+		result.CreatedAt = formatMillis(createdAtMs)
+		result.Cursor = ChatCursor{CreatedAt: createdAtMs, ID: result.ID}.String()
+		result.JumpCursor = ChatCursor{CreatedAt: createdAtMs, ID: result.ID - 1}.String()
+		result.OtherUserID = receiverID
+		if receiverID == userID {
+			result.OtherUserID = result.SenderID
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(results) > limit
+	if hasMore {
+		results = results[:limit]
+	}
+	for i := range results {
+		if name, err := GetUserNameById(results[i].OtherUserID); err == nil {
+			results[i].OtherName = name
+		}
+	}
+	return results, hasMore, nil
+}
+
+// escapeLike escapes LIKE wildcards in user input
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+}
+
+// markTerms wraps term occurrences in snippet delimiters and trims long
+// messages to a window around the first match, like FTS5 snippet() does
+func markTerms(text string, terms []string) string {
+	const window = 60 // characters of context on each side of the first match
+
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		// Lowercasing changed byte offsets; highlight nothing rather than misplace marks
+		return text
+	}
+	type span struct{ start, end int }
+	var spans []span
+	for _, term := range terms {
+		for offset := 0; ; {
+			i := strings.Index(lower[offset:], term)
+			if i < 0 {
+				break
+			}
+			spans = append(spans, span{offset + i, offset + i + len(term)})
+			offset += i + len(term)
+		}
+	}
+	if len(spans) == 0 {
+		return text
+	}
+
+	// Merge overlapping matches so the marks stay balanced
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	merged := spans[:1]
+	for _, s := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if s.start <= last.end {
+			last.end = max(last.end, s.end)
+			continue
+		}
+		merged = append(merged, s)
+	}
+
+	from, to := max(merged[0].start-window, 0), min(merged[0].end+window, len(text))
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	cut := from
+	for _, s := range merged {
+		if s.start >= to {
+			break
+		}
+		end := min(s.end, to)
+		b.WriteString(text[cut:s.start])
+		b.WriteString(markStart + text[s.start:end] + markEnd)
+		cut = end
+	}
+	b.WriteString(text[cut:to])
+	if to < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// highlightSnippet HTML-escapes a delimited snippet and turns the delimiters into <mark> tags
+func highlightSnippet(text string) string {
+	escaped := html.EscapeString(text)
+	return strings.NewReplacer(markStart, "<mark>", markEnd, "</mark>").Replace(escaped)
+}
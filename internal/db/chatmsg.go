@@ -1,34 +1,142 @@
 package db
 
 import (
+	"database/sql"
 	repo "forum/internal/repository"
-	"fmt"
+	"math"
 	"time"
 )
 
 type ChatMessage struct {
-	ID         int    `json:"id"`
-	SenderID   int    `json:"sender_id"`
-	ReceiverID int    `json:"receiver_id"`
-	Message    string `json:"message"`
-	CreatedAt  string `json:"created_at"`
-	IsRead     bool   `json:"is_read"`
-	SenderName string `json:"sender_name"`
+	ID          int    `json:"id"`
+	SenderID    int    `json:"sender_id"`
+	ReceiverID  int    `json:"receiver_id"`
+	Message     string `json:"message"`
+	CreatedAt   string `json:"created_at"`
+	IsRead      bool   `json:"is_read"`
+	SenderName  string `json:"sender_name"`
+	IsEdited    bool   `json:"is_edited"`
+	EditedAt    string `json:"edited_at,omitempty"`
+	IsDeleted   bool   `json:"is_deleted"`
+	DeletedAt   string `json:"deleted_at,omitempty"`
+	DeliveredAt string `json:"delivered_at,omitempty"`
+	ReadAt      string `json:"read_at,omitempty"`
+	Cursor      string `json:"cursor"`
+
+	Mentions []repo.Mention `json:"mentions,omitempty"`
+
+	createdAtMs int64
+}
+
+// chatMessageColumns is the select list of every private message query (chat_messages cm JOIN users u)
+const chatMessageColumns = `cm.id, cm.sender_id, cm.receiver_id, cm.message, cm.created_at, cm.is_read, u.username,
+		       cm.edited_at, cm.deleted_at, cm.delivered_at, cm.read_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanChatMessage reads one row selected with chatMessageColumns
+func scanChatMessage(row rowScanner) (ChatMessage, error) {
+	var msg ChatMessage
+	var createdAtMs int64 // created_at is stored as milliseconds
+	var editedAt, deletedAt, deliveredAt, readAt sql.NullInt64
+	err := row.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID,
+		&msg.Message, &createdAtMs, &msg.IsRead, &msg.SenderName, &editedAt, &deletedAt, &deliveredAt, &readAt)
+	if err != nil {
+		return msg, err
+	}
+	// Convert Unix milliseconds to ISO 8601 format WITH millisecond precision
+	msg.CreatedAt = formatMillis(createdAtMs)
+	msg.createdAtMs = createdAtMs
+	msg.Cursor = ChatCursor{CreatedAt: createdAtMs, ID: msg.ID}.String()
+	msg.applyRevision(editedAt, deletedAt)
+	msg.applyReceipts(deliveredAt, readAt)
+	return msg, nil
+}
+
+// Receipt lists the messages that just reached a delivery state ("delivered" or "read")
+type Receipt struct {
+	Status string `json:"status"`
+	IDs    []int  `json:"ids"`
+	At     string `json:"at"`
+}
+
+// CreatedAtMillis returns the creation time as Unix milliseconds
+func (msg ChatMessage) CreatedAtMillis() int64 {
+	return msg.createdAtMs
+}
+
+// applyReceipts fills the delivered/read timestamps
+func (msg *ChatMessage) applyReceipts(deliveredAt, readAt sql.NullInt64) {
+	if deliveredAt.Valid {
+		msg.DeliveredAt = formatMillis(deliveredAt.Int64)
+	}
+	if readAt.Valid {
+		msg.ReadAt = formatMillis(readAt.Int64)
+	}
+}
+
+// applyRevision fills the edited/deleted flags; deleted messages become tombstones without content
+func (msg *ChatMessage) applyRevision(editedAt, deletedAt sql.NullInt64) {
+	if editedAt.Valid {
+		msg.IsEdited = true
+		msg.EditedAt = formatMillis(editedAt.Int64)
+	}
+	if deletedAt.Valid {
+		msg.IsDeleted = true
+		msg.DeletedAt = formatMillis(deletedAt.Int64)
+		msg.Message = ""
+	}
 }
 
-// SaveChatMessage saves a message to the database
-func SaveChatMessage(senderID, receiverID int, message string) error {
-	query := `INSERT INTO chat_messages (sender_id, receiver_id, message, created_at) 
-			  VALUES (?, ?, ?, ?)`
+// SaveChatMessage saves a message to the database and returns the stored row.
+// A clientMsgID the sender already used means the client resent the message:
+// nothing is inserted, and the original row is returned with created false.
+func SaveChatMessage(senderID, receiverID int, message, clientMsgID string) (ChatMessage, bool, error) {
+	query := `INSERT INTO chat_messages (sender_id, receiver_id, message, created_at, client_msg_id) 
+			  VALUES (?, ?, ?, ?, ?)
+			  ON CONFLICT DO NOTHING
+			  RETURNING id`
 
-	_, err := repo.DB.Exec(query, senderID, receiverID, message, time.Now().UnixMilli())
-	return err
+	clientID := sql.NullString{String: clientMsgID, Valid: clientMsgID != ""}
+	var id int
+	created := true
+	err := repo.DB.QueryRow(query, senderID, receiverID, message, time.Now().UnixMilli(), clientID).Scan(&id)
+	if err == sql.ErrNoRows && clientID.Valid {
+		created = false
+		// A reused id in another conversation is a client bug, not a resend
+		err = repo.DB.QueryRow(`SELECT id FROM chat_messages WHERE sender_id = ? AND client_msg_id = ? AND receiver_id = ?`,
+			senderID, clientMsgID, receiverID).Scan(&id)
+	}
+	if err != nil {
+		return ChatMessage{}, false, err
+	}
+	msg, err := GetChatMessageByID(id)
+	return msg, created, err
 }
 
-// GetChatMessages retrieves chat messages between two users with pagination
+// GetChatMessageByClientID returns the message a sender already stored under
+// clientMsgID, or sql.ErrNoRows
+func GetChatMessageByClientID(senderID, receiverID int, clientMsgID string) (ChatMessage, error) {
+	if clientMsgID == "" {
+		return ChatMessage{}, sql.ErrNoRows
+	}
+	var id int
+	err := repo.DB.QueryRow(`SELECT id FROM chat_messages WHERE sender_id = ? AND client_msg_id = ? AND receiver_id = ?`,
+		senderID, clientMsgID, receiverID).Scan(&id)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	return GetChatMessageByID(id)
+}
+
+// GetChatMessages retrieves chat messages between two users with pagination.
+// Deep offsets are slow and shift when new messages arrive; prefer GetChatMessagesBefore.
 func GetChatMessages(userID1, userID2 int, limit, offset int) ([]ChatMessage, error) {
 	query := `
-		SELECT cm.id, cm.sender_id, cm.receiver_id, cm.message, cm.created_at, cm.is_read, u.username
+		SELECT ` + chatMessageColumns + `
 		FROM chat_messages cm
 		JOIN users u ON cm.sender_id = u.id
 		WHERE (cm.sender_id = ? AND cm.receiver_id = ?) 
@@ -45,34 +153,124 @@ func GetChatMessages(userID1, userID2 int, limit, offset int) ([]ChatMessage, er
 
 	var messages []ChatMessage
 	for rows.Next() {
-		var msg ChatMessage
-		var createdAtMs int64 // created_at is stored as milliseconds
-		err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID,
-			&msg.Message, &createdAtMs, &msg.IsRead, &msg.SenderName)
+		msg, err := scanChatMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-		// Convert Unix milliseconds to ISO 8601 format WITH millisecond precision
-		// Use RFC3339Nano so we preserve sub-second precision (milliseconds)
-		msg.CreatedAt = time.UnixMilli(createdAtMs).UTC().Format(time.RFC3339Nano)
 		messages = append(messages, msg)
 	}
 
 	// Reverse the slice to get chronological order (oldest first)
+	reverseChatMessages(messages)
+
+	return messages, attachChatMessageMentions(messages)
+}
+
+// reverseChatMessages flips a newest-first page into chronological order
+func reverseChatMessages(messages []ChatMessage) {
 	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
 		messages[i], messages[j] = messages[j], messages[i]
 	}
+}
 
-	return messages, nil
+// GetChatMessageByID retrieves a single private message
+func GetChatMessageByID(messageID int) (ChatMessage, error) {
+	query := `
+		SELECT ` + chatMessageColumns + `
+		FROM chat_messages cm
+		JOIN users u ON cm.sender_id = u.id
+		WHERE cm.id = ?
+	`
+
+	msg, err := scanChatMessage(repo.DB.QueryRow(query, messageID))
+	if err != nil {
+		return msg, err
+	}
+	msg.Mentions, err = MentionSpans(MentionMessage, msg.ID, msg.Message)
+	return msg, err
 }
 
-// MarkMessagesAsRead marks messages as read
-func MarkMessagesAsRead(senderID, receiverID int) error {
-	query := `UPDATE chat_messages SET is_read = 1 
-			  WHERE sender_id = ? AND receiver_id = ? AND is_read = 0`
+// EditChatMessage replaces the text of a message; only its sender may edit it.
+// sql.ErrNoRows means the message does not exist in this conversation, is not
+// the sender's, or was already deleted.
+func EditChatMessage(messageID, senderID, receiverID int, message string) (ChatMessage, error) {
+	query := `UPDATE chat_messages SET message = ?, edited_at = ?
+			  WHERE id = ? AND sender_id = ? AND receiver_id = ? AND deleted_at IS NULL`
 
-	_, err := repo.DB.Exec(query, senderID, receiverID)
-	return err
+	res, err := repo.DB.Exec(query, message, time.Now().UnixMilli(), messageID, senderID, receiverID)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return ChatMessage{}, err
+	} else if affected == 0 {
+		return ChatMessage{}, sql.ErrNoRows
+	}
+	return GetChatMessageByID(messageID)
+}
+
+// DeleteChatMessage turns a message into a tombstone, which is neither starred
+// nor pinned; only its sender may delete it
+func DeleteChatMessage(messageID, senderID, receiverID int) (ChatMessage, error) {
+	query := `UPDATE chat_messages SET message = '', deleted_at = ?
+			  WHERE id = ? AND sender_id = ? AND receiver_id = ? AND deleted_at IS NULL`
+
+	res, err := repo.DB.Exec(query, time.Now().UnixMilli(), messageID, senderID, receiverID)
+	if err != nil {
+		return ChatMessage{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return ChatMessage{}, err
+	} else if affected == 0 {
+		return ChatMessage{}, sql.ErrNoRows
+	}
+	if err := clearChatMessageMarks(messageID); err != nil {
+		return ChatMessage{}, err
+	}
+	return GetChatMessageByID(messageID)
+}
+
+// updateReceipts runs a receipt UPDATE ... RETURNING id and collects the affected messages
+func updateReceipts(status, query string, args ...any) (Receipt, error) {
+	now := time.Now().UnixMilli()
+	receipt := Receipt{Status: status, IDs: []int{}, At: formatMillis(now)}
+
+	rows, err := repo.DB.Query(query, append([]any{now}, args...)...)
+	if err != nil {
+		return receipt, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return receipt, err
+		}
+		receipt.IDs = append(receipt.IDs, id)
+	}
+	return receipt, rows.Err()
+}
+
+// MarkMessagesDelivered records delivery of every message from sender to receiver up to upToID
+func MarkMessagesDelivered(senderID, receiverID, upToID int) (Receipt, error) {
+	query := `UPDATE chat_messages SET delivered_at = ?1
+			  WHERE sender_id = ?2 AND receiver_id = ?3 AND id <= ?4 AND delivered_at IS NULL
+			  RETURNING id`
+
+	return updateReceipts("delivered", query, senderID, receiverID, upToID)
+}
+
+// MarkMessagesReadUpTo marks every message from sender to receiver up to upToID as read
+func MarkMessagesReadUpTo(senderID, receiverID, upToID int) (Receipt, error) {
+	query := `UPDATE chat_messages SET is_read = 1, read_at = ?1, delivered_at = COALESCE(delivered_at, ?1)
+			  WHERE sender_id = ?2 AND receiver_id = ?3 AND id <= ?4 AND read_at IS NULL
+			  RETURNING id`
+
+	return updateReceipts("read", query, senderID, receiverID, upToID)
+}
+
+// MarkMessagesAsRead marks messages as read
+func MarkMessagesAsRead(senderID, receiverID int) (Receipt, error) {
+	return MarkMessagesReadUpTo(senderID, receiverID, math.MaxInt64)
 }
 
 // GetUserByUsername gets user ID and basic info by username
@@ -101,7 +299,7 @@ func GetUserIDByUsername(username string) (int, error) {
 // GetUnreadMessageCount gets the count of unread messages for a user
 func GetUnreadMessageCount(userID int) (int, error) {
 	var count int
-	query := `SELECT COUNT(*) FROM chat_messages WHERE receiver_id = ? AND is_read = 0`
+	query := `SELECT COUNT(*) FROM chat_messages WHERE receiver_id = ? AND is_read = 0 AND deleted_at IS NULL`
 	err := repo.DB.QueryRow(query, userID).Scan(&count)
 	if err != nil {
 		return 0, err
@@ -109,8 +307,52 @@ func GetUnreadMessageCount(userID int) (int, error) {
 	return count, nil
 }
 
+// ConversationUnread counts the messages of one conversation a user has not read
+type ConversationUnread struct {
+	Conversation Conversation `json:"conversation"`
+	Username     string       `json:"username"`
+	Unread       int          `json:"unread"`
+}
+
+// GetUnreadCounts returns the user's unread private messages per
+// conversation, most recently active first, and their total
+func GetUnreadCounts(userID int) ([]ConversationUnread, int, error) {
+	query := `SELECT cm.sender_id, u.username, COUNT(*)
+			  FROM chat_messages cm
+			  JOIN users u ON u.id = cm.sender_id
+			  WHERE cm.receiver_id = ? AND cm.is_read = 0 AND cm.deleted_at IS NULL
+			  GROUP BY cm.sender_id, u.username
+			  ORDER BY MAX(cm.id) DESC`
+
+	rows, err := repo.DB.Query(query, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	conversations := []ConversationUnread{}
+	total := 0
+	for rows.Next() {
+		c := ConversationUnread{Conversation: Conversation{Kind: ConversationUser}}
+		if err := rows.Scan(&c.Conversation.ID, &c.Username, &c.Unread); err != nil {
+			return nil, 0, err
+		}
+		total += c.Unread
+		conversations = append(conversations, c)
+	}
+	return conversations, total, rows.Err()
+}
+
+// RecentChat is a user the current user has exchanged private messages with
+type RecentChat struct {
+	UserID          int    `json:"user_id"`
+	Username        string `json:"username"`
+	LastMessageTime string `json:"last_message_time"`
+	UnreadCount     int    `json:"unread_count"`
+}
+
 // GetRecentChatUsers gets users that the current user has recently chatted with
-func GetRecentChatUsers(userID int, limit int) ([]map[string]interface{}, error) {
+func GetRecentChatUsers(userID int, limit int) ([]RecentChat, error) {
 	query := `
 		SELECT 
 			u.id as user_id,
@@ -129,36 +371,32 @@ func GetRecentChatUsers(userID int, limit int) ([]map[string]interface{}, error)
 
 	rows, err := repo.DB.Query(query, userID, userID, userID, userID, userID, limit)
 	if err != nil {
-		fmt.Println("GetRecentChatUsers SQL error:", err) // log the SQL error
-		return []map[string]interface{}{}, nil            // return empty list instead of crashing
+		return nil, err
 	}
-
 	defer rows.Close()
 
-	var users []map[string]interface{}
+	users := []RecentChat{}
 	for rows.Next() {
-		var chatUserID int
-		var username string
-		var lastMessageTime time.Time
-		var unreadCount int
-
-		err := rows.Scan(&chatUserID, &username, &lastMessageTime, &unreadCount)
-		if err != nil {
+		var chat RecentChat
+		var lastMessageTime int64
+		if err := rows.Scan(&chat.UserID, &chat.Username, &lastMessageTime, &chat.UnreadCount); err != nil {
 			return nil, err
 		}
-
-		users = append(users, map[string]interface{}{
-			"user_id":           chatUserID,
-			"username":          username,
-			"last_message_time": lastMessageTime,
-			"unread_count":      unreadCount,
-		})
+		chat.LastMessageTime = formatMillis(lastMessageTime)
+		users = append(users, chat)
 	}
+	return users, rows.Err()
+}
 
-	return users, nil
+// LastMessage is when the current user last exchanged a private message with a user
+type LastMessage struct {
+	Username        string `json:"username"`
+	LastMessageTime string `json:"last_message_time"`
 }
 
-func GetLastMessagesForUser(userID int) ([]map[string]interface{}, error) {
+// GetLastMessagesForUser gets the time of the last message with each user the
+// current user has chatted with, most recent first
+func GetLastMessagesForUser(userID int) ([]LastMessage, error) {
 	query := `
         SELECT 
             u.username,
@@ -179,21 +417,15 @@ func GetLastMessagesForUser(userID int) ([]map[string]interface{}, error) {
 	}
 	defer rows.Close()
 
-	var messages []map[string]interface{}
+	messages := []LastMessage{}
 	for rows.Next() {
-		var username string
-		var lastMessageTime time.Time
-
-		err := rows.Scan(&username, &lastMessageTime)
-		if err != nil {
+		var message LastMessage
+		var lastMessageTime int64
+		if err := rows.Scan(&message.Username, &lastMessageTime); err != nil {
 			return nil, err
 		}
-
-		messages = append(messages, map[string]interface{}{
-			"username":          username,
-			"last_message_time": lastMessageTime,
-		})
+		message.LastMessageTime = formatMillis(lastMessageTime)
+		messages = append(messages, message)
 	}
-
-	return messages, nil
+	return messages, rows.Err()
 }
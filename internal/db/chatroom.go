@@ -0,0 +1,401 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	repo "forum/internal/repository"
+	"time"
+)
+
+type ChatRoomMember struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	JoinedAt string `json:"joined_at"`
+}
+
+type ChatRoom struct {
+	ID        int              `json:"id"`
+	Name      string           `json:"name"`
+	OwnerID   int              `json:"owner_id"`
+	CreatedAt string           `json:"created_at"`
+	Members   []ChatRoomMember `json:"members"`
+}
+
+type ChatRoomMessage struct {
+	ID         int    `json:"id"`
+	RoomID     int    `json:"room_id"`
+	SenderID   int    `json:"sender_id"`
+	Message    string `json:"message"`
+	CreatedAt  string `json:"created_at"`
+	SenderName string `json:"sender_name"`
+	IsEdited   bool   `json:"is_edited"`
+	EditedAt   string `json:"edited_at,omitempty"`
+	IsDeleted  bool   `json:"is_deleted"`
+	DeletedAt  string `json:"deleted_at,omitempty"`
+
+	Mentions []repo.Mention `json:"mentions,omitempty"`
+}
+
+// applyRevision fills the edited/deleted flags; deleted messages become tombstones without content
+func (msg *ChatRoomMessage) applyRevision(editedAt, deletedAt sql.NullInt64) {
+	if editedAt.Valid {
+		msg.IsEdited = true
+		msg.EditedAt = formatMillis(editedAt.Int64)
+	}
+	if deletedAt.Valid {
+		msg.IsDeleted = true
+		msg.DeletedAt = formatMillis(deletedAt.Int64)
+		msg.Message = ""
+	}
+}
+
+// formatMillis converts a Unix millisecond timestamp to RFC3339 with millisecond precision
+func formatMillis(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339Nano)
+}
+
+// CreateChatRoom creates a group conversation owned by ownerID with the given members
+func CreateChatRoom(ownerID int, name string, memberIDs []int) (int, error) {
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UnixMilli()
+
+	res, err := tx.Exec(`INSERT INTO chat_rooms (name, owner_id, created_at) VALUES (?, ?, ?)`, name, ownerID, now)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	roomID, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, memberID := range append([]int{ownerID}, memberIDs...) {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO chat_room_members (room_id, user_id, joined_at) VALUES (?, ?, ?)`,
+			roomID, memberID, now)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return int(roomID), tx.Commit()
+}
+
+// GetChatRoom returns a group conversation with its members
+func GetChatRoom(roomID int) (ChatRoom, error) {
+	var room ChatRoom
+	var createdAtMs int64
+	err := repo.DB.QueryRow(`SELECT id, name, owner_id, created_at FROM chat_rooms WHERE id = ?`, roomID).
+		Scan(&room.ID, &room.Name, &room.OwnerID, &createdAtMs)
+	if err != nil {
+		return room, err
+	}
+	room.CreatedAt = formatMillis(createdAtMs)
+
+	room.Members, err = GetChatRoomMembers(roomID)
+	return room, err
+}
+
+// GetChatRoomMembers lists the members of a group conversation in join order
+func GetChatRoomMembers(roomID int) ([]ChatRoomMember, error) {
+	rows, err := repo.DB.Query(`
+		SELECT m.user_id, u.username, m.joined_at
+		FROM chat_room_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = ?
+		ORDER BY m.joined_at, m.user_id`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []ChatRoomMember{}
+	for rows.Next() {
+		var member ChatRoomMember
+		var joinedAtMs int64
+		if err := rows.Scan(&member.UserID, &member.Username, &joinedAtMs); err != nil {
+			return nil, err
+		}
+		member.JoinedAt = formatMillis(joinedAtMs)
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// GetChatRoomsForUser lists the group conversations a user belongs to
+func GetChatRoomsForUser(userID int) ([]ChatRoom, error) {
+	rows, err := repo.DB.Query(`
+		SELECT r.id, r.name, r.owner_id, r.created_at
+		FROM chat_rooms r
+		JOIN chat_room_members m ON m.room_id = r.id
+		WHERE m.user_id = ?
+		ORDER BY r.created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []ChatRoom{}
+	for rows.Next() {
+		var room ChatRoom
+		var createdAtMs int64
+		if err := rows.Scan(&room.ID, &room.Name, &room.OwnerID, &createdAtMs); err != nil {
+			return nil, err
+		}
+		room.CreatedAt = formatMillis(createdAtMs)
+		rooms = append(rooms, room)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range rooms {
+		rooms[i].Members, err = GetChatRoomMembers(rooms[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rooms, nil
+}
+
+// RenameChatRoom changes the display name of a group conversation
+func RenameChatRoom(roomID int, name string) error {
+	_, err := repo.DB.Exec(`UPDATE chat_rooms SET name = ? WHERE id = ?`, name, roomID)
+	return err
+}
+
+// AddChatRoomMember adds a user to a group conversation, ignoring existing members
+func AddChatRoomMember(roomID, userID int) error {
+	_, err := repo.DB.Exec(`INSERT OR IGNORE INTO chat_room_members (room_id, user_id, joined_at) VALUES (?, ?, ?)`,
+		roomID, userID, time.Now().UnixMilli())
+	return err
+}
+
+// RemoveChatRoomMember removes a user from a group conversation.
+// When the owner leaves, ownership passes to the longest-standing member,
+// and a room left without members is deleted.
+func RemoveChatRoomMember(roomID, userID int) (bool, error) {
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM chat_room_members WHERE room_id = ? AND user_id = ?`, roomID, userID)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if removed == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	var nextOwner int
+	err = tx.QueryRow(`SELECT user_id FROM chat_room_members WHERE room_id = ? ORDER BY joined_at, user_id LIMIT 1`, roomID).
+		Scan(&nextOwner)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Nobody left: the messages and their mentions go with the room
+		_, err = tx.Exec(`DELETE FROM mentions WHERE source = ? AND source_id IN (SELECT id FROM chat_room_messages WHERE room_id = ?)`,
+			MentionRoomMessage, roomID)
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		if _, err = tx.Exec(`DELETE FROM chat_room_messages WHERE room_id = ?`, roomID); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		if _, err = tx.Exec(`DELETE FROM chat_rooms WHERE id = ?`, roomID); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		return true, tx.Commit()
+	} else if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	_, err = tx.Exec(`UPDATE chat_rooms SET owner_id = ? WHERE id = ? AND owner_id = ?`, nextOwner, roomID, userID)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// IsChatRoomMember reports whether a user belongs to a group conversation
+func IsChatRoomMember(roomID, userID int) (bool, error) {
+	var exists int
+	err := repo.DB.QueryRow(`SELECT 1 FROM chat_room_members WHERE room_id = ? AND user_id = ?`, roomID, userID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetChatRoomMemberIDs returns the member set of a group conversation keyed by user ID
+func GetChatRoomMemberIDs(roomID int) (map[int]string, error) {
+	rows, err := repo.DB.Query(`
+		SELECT m.user_id, u.username
+		FROM chat_room_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = ?`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[int]string)
+	for rows.Next() {
+		var userID int
+		var username string
+		if err := rows.Scan(&userID, &username); err != nil {
+			return nil, err
+		}
+		members[userID] = username
+	}
+	return members, rows.Err()
+}
+
+// SaveChatRoomMessage stores a group message and returns the stored row. A
+// non-empty clientMsgID makes the call idempotent: resending returns the
+// message already stored under it, with created false.
+func SaveChatRoomMessage(roomID, senderID int, message, clientMsgID string) (ChatRoomMessage, bool, error) {
+	query := `INSERT INTO chat_room_messages (room_id, sender_id, message, created_at, client_msg_id)
+			  VALUES (?, ?, ?, ?, ?)
+			  ON CONFLICT DO NOTHING
+			  RETURNING id`
+
+	clientID := sql.NullString{String: clientMsgID, Valid: clientMsgID != ""}
+	var id int
+	created := true
+	err := repo.DB.QueryRow(query, roomID, senderID, message, time.Now().UnixMilli(), clientID).Scan(&id)
+	if err == sql.ErrNoRows && clientID.Valid {
+		created = false
+		// A reused id in another room is a client bug, not a resend
+		err = repo.DB.QueryRow(`SELECT id FROM chat_room_messages WHERE sender_id = ? AND client_msg_id = ? AND room_id = ?`,
+			senderID, clientMsgID, roomID).Scan(&id)
+	}
+	if err != nil {
+		return ChatRoomMessage{}, false, err
+	}
+	msg, err := GetChatRoomMessageByID(id)
+	return msg, created, err
+}
+
+// GetChatRoomMessageByClientID returns the group message a sender already
+// stored under clientMsgID, or sql.ErrNoRows
+func GetChatRoomMessageByClientID(roomID, senderID int, clientMsgID string) (ChatRoomMessage, error) {
+	if clientMsgID == "" {
+		return ChatRoomMessage{}, sql.ErrNoRows
+	}
+	var id int
+	err := repo.DB.QueryRow(`SELECT id FROM chat_room_messages WHERE sender_id = ? AND client_msg_id = ? AND room_id = ?`,
+		senderID, clientMsgID, roomID).Scan(&id)
+	if err != nil {
+		return ChatRoomMessage{}, err
+	}
+	return GetChatRoomMessageByID(id)
+}
+
+// GetChatRoomMessages retrieves group messages with pagination, oldest first
+func GetChatRoomMessages(roomID, limit, offset int) ([]ChatRoomMessage, error) {
+	rows, err := repo.DB.Query(`
+		SELECT m.id, m.room_id, m.sender_id, m.message, m.created_at, u.username, m.edited_at, m.deleted_at
+		FROM chat_room_messages m
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.room_id = ?
+		ORDER BY m.created_at DESC, m.id DESC
+		LIMIT ? OFFSET ?`, roomID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []ChatRoomMessage{}
+	for rows.Next() {
+		var msg ChatRoomMessage
+		var createdAtMs int64
+		var editedAt, deletedAt sql.NullInt64
+		if err := rows.Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Message, &createdAtMs, &msg.SenderName,
+			&editedAt, &deletedAt); err != nil {
+			return nil, err
+		}
+		msg.CreatedAt = formatMillis(createdAtMs)
+		msg.applyRevision(editedAt, deletedAt)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Reverse the slice to get chronological order (oldest first)
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, attachChatRoomMessageMentions(messages)
+}
+
+// GetChatRoomMessageByID retrieves a single group message
+func GetChatRoomMessageByID(messageID int) (ChatRoomMessage, error) {
+	var msg ChatRoomMessage
+	var createdAtMs int64
+	var editedAt, deletedAt sql.NullInt64
+	err := repo.DB.QueryRow(`
+		SELECT m.id, m.room_id, m.sender_id, m.message, m.created_at, u.username, m.edited_at, m.deleted_at
+		FROM chat_room_messages m
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.id = ?`, messageID).
+		Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Message, &createdAtMs, &msg.SenderName, &editedAt, &deletedAt)
+	if err != nil {
+		return msg, err
+	}
+	msg.CreatedAt = formatMillis(createdAtMs)
+	msg.applyRevision(editedAt, deletedAt)
+	msg.Mentions, err = MentionSpans(MentionRoomMessage, msg.ID, msg.Message)
+	return msg, err
+}
+
+// EditChatRoomMessage replaces the text of a group message; only its sender may edit it
+func EditChatRoomMessage(roomID, messageID, senderID int, message string) (ChatRoomMessage, error) {
+	res, err := repo.DB.Exec(`
+		UPDATE chat_room_messages SET message = ?, edited_at = ?
+		WHERE id = ? AND room_id = ? AND sender_id = ? AND deleted_at IS NULL`,
+		message, time.Now().UnixMilli(), messageID, roomID, senderID)
+	if err != nil {
+		return ChatRoomMessage{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return ChatRoomMessage{}, err
+	} else if affected == 0 {
+		return ChatRoomMessage{}, sql.ErrNoRows
+	}
+	return GetChatRoomMessageByID(messageID)
+}
+
+// DeleteChatRoomMessage turns a group message into a tombstone; only its sender may delete it
+func DeleteChatRoomMessage(roomID, messageID, senderID int) (ChatRoomMessage, error) {
+	res, err := repo.DB.Exec(`
+		UPDATE chat_room_messages SET message = '', deleted_at = ?
+		WHERE id = ? AND room_id = ? AND sender_id = ? AND deleted_at IS NULL`,
+		time.Now().UnixMilli(), messageID, roomID, senderID)
+	if err != nil {
+		return ChatRoomMessage{}, err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return ChatRoomMessage{}, err
+	} else if affected == 0 {
+		return ChatRoomMessage{}, sql.ErrNoRows
+	}
+	return GetChatRoomMessageByID(messageID)
+}
@@ -5,12 +5,26 @@ import (
 	"database/sql"
 	"html"
 	"html/template"
+	"log"
 	"strings"
 )
 
 func AddNewComment(userId int, postId int, comment string) error {
-	_, err := repo.DB.Exec(repo.INSERT_NEW_COMMENT, userId, postId, comment)
-	return err
+	res, err := repo.DB.Exec(repo.INSERT_NEW_COMMENT, userId, postId, comment)
+	if err != nil {
+		return err
+	}
+	commentId, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, mentioned, err := SaveMentions(MentionComment, int(commentId), userId, comment)
+	if err != nil {
+		log.Printf("Error recording mentions of comment %d: %v", commentId, err)
+	}
+	notifyMentions(mentioned, userId, postId, int(commentId))
+	notifyNewComment(userId, postId, int(commentId), mentioned)
+	return nil
 }
 
 func IsUserCanCommentToday(userId int) (bool, error) {
@@ -22,10 +36,11 @@ func IsUserCanCommentToday(userId int) (bool, error) {
 	return commentCount < repo.DAY_COMMENTS_LIMIT, nil
 }
 
-func GetCommentCount(postId int) (int, error) {
+// GetCommentCount counts the comments of a post the user can see
+func GetCommentCount(postId int, userId int) (int, error) {
 	var count int
 
-	err := repo.DB.QueryRow(repo.GET_COMMENT_POST_COUNT, postId).Scan(&count)
+	err := repo.DB.QueryRow(repo.GET_VISIBLE_COMMENT_POST_COUNT, postId, userId).Scan(&count)
 
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -38,7 +53,7 @@ func GetCommentCount(postId int) (int, error) {
 func GetCommentsByPostPaginated(postID, page, userID int) ([]repo.Comment, int, error) {
 	offset := (page - 1) * repo.PAGE_COMMENT_QUANTITY
 
-	rows, err := repo.DB.Query(repo.SELECT_COMMENT_BY_10, postID, repo.PAGE_COMMENT_QUANTITY, offset)
+	rows, err := repo.DB.Query(repo.SELECT_COMMENT_BY_10, postID, userID, repo.PAGE_COMMENT_QUANTITY, offset)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -73,9 +88,12 @@ func GetCommentsByPostPaginated(postID, page, userID int) ([]repo.Comment, int,
 		}
 		comments = append(comments, c)
 	}
+	if err := attachCommentMentions(comments); err != nil {
+		return nil, 0, err
+	}
 	var total int
 
-	err = repo.DB.QueryRow(repo.GET_COMMENT_POST_COUNT, postID).Scan(&total)
+	err = repo.DB.QueryRow(repo.GET_VISIBLE_COMMENT_POST_COUNT, postID, userID).Scan(&total)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -128,6 +146,9 @@ func AddRemoveCommentLike(userId, commentId int) error {
 	isLiked, err := IsCommentLikedByUser(userId, commentId)
 	if err == sql.ErrNoRows {
 		_, err = repo.DB.Exec(repo.INSERT_COMMENT_LIKE_DISLIKE, userId, commentId, 1, 0)
+		if err == nil {
+			notifyCommentLike(userId, commentId)
+		}
 		return err
 	}
 	if isLiked {
@@ -135,6 +156,7 @@ func AddRemoveCommentLike(userId, commentId int) error {
 		if err != nil {
 			return err
 		}
+		removeNotification(userId, NotificationCommentLike, 0, commentId)
 		_, err = res.RowsAffected()
 		return err
 	}
@@ -142,6 +164,7 @@ func AddRemoveCommentLike(userId, commentId int) error {
 	if err != nil {
 		return err
 	}
+	notifyCommentLike(userId, commentId)
 	_, err = res.RowsAffected()
 	return err
 }
@@ -164,6 +187,8 @@ func AddRemoveCommentDislike(userId, commentId int) error {
 	if err != nil {
 		return err
 	}
+	// A dislike replaces any like
+	removeNotification(userId, NotificationCommentLike, 0, commentId)
 	_, err = res.RowsAffected()
 	return err
 }
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"database/sql"
+	repo "forum/internal/repository"
+	"time"
+	"unicode/utf8"
+)
+
+// ConversationSummary is one entry of a user's conversation list: the peer,
+// the last message, and the user's unread count and mute for it
+type ConversationSummary struct {
+	Conversation Conversation         `json:"conversation"`
+	UserID       int                  `json:"user_id"`
+	Username     string               `json:"username"`
+	Online       bool                 `json:"online"`
+	LastMessage  *ConversationPreview `json:"last_message"` // nil before the first message
+	LastActivity string               `json:"last_activity,omitempty"`
+	Unread       int                  `json:"unread"`
+	Muted        bool                 `json:"muted"`
+	MutedUntil   string               `json:"muted_until,omitempty"`
+	Cursor       string               `json:"cursor"`
+}
+
+// ConversationPreview is the start of a conversation's last message
+type ConversationPreview struct {
+	ID        int    `json:"id"`
+	SenderID  int    `json:"sender_id"`
+	Message   string `json:"message"`
+	Truncated bool   `json:"truncated"`
+	IsDeleted bool   `json:"is_deleted"`
+	CreatedAt string `json:"created_at"`
+}
+
+// GetConversations returns a page of the user's private conversations, most
+// recently active first, and whether more follow. Every user the caller has
+// not blocked is a conversation; those never written to come last. Pass nil
+// for the first page, then the cursor of the last entry.
+func GetConversations(userID int, before *ChatCursor, limit int) ([]ConversationSummary, bool, error) {
+	query := `
+		WITH last AS (
+			SELECT CASE WHEN sender_id = ?1 THEN receiver_id ELSE sender_id END AS peer_id, MAX(id) AS message_id
+			FROM chat_messages
+			WHERE sender_id = ?1 OR receiver_id = ?1
+			GROUP BY peer_id
+		), unread AS (
+			SELECT sender_id AS peer_id, COUNT(*) AS unread
+			FROM chat_messages
+			WHERE receiver_id = ?1 AND is_read = 0 AND deleted_at IS NULL
+			GROUP BY sender_id
+		)
+		SELECT u.id, u.username, COALESCE(u.online, 0),
+		       cm.id, cm.sender_id, cm.message, cm.created_at, cm.deleted_at,
+		       COALESCE(un.unread, 0), mu.user_id IS NOT NULL, mu.muted_until,
+		       COALESCE(cm.created_at, 0) AS last_at
+		FROM users u
+		LEFT JOIN last l ON l.peer_id = u.id
+		LEFT JOIN chat_messages cm ON cm.id = l.message_id
+		LEFT JOIN unread un ON un.peer_id = u.id
+		LEFT JOIN conversation_mutes mu ON mu.user_id = ?1 AND mu.kind = 'user' AND mu.target_id = u.id
+		     AND (mu.muted_until IS NULL OR mu.muted_until > ?2)
+		WHERE u.id != ?1
+		  AND NOT EXISTS (SELECT 1 FROM blocked_users b WHERE b.blocker_id = ?1 AND b.blocked_id = u.id)
+		  AND (COALESCE(cm.created_at, 0) < ?3 OR (COALESCE(cm.created_at, 0) = ?3 AND u.id > ?4))
+		ORDER BY last_at DESC, u.id ASC
+		LIMIT ?5`
+
+	cursor := latestChatCursor
+	if before != nil {
+		cursor = *before
+	} else {
+		cursor.ID = 0
+	}
+	rows, err := repo.DB.Query(query, userID, time.Now().UnixMilli(), cursor.CreatedAt, cursor.ID, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	conversations := []ConversationSummary{}
+	for rows.Next() {
+		var c ConversationSummary
+		var messageID, senderID, createdAt, deletedAt, mutedUntil sql.NullInt64
+		var message sql.NullString
+		var lastAt int64
+		err := rows.Scan(&c.UserID, &c.Username, &c.Online,
+			&messageID, &senderID, &message, &createdAt, &deletedAt,
+			&c.Unread, &c.Muted, &mutedUntil, &lastAt)
+		if err != nil {
+			return nil, false, err
+		}
+		c.Conversation = Conversation{Kind: ConversationUser, ID: c.UserID}
+		if messageID.Valid {
+			c.LastMessage = newConversationPreview(int(messageID.Int64), int(senderID.Int64), message.String, createdAt.Int64, deletedAt.Valid)
+			c.LastActivity = c.LastMessage.CreatedAt
+		}
+		if mutedUntil.Valid {
+			c.MutedUntil = formatMillis(mutedUntil.Int64)
+		}
+		c.Cursor = ChatCursor{CreatedAt: lastAt, ID: c.UserID}.String()
+		conversations = append(conversations, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(conversations) > limit
+	if hasMore {
+		conversations = conversations[:limit]
+	}
+	return conversations, hasMore, nil
+}
+
+// newConversationPreview cuts a message down to CONVERSATION_PREVIEW_MAX_LEN
+// characters; deleted messages have no text
+func newConversationPreview(id, senderID int, message string, createdAt int64, deleted bool) *ConversationPreview {
+	preview := &ConversationPreview{ID: id, SenderID: senderID, IsDeleted: deleted, CreatedAt: formatMillis(createdAt)}
+	if deleted {
+		return preview
+	}
+	if utf8.RuneCountInString(message) > repo.CONVERSATION_PREVIEW_MAX_LEN {
+		message = string([]rune(message)[:repo.CONVERSATION_PREVIEW_MAX_LEN])
+		preview.Truncated = true
+	}
+	preview.Message = message
+	return preview
+}
@@ -30,6 +30,26 @@ func CreateTabale(db *sql.DB) error {
 		return err
 	}
 	db.Exec(`ALTER TABLE users ADD COLUMN online BOOLEAN DEFAULT 0`)
+	// Message revisions; these fail harmlessly once the columns exist
+	db.Exec(`ALTER TABLE chat_messages ADD COLUMN edited_at INTEGER`)
+	db.Exec(`ALTER TABLE chat_messages ADD COLUMN deleted_at INTEGER`)
+	db.Exec(`ALTER TABLE chat_room_messages ADD COLUMN edited_at INTEGER`)
+	db.Exec(`ALTER TABLE chat_room_messages ADD COLUMN deleted_at INTEGER`)
+	// Delivery receipts
+	db.Exec(`ALTER TABLE chat_messages ADD COLUMN delivered_at INTEGER`)
+	db.Exec(`ALTER TABLE chat_messages ADD COLUMN read_at INTEGER`)
+	// Idempotent sends; the index needs the column, so it cannot live in schema.sql
+	db.Exec(`ALTER TABLE chat_messages ADD COLUMN client_msg_id TEXT`)
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_messages_client_msg
+		ON chat_messages (sender_id, client_msg_id) WHERE client_msg_id IS NOT NULL`); err != nil {
+		return err
+	}
+	db.Exec(`ALTER TABLE chat_room_messages ADD COLUMN client_msg_id TEXT`)
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_room_messages_client_msg
+		ON chat_room_messages (sender_id, client_msg_id) WHERE client_msg_id IS NOT NULL`); err != nil {
+		return err
+	}
+	initChatSearch(db)
 	return nil
 }
 
@@ -41,7 +41,7 @@ func Getposbytlikes(userId int, page int) (repo.PageData, error) {
 
 		post.IsEdited = post.Created_at != post.Updated_at
 		post.IsLikedByUser = true
-		post.CommentsCount, err = GetCommentCount(post.Id)
+		post.CommentsCount, err = GetCommentCount(post.Id, userId)
 		if err != nil {
 			return data, err
 		}
@@ -59,7 +59,7 @@ func Getposbytlikes(userId int, page int) (repo.PageData, error) {
 	if err := rows.Err(); err != nil {
 		return data, err
 	}
-	return data, nil
+	return data, attachPostMentions(data.Posts)
 }
 
 func Getpostbyowner(userId int, page int) (repo.PageData, error) {
@@ -108,7 +108,7 @@ func Getpostbyowner(userId int, page int) (repo.PageData, error) {
 		if userId == post.PublisherId {
 			post.Owned = true
 		}
-		post.CommentsCount, err = GetCommentCount(post.Id)
+		post.CommentsCount, err = GetCommentCount(post.Id, userId)
 		if err != nil {
 			return data, err
 		}
@@ -123,13 +123,13 @@ func Getpostbyowner(userId int, page int) (repo.PageData, error) {
 	if err := rows.Err(); err != nil {
 		return data, err
 	}
-	return data, nil
+	return data, attachPostMentions(data.Posts)
 }
 
 func GePostbycategory(category string, page int, userId int) (repo.PageData, error) {
 	var data repo.PageData
 
-	rows, err := repo.DB.Query(repo.GET_POST_BYCATEGORY, category, repo.PAGE_POSTS_QUANTITY, (page-1)*repo.PAGE_POSTS_QUANTITY)
+	rows, err := repo.DB.Query(repo.GET_POST_BYCATEGORY, category, userId, repo.PAGE_POSTS_QUANTITY, (page-1)*repo.PAGE_POSTS_QUANTITY)
 	if err != nil {
 		return data, err
 	}
@@ -169,7 +169,7 @@ func GePostbycategory(category string, page int, userId int) (repo.PageData, err
 		if userId == post.PublisherId {
 			post.Owned = true
 		}
-		post.CommentsCount, err = GetCommentCount(post.Id)
+		post.CommentsCount, err = GetCommentCount(post.Id, userId)
 		if err != nil {
 			return data, err
 		}
@@ -186,5 +186,5 @@ func GePostbycategory(category string, page int, userId int) (repo.PageData, err
 	if err := rows.Err(); err != nil {
 		return data, err
 	}
-	return data, nil
+	return data, attachPostMentions(data.Posts)
 }
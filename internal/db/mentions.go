@@ -0,0 +1,258 @@
+package db
+
+import (
+	"database/sql"
+	repo "forum/internal/repository"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Where a mention was made
+const (
+	MentionPost        = "post"
+	MentionComment     = "comment"
+	MentionMessage     = "message"      // private message
+	MentionRoomMessage = "room_message" // group message
+)
+
+// mentionRef is an @username reference found in a text, at byte offsets
+type mentionRef struct {
+	name       string
+	start, end int
+}
+
+// findMentions returns the @username references in text. A reference starts
+// at an @ that does not follow a word character, so e-mail addresses are not
+// references, and trailing dots are taken as punctuation.
+func findMentions(text string) []mentionRef {
+	var refs []mentionRef
+	for i := 0; i < len(text); i++ {
+		if text[i] != '@' {
+			continue
+		}
+		if i > 0 && (isUsernameByte(text[i-1]) || text[i-1] == '@') {
+			continue
+		}
+		end := i + 1
+		for end < len(text) && isUsernameByte(text[end]) {
+			end++
+		}
+		next := end
+		for end > i+1 && text[end-1] == '.' {
+			end--
+		}
+		name := text[i+1 : end]
+		if len(name) >= repo.USERNAME_MIN_LEN && len(name) <= repo.USERNAME_MAX_LEN && isASCIILetter(name[0]) {
+			refs = append(refs, mentionRef{name: name, start: i, end: end})
+		}
+		i = next - 1
+	}
+	return refs
+}
+
+// isUsernameByte reports whether b can be part of a username
+func isUsernameByte(b byte) bool {
+	return isASCIILetter(b) || b >= '0' && b <= '9' || b == '_' || b == '.'
+}
+
+func isASCIILetter(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// utf16Len counts the UTF-16 code units of s
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// spansOf locates the references in text to the mentioned users, by username
+func spansOf(text string, users map[string]int) []repo.Mention {
+	spans := []repo.Mention{}
+	if len(users) == 0 {
+		return spans
+	}
+	offset, consumed := 0, 0
+	for _, ref := range findMentions(text) {
+		userID, ok := users[ref.name]
+		if !ok {
+			continue
+		}
+		offset += utf16Len(text[consumed:ref.start])
+		consumed = ref.start
+		spans = append(spans, repo.Mention{
+			UserID:   userID,
+			Username: ref.name,
+			Start:    offset,
+			End:      offset + utf16Len(text[ref.start:ref.end]),
+		})
+	}
+	return spans
+}
+
+// SaveMentions records the users text mentions from source sourceID,
+// replacing what an earlier version of the text mentioned. It returns the
+// spans of the mentions and the users who were not mentioned there before.
+// Names that are not users are left as plain text, and so is every user past
+// MENTIONS_MAX_PER_TEXT.
+func SaveMentions(source string, sourceID, authorID int, text string) ([]repo.Mention, []int, error) {
+	users := make(map[string]int)
+	for _, ref := range findMentions(text) {
+		if len(users) == repo.MENTIONS_MAX_PER_TEXT {
+			break
+		}
+		if _, seen := users[ref.name]; seen {
+			continue
+		}
+		userID, err := GetUserIDByUsername(ref.name)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		users[ref.name] = userID
+	}
+
+	previous, err := mentionedUsers(source, []int{sourceID})
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, userID := range previous[sourceID] {
+		if _, still := users[name]; still {
+			continue
+		}
+		if _, err := repo.DB.Exec(`DELETE FROM mentions WHERE source = ? AND source_id = ? AND user_id = ?`,
+			source, sourceID, userID); err != nil {
+			return nil, nil, err
+		}
+	}
+	var added []int
+	now := time.Now().UnixMilli()
+	for _, userID := range users {
+		res, err := repo.DB.Exec(`INSERT OR IGNORE INTO mentions (source, source_id, user_id, author_id, created_at) VALUES (?, ?, ?, ?, ?)`,
+			source, sourceID, userID, authorID, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			added = append(added, userID)
+		}
+	}
+	return spansOf(text, users), added, nil
+}
+
+// DeleteMentions forgets the mentions of a source that no longer has a text,
+// such as a deleted message
+func DeleteMentions(source string, sourceID int) error {
+	_, err := repo.DB.Exec(`DELETE FROM mentions WHERE source = ? AND source_id = ?`, source, sourceID)
+	return err
+}
+
+// MentionSpans locates the recorded mentions of source sourceID in text,
+// which may be the stored text or a rendering of it that keeps usernames as is
+func MentionSpans(source string, sourceID int, text string) ([]repo.Mention, error) {
+	users, err := mentionedUsers(source, []int{sourceID})
+	if err != nil {
+		return nil, err
+	}
+	return spansOf(text, users[sourceID]), nil
+}
+
+// mentionedUsers loads the users mentioned from each of the sources, by username
+func mentionedUsers(source string, sourceIDs []int) (map[int]map[string]int, error) {
+	mentioned := make(map[int]map[string]int)
+	if len(sourceIDs) == 0 {
+		return mentioned, nil
+	}
+	args := []any{source}
+	for _, id := range sourceIDs {
+		args = append(args, id)
+	}
+	rows, err := repo.DB.Query(`SELECT m.source_id, u.id, u.username FROM mentions m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.source = ? AND m.source_id IN (?`+strings.Repeat(", ?", len(sourceIDs)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sourceID, userID int
+		var username string
+		if err := rows.Scan(&sourceID, &userID, &username); err != nil {
+			return nil, err
+		}
+		if mentioned[sourceID] == nil {
+			mentioned[sourceID] = make(map[string]int)
+		}
+		mentioned[sourceID][username] = userID
+	}
+	return mentioned, rows.Err()
+}
+
+// attachChatMessageMentions fills the mention spans of private messages
+func attachChatMessageMentions(messages []ChatMessage) error {
+	ids := make([]int, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	mentioned, err := mentionedUsers(MentionMessage, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Mentions = spansOf(messages[i].Message, mentioned[messages[i].ID])
+	}
+	return nil
+}
+
+// attachChatRoomMessageMentions fills the mention spans of group messages
+func attachChatRoomMessageMentions(messages []ChatRoomMessage) error {
+	ids := make([]int, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	mentioned, err := mentionedUsers(MentionRoomMessage, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Mentions = spansOf(messages[i].Message, mentioned[messages[i].ID])
+	}
+	return nil
+}
+
+// attachPostMentions fills the mention spans of posts' content
+func attachPostMentions(posts []repo.Post) error {
+	ids := make([]int, len(posts))
+	for i, post := range posts {
+		ids[i] = post.Id
+	}
+	mentioned, err := mentionedUsers(MentionPost, ids)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Mentions = spansOf(posts[i].Content, mentioned[posts[i].Id])
+	}
+	return nil
+}
+
+// attachCommentMentions fills the mention spans of comments, in their
+// rendered content
+func attachCommentMentions(comments []repo.Comment) error {
+	ids := make([]int, len(comments))
+	for i, comment := range comments {
+		ids[i] = comment.CommentId
+	}
+	mentioned, err := mentionedUsers(MentionComment, ids)
+	if err != nil {
+		return err
+	}
+	for i := range comments {
+		comments[i].Mentions = spansOf(string(comments[i].Content), mentioned[comments[i].CommentId])
+	}
+	return nil
+}
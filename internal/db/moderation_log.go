@@ -0,0 +1,21 @@
+package db
+
+import (
+	repo "forum/internal/repository"
+	"time"
+)
+
+// SaveModerationLog records a moderation decision; reasons is a JSON array
+func SaveModerationLog(userID int, kind, action, reasons, content string) error {
+	query := `INSERT INTO moderation_log (user_id, kind, action, reasons, content, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+
+	_, err := repo.DB.Exec(query, userID, kind, action, reasons, content, time.Now().UnixMilli())
+	return err
+}
+
+// GetUserCreatedAt returns when an account was registered
+func GetUserCreatedAt(userID int) (time.Time, error) {
+	var created time.Time
+	err := repo.DB.QueryRow(`SELECT created_at FROM users WHERE id = ?`, userID).Scan(&created)
+	return created, err
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	repo "forum/internal/repository"
+	"time"
+)
+
+// Conversation kinds a user can mute
+const (
+	ConversationUser = "user" // private conversation, ID is the other user
+	ConversationRoom = "room" // group conversation, ID is the room
+)
+
+// Conversation identifies a private or group conversation
+type Conversation struct {
+	Kind string `json:"kind"`
+	ID   int    `json:"id"`
+}
+
+// NotificationSettings are a user's push preferences. Quiet hours are
+// "HH:MM" in Timezone and may wrap past midnight; empty means none.
+type NotificationSettings struct {
+	DoNotDisturb   bool     `json:"do_not_disturb"`
+	QuietStart     string   `json:"quiet_hours_start"`
+	QuietEnd       string   `json:"quiet_hours_end"`
+	Timezone       string   `json:"timezone"`
+	DisabledEvents []string `json:"disabled_events"`
+}
+
+// ConversationMute is a muted conversation; Until is empty for an open-ended mute
+type ConversationMute struct {
+	Conversation
+	Until string `json:"until,omitempty"`
+}
+
+// GetNotificationSettings returns a user's settings, or the defaults
+func GetNotificationSettings(userID int) (NotificationSettings, error) {
+	settings := NotificationSettings{Timezone: "UTC", DisabledEvents: []string{}}
+	var quietStart, quietEnd sql.NullInt64
+	err := repo.DB.QueryRow(`SELECT do_not_disturb, quiet_start, quiet_end, timezone FROM notification_settings WHERE user_id = ?`,
+		userID).Scan(&settings.DoNotDisturb, &quietStart, &quietEnd, &settings.Timezone)
+	if err != nil && err != sql.ErrNoRows {
+		return settings, err
+	}
+	if quietStart.Valid && quietEnd.Valid {
+		settings.QuietStart = formatMinutes(quietStart.Int64)
+		settings.QuietEnd = formatMinutes(quietEnd.Int64)
+	}
+
+	rows, err := repo.DB.Query(`SELECT event_type FROM notification_disabled_events WHERE user_id = ? ORDER BY event_type`, userID)
+	if err != nil {
+		return settings, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventType string
+		if err := rows.Scan(&eventType); err != nil {
+			return settings, err
+		}
+		settings.DisabledEvents = append(settings.DisabledEvents, eventType)
+	}
+	return settings, rows.Err()
+}
+
+// SaveNotificationSettings replaces a user's settings. Callers validate the
+// quiet hours with ParseClock and the timezone with time.LoadLocation.
+func SaveNotificationSettings(userID int, settings NotificationSettings) error {
+	var quietStart, quietEnd sql.NullInt64
+	if settings.QuietStart != "" && settings.QuietEnd != "" {
+		start, err := ParseClock(settings.QuietStart)
+		if err != nil {
+			return err
+		}
+		end, err := ParseClock(settings.QuietEnd)
+		if err != nil {
+			return err
+		}
+		quietStart = sql.NullInt64{Int64: int64(start), Valid: true}
+		quietEnd = sql.NullInt64{Int64: int64(end), Valid: true}
+	}
+
+	tx, err := repo.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO notification_settings (user_id, do_not_disturb, quiet_start, quiet_end, timezone)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET
+				do_not_disturb = excluded.do_not_disturb,
+				quiet_start = excluded.quiet_start,
+				quiet_end = excluded.quiet_end,
+				timezone = excluded.timezone`,
+		userID, settings.DoNotDisturb, quietStart, quietEnd, settings.Timezone)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM notification_disabled_events WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, eventType := range settings.DisabledEvents {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO notification_disabled_events (user_id, event_type) VALUES (?, ?)`,
+			userID, eventType); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// EventEnabled reports whether pushes of this event type are wanted
+func (s NotificationSettings) EventEnabled(eventType string) bool {
+	for _, disabled := range s.DisabledEvents {
+		if disabled == eventType {
+			return false
+		}
+	}
+	return true
+}
+
+// InQuietHours reports whether now falls inside the quiet hours
+func (s NotificationSettings) InQuietHours(now time.Time) bool {
+	start, err := ParseClock(s.QuietStart)
+	if err != nil {
+		return false
+	}
+	end, err := ParseClock(s.QuietEnd)
+	if err != nil || start == end {
+		return false
+	}
+	if loc, err := time.LoadLocation(s.Timezone); err == nil {
+		now = now.In(loc)
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	// Wraps past midnight, e.g. 22:00-07:00
+	return minute >= start || minute < end
+}
+
+// ParseClock parses "HH:MM" into minutes after midnight
+func ParseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// formatMinutes formats minutes after midnight as "HH:MM"
+func formatMinutes(minutes int64) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// MuteConversation mutes a conversation until the given time, or until unmuted when until is nil
+func MuteConversation(userID int, conv Conversation, until *time.Time) error {
+	var mutedUntil sql.NullInt64
+	if until != nil {
+		mutedUntil = sql.NullInt64{Int64: until.UnixMilli(), Valid: true}
+	}
+	_, err := repo.DB.Exec(`INSERT INTO conversation_mutes (user_id, kind, target_id, muted_until) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, kind, target_id) DO UPDATE SET muted_until = excluded.muted_until`,
+		userID, conv.Kind, conv.ID, mutedUntil)
+	return err
+}
+
+// UnmuteConversation removes a mute, reporting whether there was one
+func UnmuteConversation(userID int, conv Conversation) (bool, error) {
+	res, err := repo.DB.Exec(`DELETE FROM conversation_mutes WHERE user_id = ? AND kind = ? AND target_id = ?`,
+		userID, conv.Kind, conv.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// IsConversationMuted reports whether the user has a mute on the conversation that has not expired
+func IsConversationMuted(userID int, conv Conversation, now time.Time) (bool, error) {
+	var muted bool
+	err := repo.DB.QueryRow(`SELECT EXISTS (
+				SELECT 1 FROM conversation_mutes
+				WHERE user_id = ? AND kind = ? AND target_id = ? AND (muted_until IS NULL OR muted_until > ?)
+			)`, userID, conv.Kind, conv.ID, now.UnixMilli()).Scan(&muted)
+	return muted, err
+}
+
+// GetConversationMutes lists a user's mutes that have not expired
+func GetConversationMutes(userID int, now time.Time) ([]ConversationMute, error) {
+	rows, err := repo.DB.Query(`SELECT kind, target_id, muted_until FROM conversation_mutes
+			WHERE user_id = ? AND (muted_until IS NULL OR muted_until > ?)
+			ORDER BY kind, target_id`, userID, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mutes := []ConversationMute{}
+	for rows.Next() {
+		var mute ConversationMute
+		var until sql.NullInt64
+		if err := rows.Scan(&mute.Kind, &mute.ID, &until); err != nil {
+			return nil, err
+		}
+		if until.Valid {
+			mute.Until = formatMillis(until.Int64)
+		}
+		mutes = append(mutes, mute)
+	}
+	return mutes, rows.Err()
+}
@@ -0,0 +1,294 @@
+package db
+
+import (
+	"database/sql"
+	repo "forum/internal/repository"
+	"log"
+	"time"
+)
+
+// Forum activity a user is notified of
+const (
+	NotificationComment     = "comment"      // someone commented on the user's post
+	NotificationReply       = "reply"        // someone commented on a post the user commented on
+	NotificationPostLike    = "post_like"    // someone liked the user's post
+	NotificationCommentLike = "comment_like" // someone liked the user's comment
+	NotificationMention     = "mention"      // someone mentioned the user in a post or comment
+)
+
+// Notification is a piece of forum activity recorded for its recipient
+type Notification struct {
+	ID        int    `json:"id"`
+	Type      string `json:"type"`
+	ActorID   int    `json:"actor_id"`
+	ActorName string `json:"actor_name"`
+	PostID    int    `json:"post_id"`
+	PostTitle string `json:"post_title"`
+	CommentID int    `json:"comment_id,omitempty"`
+	CreatedAt string `json:"created_at"`
+	ReadAt    string `json:"read_at,omitempty"`
+}
+
+// Notifier pushes a stored notification to the recipient's live connections.
+// It is an interface so this package does not import handler. It must not
+// block: notifications are recorded while the request that caused them waits.
+type Notifier interface {
+	PushNotification(userID int, notification Notification)
+}
+
+// LiveNotifier is set at startup; notifications are only stored while it is nil
+var LiveNotifier Notifier
+
+const notificationColumns = `n.id, n.type, n.actor_id, u.username, n.post_id, p.title, n.comment_id, n.created_at, n.read_at`
+
+const notificationJoins = `
+	FROM notifications n
+	JOIN users u ON u.id = n.actor_id
+	JOIN posts p ON p.id = n.post_id`
+
+func scanNotification(row rowScanner) (Notification, error) {
+	var n Notification
+	var commentID, readAt sql.NullInt64
+	var createdAt int64
+	err := row.Scan(&n.ID, &n.Type, &n.ActorID, &n.ActorName, &n.PostID, &n.PostTitle, &commentID, &createdAt, &readAt)
+	if err != nil {
+		return n, err
+	}
+	n.CommentID = int(commentID.Int64)
+	n.CreatedAt = formatMillis(createdAt)
+	if readAt.Valid {
+		n.ReadAt = formatMillis(readAt.Int64)
+	}
+	return n, nil
+}
+
+// addNotification records activity of actorID for recipientID and pushes it
+// live. Nobody is notified of their own activity or of users they blocked or
+// were blocked by. Failures are logged: the activity itself already happened.
+func addNotification(recipientID, actorID int, notificationType string, postID, commentID int) {
+	if recipientID == actorID {
+		return
+	}
+	blocked, err := IsBlockedBetween(recipientID, actorID)
+	if err != nil || blocked {
+		return
+	}
+	var comment sql.NullInt64
+	if commentID > 0 {
+		comment = sql.NullInt64{Int64: int64(commentID), Valid: true}
+	}
+	res, err := repo.DB.Exec(`INSERT INTO notifications (user_id, actor_id, type, post_id, comment_id, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		recipientID, actorID, notificationType, postID, comment, time.Now().UnixMilli())
+	if err != nil {
+		log.Printf("Error recording %s notification for user %d: %v", notificationType, recipientID, err)
+		return
+	}
+	if LiveNotifier == nil {
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	notification, err := scanNotification(repo.DB.QueryRow(`SELECT `+notificationColumns+notificationJoins+` WHERE n.id = ?`, id))
+	if err != nil {
+		log.Printf("Error loading notification %d: %v", id, err)
+		return
+	}
+	LiveNotifier.PushNotification(recipientID, notification)
+}
+
+// removeNotification drops the notification of activity that was undone,
+// such as a like. A zero postID or commentID matches any.
+func removeNotification(actorID int, notificationType string, postID, commentID int) {
+	_, err := repo.DB.Exec(`DELETE FROM notifications
+			  WHERE actor_id = ?1 AND type = ?2 AND (?3 = 0 OR post_id = ?3) AND (?4 = 0 OR comment_id = ?4)`,
+		actorID, notificationType, postID, commentID)
+	if err != nil {
+		log.Printf("Error removing %s notification of user %d: %v", notificationType, actorID, err)
+	}
+}
+
+// notifyMentions tells the users newly mentioned in a post or comment
+func notifyMentions(mentioned []int, actorID, postID, commentID int) {
+	for _, userID := range mentioned {
+		addNotification(userID, actorID, NotificationMention, postID, commentID)
+	}
+}
+
+// notifyNewComment tells the post author about a comment, and everyone else
+// who commented on the post about a reply. Users the comment mentions were
+// already told about it, and are recorded as its mentions by now.
+func notifyNewComment(actorID, postID, commentID int, mentioned []int) {
+	var authorID int
+	if err := repo.DB.QueryRow(`SELECT user_id FROM posts WHERE id = ?`, postID).Scan(&authorID); err != nil {
+		log.Printf("Error loading author of post %d: %v", postID, err)
+		return
+	}
+	told := map[int]bool{actorID: true}
+	for _, userID := range mentioned {
+		told[userID] = true
+	}
+	if !told[authorID] {
+		addNotification(authorID, actorID, NotificationComment, postID, commentID)
+	}
+	addReplyNotifications(actorID, authorID, postID, commentID)
+}
+
+// addReplyNotifications records a reply for everyone else who commented on
+// the post in a single statement, skipping the author, users the comment
+// mentions and users blocked either way, then pushes them live
+func addReplyNotifications(actorID, authorID, postID, commentID int) {
+	rows, err := repo.DB.Query(`
+		INSERT INTO notifications (user_id, actor_id, type, post_id, comment_id, created_at)
+		SELECT DISTINCT c.user_id, ?1, ?2, ?3, ?4, ?5
+		FROM comments c
+		WHERE c.post_id = ?3 AND c.user_id NOT IN (?1, ?6)
+		  AND c.user_id NOT IN (SELECT user_id FROM mentions WHERE source = ?7 AND source_id = ?4)
+		  AND NOT EXISTS (
+			SELECT 1 FROM blocked_users b
+			WHERE (b.blocker_id = c.user_id AND b.blocked_id = ?1) OR (b.blocker_id = ?1 AND b.blocked_id = c.user_id)
+		  )
+		RETURNING id, user_id`,
+		actorID, NotificationReply, postID, commentID, time.Now().UnixMilli(), authorID, MentionComment)
+	if err != nil {
+		log.Printf("Error recording reply notifications of comment %d: %v", commentID, err)
+		return
+	}
+	recipients := make(map[int]int)
+	for rows.Next() {
+		var id, userID int
+		if err := rows.Scan(&id, &userID); err != nil {
+			break
+		}
+		recipients[id] = userID
+	}
+	rows.Close()
+	if LiveNotifier == nil || len(recipients) == 0 {
+		return
+	}
+
+	rows, err = repo.DB.Query(`SELECT `+notificationColumns+notificationJoins+`
+			WHERE n.comment_id = ? AND n.type = ? AND n.actor_id = ?`,
+		commentID, NotificationReply, actorID)
+	if err != nil {
+		log.Printf("Error loading reply notifications of comment %d: %v", commentID, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		notification, err := scanNotification(rows)
+		if err != nil {
+			log.Printf("Error loading reply notifications of comment %d: %v", commentID, err)
+			return
+		}
+		if userID, ok := recipients[notification.ID]; ok {
+			LiveNotifier.PushNotification(userID, notification)
+		}
+	}
+}
+
+// notifyPostLike tells the post author about a like
+func notifyPostLike(actorID, postID int) {
+	var authorID int
+	if err := repo.DB.QueryRow(`SELECT user_id FROM posts WHERE id = ?`, postID).Scan(&authorID); err != nil {
+		log.Printf("Error loading author of post %d: %v", postID, err)
+		return
+	}
+	addNotification(authorID, actorID, NotificationPostLike, postID, 0)
+}
+
+// notifyCommentLike tells the comment author about a like
+func notifyCommentLike(actorID, commentID int) {
+	var authorID, postID int
+	err := repo.DB.QueryRow(`SELECT user_id, post_id FROM comments WHERE id = ?`, commentID).Scan(&authorID, &postID)
+	if err != nil {
+		log.Printf("Error loading comment %d: %v", commentID, err)
+		return
+	}
+	addNotification(authorID, actorID, NotificationCommentLike, postID, commentID)
+}
+
+// GetNotifications returns a page of the user's notifications, newest first,
+// older than the notification with id before (0 for the newest), and whether
+// there are more
+func GetNotifications(userID, before, limit int) ([]Notification, bool, error) {
+	query := `SELECT ` + notificationColumns + notificationJoins + `
+			  WHERE n.user_id = ? AND (? = 0 OR n.id < ?)
+			  ORDER BY n.id DESC
+			  LIMIT ?`
+
+	rows, err := repo.DB.Query(query, userID, before, before, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	hasMore := len(notifications) > limit
+	if hasMore {
+		notifications = notifications[:limit]
+	}
+	return notifications, hasMore, nil
+}
+
+// CountUnreadNotifications returns how many of the user's notifications are unread
+func CountUnreadNotifications(userID int) (int, error) {
+	var count int
+	err := repo.DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL`, userID).Scan(&count)
+	return count, err
+}
+
+// MarkNotificationRead marks one of the user's notifications read and
+// reports whether it exists
+func MarkNotificationRead(userID, notificationID int) (bool, error) {
+	var exists bool
+	err := repo.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM notifications WHERE id = ? AND user_id = ?)`,
+		notificationID, userID).Scan(&exists)
+	if err != nil || !exists {
+		return false, err
+	}
+	_, err = repo.DB.Exec(`UPDATE notifications SET read_at = ? WHERE id = ? AND user_id = ? AND read_at IS NULL`,
+		time.Now().UnixMilli(), notificationID, userID)
+	return true, err
+}
+
+// MarkAllNotificationsRead marks every unread notification of the user read
+func MarkAllNotificationsRead(userID int) (int64, error) {
+	res, err := repo.DB.Exec(`UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL`,
+		time.Now().UnixMilli(), userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteNotification deletes one of the user's notifications and reports
+// whether it existed
+func DeleteNotification(userID, notificationID int) (bool, error) {
+	res, err := repo.DB.Exec(`DELETE FROM notifications WHERE id = ? AND user_id = ?`, notificationID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteAllNotifications deletes every notification of the user
+func DeleteAllNotifications(userID int) (int64, error) {
+	res, err := repo.DB.Exec(`DELETE FROM notifications WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"forum/internal/utils"
 	"database/sql"
+	"log"
 	"strings"
 	repo "forum/internal/repository"
 )
@@ -13,12 +14,20 @@ func AddNewPost(userId int, titel string, content string) (int, error) {
 		return -1, err
 	}
 	id, err := res.LastInsertId()
-	return int(id), err
+	if err != nil {
+		return -1, err
+	}
+	_, mentioned, err := SaveMentions(MentionPost, int(id), userId, content)
+	if err != nil {
+		log.Printf("Error recording mentions of post %d: %v", id, err)
+	}
+	notifyMentions(mentioned, userId, int(id), 0)
+	return int(id), nil
 }
 
 func GetAllPostsInfo(page int, userId int) (repo.PageData, error) {
 	var data repo.PageData
-	rows, err := repo.DB.Query(repo.SELECT_ALL_POSTS, repo.PAGE_POSTS_QUANTITY, (page-1)*repo.PAGE_POSTS_QUANTITY)
+	rows, err := repo.DB.Query(repo.SELECT_ALL_POSTS, userId, repo.PAGE_POSTS_QUANTITY, (page-1)*repo.PAGE_POSTS_QUANTITY)
 	if err != nil {
 		return data, err
 	}
@@ -62,7 +71,7 @@ func GetAllPostsInfo(page int, userId int) (repo.PageData, error) {
 		if userId == post.PublisherId {
 			post.Owned = true
 		}
-		post.CommentsCount, err = GetCommentCount(post.Id)
+		post.CommentsCount, err = GetCommentCount(post.Id, userId)
 		if err != nil {
 			return data, err
 		}
@@ -81,7 +90,7 @@ func GetAllPostsInfo(page int, userId int) (repo.PageData, error) {
 		return data, err
 	}
 
-	return data, nil
+	return data, attachPostMentions(data.Posts)
 }
 
 func IsPostExist(postId int) (bool, error) {
@@ -100,6 +109,9 @@ func AddRemovePostLike(userId int, postId int) error {
 	isLiked, err := IsPostLikedByUser(userId, postId)
 	if err == sql.ErrNoRows {
 		_, err = repo.DB.Exec(repo.INSERT_NEW_LIKE_DISLIKE, userId, postId, 1, 0)
+		if err == nil {
+			notifyPostLike(userId, postId)
+		}
 		return err
 	}
 	if isLiked {
@@ -107,6 +119,7 @@ func AddRemovePostLike(userId int, postId int) error {
 		if err != nil {
 			return err
 		}
+		removeNotification(userId, NotificationPostLike, postId, 0)
 		_, err = res.RowsAffected()
 		return err
 	}
@@ -114,6 +127,7 @@ func AddRemovePostLike(userId int, postId int) error {
 	if err != nil {
 		return err
 	}
+	notifyPostLike(userId, postId)
 	_, err = res.RowsAffected()
 	return err
 }
@@ -136,6 +150,8 @@ func AddRemovePostDeslike(userId int, postId int) error {
 	if err != nil {
 		return err
 	}
+	// A dislike replaces any like
+	removeNotification(userId, NotificationPostLike, postId, 0)
 	_, err = res.RowsAffected()
 	return err
 }
@@ -199,10 +215,10 @@ func MapPostCategory(postId int, categoryId int) error {
 func GetPostsCount(filter string, userId int) (int, error) {
 	var count int
 	var query string
-	var param any
+	var params []any
 
 	if filter == "" {
-		err := repo.DB.QueryRow(repo.GET_POST_COUNT).Scan(&count)
+		err := repo.DB.QueryRow(repo.GET_VISIBLE_POST_COUNT, userId).Scan(&count)
 		if err == sql.ErrNoRows {
 			return 0, nil
 		} else if err != nil {
@@ -213,18 +229,18 @@ func GetPostsCount(filter string, userId int) (int, error) {
 
 	if filter == "Owned" {
 		query = repo.GET_OWNED_POST_COUNT
-		param = userId
+		params = []any{userId}
 
 	} else if filter == "Likes" {
 		query = repo.GET_LIKED_POST_COUNT
-		param = userId
+		params = []any{userId}
 
 	} else if repo.IT_MAJOR_FIELDS[filter] {
-		query = repo.GET_POST_COUNT_BY_CAT
-		param = filter
+		query = repo.GET_VISIBLE_POST_COUNT_BY_CAT
+		params = []any{filter, userId}
 	}
 
-	err := repo.DB.QueryRow(query, param).Scan(&count)
+	err := repo.DB.QueryRow(query, params...).Scan(&count)
 
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -288,7 +304,8 @@ func GetPostByID(postID, userID int) (repo.Post, error) {
 	}
 	post.Created_at = utils.SqlDateFormater(post.Created_at)
 	post.Updated_at = utils.SqlDateFormater(post.Updated_at)
-	return post, nil
+	post.Mentions, err = MentionSpans(MentionPost, post.Id, post.Content)
+	return post, err
 }
 
 func UpdateCatCount() error {
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"encoding/json"
+	db "forum/internal/db"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// blockRequest is the JSON body accepted by the block endpoints
+type blockRequest struct {
+	Username string `json:"username"`
+}
+
+// decodeBlockRequest enforces POST, parses the body and resolves the target
+// user, who may not be the caller
+func decodeBlockRequest(w http.ResponseWriter, r *http.Request, userID int) (int, bool) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Use POST",
+		})
+		return 0, false
+	}
+	var input blockRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid JSON body",
+		})
+		return 0, false
+	}
+	targetID, err := db.GetUserIDByUsername(strings.TrimSpace(input.Username))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		return 0, false
+	}
+	if targetID == userID {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "You cannot block yourself"})
+		return 0, false
+	}
+	return targetID, true
+}
+
+// BlockedUsersHandler lists the caller's blocked users (GET) or blocks one (POST)
+func BlockedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		if containsHTML(r.Header.Get("Accept")) {
+			http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+			return
+		}
+		userID, _, ok := apiSessionUser(w, r)
+		if !ok {
+			return
+		}
+		blocked, err := db.GetBlockedUsers(userID)
+		if err != nil {
+			log.Printf("Error listing blocked users: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"users": blocked})
+		return
+	}
+
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	targetID, ok := decodeBlockRequest(w, r, userID)
+	if !ok {
+		return
+	}
+	if err := db.BlockUser(userID, targetID); err != nil {
+		log.Printf("Error blocking user %d for %d: %v", targetID, userID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// UnblockUserHandler removes a user from the caller's block list
+func UnblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	targetID, ok := decodeBlockRequest(w, r, userID)
+	if !ok {
+		return
+	}
+	removed, err := db.UnblockUser(userID, targetID)
+	if err != nil {
+		log.Printf("Error unblocking user %d for %d: %v", targetID, userID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	if !removed {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "User is not blocked"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
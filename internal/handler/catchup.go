@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"encoding/json"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// syncEvent ends a catch-up replay and gives the client its new positions
+type syncEvent struct {
+	Type      string `json:"type"`
+	LastSeen  int    `json:"last_seen"`
+	LastEvent int    `json:"last_event"`
+	Truncated bool   `json:"truncated"` // more was missed than replayed; reload history over REST
+}
+
+// pushEvent records a notification for offline catch-up, then pushes it live
+// to the user's notification sockets with its event_id. conv is the
+// conversation the event belongs to, if any, for mute settings.
+func (h *Hub) pushEvent(username string, conv db.Conversation, payload []byte) {
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return
+	}
+	eventType, _ := fields["type"].(string)
+
+	userID, err := db.GetUserIDByUsername(username)
+	if err != nil {
+		return
+	}
+	switch notificationModeFor(userID, eventType, conv) {
+	case notifySkip:
+		return
+	case notifySilent:
+		payload = withField(payload, "silent", true)
+	}
+	eventID, err := db.SaveChatEvent(userID, eventType, payload)
+	if err != nil {
+		log.Printf("Error recording %s event for %s: %v", eventType, username, err)
+		h.notifyUser(username, payload)
+		return
+	}
+	h.notifyUser(username, withField(payload, "event_id", eventID))
+}
+
+// withField sets a field of a JSON object payload
+func withField(payload []byte, key string, value any) []byte {
+	var fields map[string]any
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	fields[key] = value
+	if tagged, err := json.Marshal(fields); err == nil {
+		return tagged
+	}
+	return payload
+}
+
+// catchUpPositions reads ?last_seen= (last received message id) and
+// ?last_event= (last event id). A client without them gets no replay.
+func catchUpPositions(req *http.Request) (int, int, bool) {
+	lastSeen, err := strconv.Atoi(req.URL.Query().Get("last_seen"))
+	if err != nil || lastSeen < 0 {
+		return 0, 0, false
+	}
+	lastEvent, err := strconv.Atoi(req.URL.Query().Get("last_event"))
+	if err != nil || lastEvent < 0 {
+		lastEvent = 0
+	}
+	return lastSeen, lastEvent, true
+}
+
+// replay writes every private message and event missed since the given
+// positions, in the order they happened, followed by a sync frame and the
+// unread counts. It runs before the write goroutine starts, so it owns the
+// socket; anything pushed meanwhile waits in the receive queue and may repeat
+// a replayed item, which clients skip by id.
+func (c *user) replay(lastSeen, lastEvent int, resume bool) error {
+	latestSeen, latestEvent, err := db.LatestChatPositions(c.userID)
+	if err != nil {
+		return err
+	}
+	sync := syncEvent{Type: "sync", LastSeen: latestSeen, LastEvent: latestEvent}
+	if !resume {
+		return c.endReplay(sync)
+	}
+	// Positions ahead of ours come from another database; start over from now
+	if lastSeen > latestSeen || lastEvent > latestEvent {
+		return c.endReplay(sync)
+	}
+	sync.LastSeen, sync.LastEvent = lastSeen, lastEvent
+
+	messages, err := db.GetMissedChatMessages(c.userID, lastSeen, repo.CHAT_CATCHUP_MAX_ITEMS)
+	if err != nil {
+		return err
+	}
+	events, err := db.GetChatEventsSince(c.userID, lastEvent, repo.CHAT_CATCHUP_MAX_ITEMS)
+	if err != nil {
+		return err
+	}
+	sync.Truncated = len(messages) == repo.CHAT_CATCHUP_MAX_ITEMS || len(events) == repo.CHAT_CATCHUP_MAX_ITEMS
+
+	// Merge both streams by creation time
+	for len(messages) > 0 || len(events) > 0 {
+		if len(events) == 0 || (len(messages) > 0 && messages[0].CreatedAtMillis() <= events[0].CreatedAt) {
+			msg := messages[0]
+			messages = messages[1:]
+			err = c.writeNow(ChatMessageData{
+				Type:      "message",
+				Name:      msg.SenderName,
+				Message:   msg.Message,
+				SenderID:  msg.SenderID,
+				CreatedAt: msg.CreatedAt,
+				ID:        msg.ID,
+				EditedAt:  msg.EditedAt,
+				Silent:    notificationModeFor(c.userID, "message", db.Conversation{Kind: db.ConversationUser, ID: msg.SenderID}) == notifySilent,
+				Mentions:  msg.Mentions,
+			})
+			sync.LastSeen = msg.ID
+		} else {
+			event := events[0]
+			events = events[1:]
+			err = c.writeRaw(withField(event.Payload, "event_id", event.ID))
+			sync.LastEvent = event.ID
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.endReplay(sync)
+}
+
+// endReplay writes the sync frame, then the current unread counts, which
+// are not replayed as events
+func (c *user) endReplay(sync syncEvent) error {
+	if err := c.writeNow(sync); err != nil {
+		return err
+	}
+	payload, err := unreadUpdate(c.userID)
+	if err != nil {
+		log.Printf("Error counting unread messages of %s: %v", c.name, err)
+		return nil
+	}
+	return c.writeRaw(payload)
+}
+
+// writeNow marshals and writes a frame directly; only valid while no write goroutine runs
+func (c *user) writeNow(v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeRaw(payload)
+}
+
+// writeRaw writes a frame directly, wrapped for the socket's protocol
+func (c *user) writeRaw(payload []byte) error {
+	return c.writeFrame(c.wrap(payload))
+}
+
+// writeFrame writes a frame as is, directly under the write deadline
+func (c *user) writeFrame(payload []byte) error {
+	if c.stream != nil {
+		return c.stream.send(payload, c.config.WriteTimeout)
+	}
+	c.socket.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	return c.socket.WriteMessage(websocket.TextMessage, payload)
+}
@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportedMessage is one message of a JSON transcript
+type exportedMessage struct {
+	ID         int    `json:"id"`
+	SenderID   int    `json:"sender_id"`
+	SenderName string `json:"sender_name"`
+	Message    string `json:"message"`
+	CreatedAt  string `json:"created_at"`
+	EditedAt   string `json:"edited_at,omitempty"`
+	DeletedAt  string `json:"deleted_at,omitempty"`
+}
+
+// transcriptWriter renders a transcript in one export format
+type transcriptWriter interface {
+	header(w io.Writer, user, other string) error
+	message(w io.Writer, msg db.ChatMessage) error
+	footer(w io.Writer) error
+}
+
+// transcriptFormats maps ?format= to its content type and writer
+var transcriptFormats = map[string]struct {
+	contentType string
+	newWriter   func() transcriptWriter
+}{
+	"json": {"application/json; charset=utf-8", func() transcriptWriter { return &jsonTranscript{} }},
+	"html": {"text/html; charset=utf-8", func() transcriptWriter { return htmlTranscript{} }},
+	"txt":  {"text/plain; charset=utf-8", func() transcriptWriter { return textTranscript{} }},
+}
+
+// ChatExportHandler streams the full private conversation between the caller
+// and other_user_id as a JSON, HTML or plain text attachment. History is read
+// in keyset chunks and flushed as it goes, so it is never held in memory.
+func ChatExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Only GET is supported.",
+		})
+		return
+	}
+	userID, username, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	otherUserID, err := strconv.Atoi(r.URL.Query().Get("other_user_id"))
+	if err != nil || otherUserID <= 0 || otherUserID == userID {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid other_user_id"})
+		return
+	}
+	otherName, err := db.GetUserNameById(otherUserID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		return
+	}
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "json"
+	}
+	format, ok := transcriptFormats[formatName]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid format, use json, html or txt"})
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chat-%s-%s.%s"`, username, otherName, formatName))
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, _ := w.(http.Flusher)
+
+	// The caller is always one of the two participants: the query only ever
+	// pairs the session user with other_user_id
+	transcript := format.newWriter()
+	if err := transcript.header(w, username, otherName); err != nil {
+		return
+	}
+	cursor := db.ChatCursor{}
+	for {
+		messages, hasMore, err := db.GetChatMessagesAfter(userID, otherUserID, cursor, repo.CHAT_EXPORT_CHUNK_SIZE)
+		if err != nil {
+			// Headers are gone; all we can do is cut the transcript short
+			log.Printf("Error exporting chat between %d and %d: %v", userID, otherUserID, err)
+			return
+		}
+		for _, msg := range messages {
+			if err := transcript.message(w, msg); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !hasMore || len(messages) == 0 {
+			break
+		}
+		last := messages[len(messages)-1]
+		cursor = db.ChatCursor{CreatedAt: last.CreatedAtMillis(), ID: last.ID}
+	}
+	transcript.footer(w)
+}
+
+// jsonTranscript writes {"participants": [...], "exported_at": ..., "messages": [...]}
+type jsonTranscript struct {
+	count int
+}
+
+func (t *jsonTranscript) header(w io.Writer, user, other string) error {
+	head, err := json.Marshal(map[string]any{
+		"participants": []string{user, other},
+		"exported_at":  time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	// Reopen the object to append the streamed messages array
+	_, err = fmt.Fprintf(w, "%s,\"messages\":[", head[:len(head)-1])
+	return err
+}
+
+func (t *jsonTranscript) message(w io.Writer, msg db.ChatMessage) error {
+	line, err := json.Marshal(exportedMessage{
+		ID:         msg.ID,
+		SenderID:   msg.SenderID,
+		SenderName: msg.SenderName,
+		Message:    msg.Message,
+		CreatedAt:  msg.CreatedAt,
+		EditedAt:   msg.EditedAt,
+		DeletedAt:  msg.DeletedAt,
+	})
+	if err != nil {
+		return err
+	}
+	separator := ",\n"
+	if t.count == 0 {
+		separator = "\n"
+	}
+	t.count++
+	_, err = fmt.Fprintf(w, "%s%s", separator, line)
+	return err
+}
+
+func (t *jsonTranscript) footer(w io.Writer) error {
+	_, err := io.WriteString(w, "\n]}\n")
+	return err
+}
+
+// textTranscript writes one "[timestamp] sender: message" line per message
+type textTranscript struct{}
+
+func (textTranscript) header(w io.Writer, user, other string) error {
+	_, err := fmt.Fprintf(w, "Conversation between %s and %s\nExported %s\n\n",
+		user, other, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (textTranscript) message(w io.Writer, msg db.ChatMessage) error {
+	// Indent continuation lines so every message still starts with its timestamp
+	text := strings.ReplaceAll(transcriptText(msg), "\n", "\n    ")
+	_, err := fmt.Fprintf(w, "[%s] %s: %s\n", msg.CreatedAt, msg.SenderName, text)
+	return err
+}
+
+func (textTranscript) footer(w io.Writer) error {
+	return nil
+}
+
+// htmlTranscript writes a standalone page with every value escaped
+type htmlTranscript struct{}
+
+func (htmlTranscript) header(w io.Writer, user, other string) error {
+	title := html.EscapeString(fmt.Sprintf("Conversation between %s and %s", user, other))
+	_, err := fmt.Fprintf(w, `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; }
+.message { margin: 0.5rem 0; white-space: pre-wrap; }
+.meta { color: #666; font-size: 0.85em; }
+.deleted { color: #999; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<p class="meta">Exported %s</p>
+`, title, title, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (htmlTranscript) message(w io.Writer, msg db.ChatMessage) error {
+	class := "message"
+	if msg.IsDeleted {
+		class += " deleted"
+	}
+	_, err := fmt.Fprintf(w, "<div class=\"%s\"><span class=\"meta\"><time datetime=\"%s\">%s</time></span> <strong>%s</strong>: %s</div>\n",
+		class, html.EscapeString(msg.CreatedAt), html.EscapeString(msg.CreatedAt),
+		html.EscapeString(msg.SenderName), html.EscapeString(transcriptText(msg)))
+	return err
+}
+
+func (htmlTranscript) footer(w io.Writer) error {
+	_, err := io.WriteString(w, "</body>\n</html>\n")
+	return err
+}
+
+// transcriptText is the text shown for a message in text and HTML transcripts
+func transcriptText(msg db.ChatMessage) string {
+	switch {
+	case msg.IsDeleted:
+		return "(message deleted)"
+	case msg.IsEdited:
+		return msg.Message + " (edited)"
+	}
+	return msg.Message
+}
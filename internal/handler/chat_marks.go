@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// pinEvent tells both participants of a private conversation that a message
+// was pinned or unpinned
+type pinEvent struct {
+	Type     string            `json:"type"` // pin or unpin
+	Name     string            `json:"name"` // who pinned or unpinned it
+	SenderID int               `json:"sender_id"`
+	ID       int               `json:"id"`               // the message
+	Pinned   *db.PinnedMessage `json:"pinned,omitempty"` // the message as pinned; pin only
+}
+
+// applyPin pins or unpins a message of a private room for both participants
+// and returns the frame for the room, or nil when nothing changed. The peer
+// also gets it on their notification sockets.
+func (r *room) applyPin(chatMsg ChatMessageData) []byte {
+	if r.groupID > 0 {
+		r.sendTo(chatMsg.Name, r.refusal(chatMsg, "Only private messages can be pinned"))
+		return nil
+	}
+	peerName, ok := r.privatePeer(chatMsg.Name)
+	if !ok || chatMsg.ID <= 0 || chatMsg.SenderID <= 0 || r.blockedPeer(chatMsg) {
+		return nil
+	}
+	peerID := r.getUserIDByUsername(peerName)
+	if peerID <= 0 {
+		return nil
+	}
+
+	event := pinEvent{Type: chatMsg.Type, Name: chatMsg.Name, SenderID: chatMsg.SenderID, ID: chatMsg.ID}
+	if chatMsg.Type == "pin" {
+		pinned, changed, err := db.PinChatMessage(chatMsg.ID, chatMsg.SenderID, peerID)
+		if err == db.ErrTooManyPins {
+			r.sendTo(chatMsg.Name, r.refusal(chatMsg, fmt.Sprintf("A conversation can have at most %d pinned messages", repo.CHAT_PINNED_MAX_PER_CONVERSATION)))
+			return nil
+		}
+		if err != nil {
+			log.Printf("Rejected pin of message %d by %s: %v", chatMsg.ID, chatMsg.Name, err)
+			return nil
+		}
+		if !changed {
+			return nil
+		}
+		event.Pinned = &pinned
+	} else {
+		changed, err := db.UnpinChatMessage(chatMsg.ID, chatMsg.SenderID, peerID)
+		if err != nil {
+			log.Printf("Error unpinning message %d by %s: %v", chatMsg.ID, chatMsg.Name, err)
+			return nil
+		}
+		if !changed {
+			return nil
+		}
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil
+	}
+	r.hub.pushEvent(peerName, db.Conversation{Kind: db.ConversationUser, ID: chatMsg.SenderID}, payload)
+	return payload
+}
+
+// starRequest is the JSON body of the star endpoints
+type starRequest struct {
+	MessageID int `json:"message_id"`
+}
+
+// decodeStarRequest enforces POST and parses the body
+func decodeStarRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Use POST",
+		})
+		return 0, false
+	}
+	var input starRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid JSON body",
+		})
+		return 0, false
+	}
+	if input.MessageID <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid message_id"})
+		return 0, false
+	}
+	return input.MessageID, true
+}
+
+// conversationPeer reads the other_user_id query parameter of the caller's
+// private conversation listings
+func conversationPeer(w http.ResponseWriter, r *http.Request, userID int) (int, bool) {
+	otherUserID, err := strconv.Atoi(r.URL.Query().Get("other_user_id"))
+	if err != nil || otherUserID <= 0 || otherUserID == userID {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid other_user_id"})
+		return 0, false
+	}
+	return otherUserID, true
+}
+
+// StarredMessagesHandler lists the messages the caller starred in their
+// conversation with ?other_user_id= (GET) or stars one (POST). Stars are only
+// seen by the user who made them.
+func StarredMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		if containsHTML(r.Header.Get("Accept")) {
+			http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+			return
+		}
+		userID, _, ok := apiSessionUser(w, r)
+		if !ok {
+			return
+		}
+		otherUserID, ok := conversationPeer(w, r, userID)
+		if !ok {
+			return
+		}
+		starred, err := db.GetStarredChatMessages(userID, otherUserID)
+		if err != nil {
+			log.Printf("Error listing starred messages of user %d: %v", userID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"messages": starred})
+		return
+	}
+
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	messageID, ok := decodeStarRequest(w, r)
+	if !ok {
+		return
+	}
+	if _, err := db.StarChatMessage(userID, messageID); err == sql.ErrNoRows {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Message not found"})
+		return
+	} else if err != nil {
+		log.Printf("Error starring message %d for user %d: %v", messageID, userID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// UnstarMessageHandler removes the caller's star from a message
+func UnstarMessageHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	messageID, ok := decodeStarRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := db.UnstarChatMessage(userID, messageID); err != nil {
+		log.Printf("Error unstarring message %d for user %d: %v", messageID, userID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// PinnedMessagesHandler lists the pinned messages of the caller's
+// conversation with ?other_user_id=. Messages are pinned and unpinned with
+// pin and unpin frames on the conversation's socket.
+func PinnedMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Only GET is supported.",
+		})
+		return
+	}
+	if containsHTML(r.Header.Get("Accept")) {
+		http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+		return
+	}
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	otherUserID, ok := conversationPeer(w, r, userID)
+	if !ok {
+		return
+	}
+	pinned, err := db.GetPinnedChatMessages(userID, otherUserID)
+	if err != nil {
+		log.Printf("Error listing pinned messages between %d and %d: %v", userID, otherUserID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"messages": pinned})
+}
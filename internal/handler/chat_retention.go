@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"encoding/json"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retentionOptions are the retention periods a conversation can agree on
+var retentionOptions = map[string]int{
+	"off": 0,
+	"24h": 24 * 60 * 60,
+	"7d":  7 * 24 * 60 * 60,
+	"30d": 30 * 24 * 60 * 60,
+}
+
+// retentionLabel turns a stored period back into its option name
+func retentionLabel(ttlSeconds int) string {
+	for label, seconds := range retentionOptions {
+		if seconds == ttlSeconds {
+			return label
+		}
+	}
+	return strconv.Itoa(ttlSeconds) + "s"
+}
+
+// retentionResponse describes a conversation's retention
+type retentionResponse struct {
+	Type        string `json:"type,omitempty"`
+	Name        string `json:"name,omitempty"`
+	OtherUserID int    `json:"other_user_id,omitempty"`
+	TTL         string `json:"ttl"`
+	PendingTTL  string `json:"pending_ttl,omitempty"`
+	ProposedBy  string `json:"proposed_by,omitempty"` // username whose change awaits the other participant
+}
+
+// newRetentionResponse presents the policy of the conversation between two named users
+func newRetentionResponse(policy db.RetentionPolicy, userID int, username, otherName string) retentionResponse {
+	resp := retentionResponse{TTL: retentionLabel(policy.TTLSeconds)}
+	if policy.ProposedBy != 0 {
+		resp.PendingTTL = retentionLabel(policy.PendingTTLSeconds)
+		resp.ProposedBy = otherName
+		if policy.ProposedBy == userID {
+			resp.ProposedBy = username
+		}
+	}
+	return resp
+}
+
+// retentionRequest is the JSON body of a retention change
+type retentionRequest struct {
+	OtherUserID int    `json:"other_user_id"`
+	TTL         string `json:"ttl"`
+}
+
+// ChatRetentionHandler returns (GET ?other_user_id=) or proposes (POST) how
+// long a private conversation keeps its messages. A proposal takes effect
+// once the other participant proposes the same period.
+func (h *Hub) ChatRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		if containsHTML(r.Header.Get("Accept")) {
+			http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+			return
+		}
+		userID, username, ok := apiSessionUser(w, r)
+		if !ok {
+			return
+		}
+		otherUserID, err := strconv.Atoi(r.URL.Query().Get("other_user_id"))
+		if err != nil || otherUserID <= 0 || otherUserID == userID {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid other_user_id"})
+			return
+		}
+		otherName, err := db.GetUserNameById(otherUserID)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+			return
+		}
+		policy, err := db.GetRetentionPolicy(userID, otherUserID)
+		if err != nil {
+			log.Printf("Error loading retention policy: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+		resp := newRetentionResponse(policy, userID, username, otherName)
+		resp.OtherUserID = otherUserID
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Use GET or POST",
+		})
+		return
+	}
+	userID, username, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	var input retentionRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid JSON body"})
+		return
+	}
+	ttlSeconds, ok := retentionOptions[input.TTL]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid ttl, use off, 24h, 7d or 30d"})
+		return
+	}
+	if input.OtherUserID <= 0 || input.OtherUserID == userID {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid other_user_id"})
+		return
+	}
+	otherName, err := db.GetUserNameById(input.OtherUserID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		return
+	}
+
+	policy, applied, err := db.ProposeRetention(userID, input.OtherUserID, ttlSeconds)
+	if err != nil {
+		log.Printf("Error saving retention policy: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+
+	resp := newRetentionResponse(policy, userID, username, otherName)
+
+	// Both participants see the proposal or the agreed period
+	update := resp
+	update.Type = "retention_update"
+	if payload, err := json.Marshal(update); err == nil {
+		h.sendToRoom(CreatePrivateRoomName(username, otherName), payload)
+	}
+	update.Name, update.OtherUserID = username, userID
+	if payload, err := json.Marshal(update); err == nil {
+		h.pushEvent(otherName, db.Conversation{Kind: db.ConversationUser, ID: userID}, payload)
+	}
+
+	resp.OtherUserID = input.OtherUserID
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "applied": applied, "retention": resp})
+}
+
+// RunRetentionSweeper deletes expired private messages, and catch-up events
+// nobody will replay anymore, every interval until the process exits
+func (h *Hub) RunRetentionSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.sweepExpiredMessages()
+		pruneChatEvents()
+	}
+}
+
+// pruneChatEvents drops catch-up events older than their retention period
+func pruneChatEvents() {
+	if _, err := db.PruneChatEvents(time.Now().AddDate(0, 0, -repo.CHAT_EVENTS_RETENTION_DAYS)); err != nil {
+		log.Printf("Pruning chat events failed: %v", err)
+	}
+}
+
+// messageExpiredEvent tells a participant which messages the retention policy removed
+type messageExpiredEvent struct {
+	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"` // the other participant
+	OtherUserID int    `json:"other_user_id,omitempty"`
+	IDs         []int  `json:"ids"`
+}
+
+// sweepExpiredMessages runs one retention pass and tells live clients what went away
+func (h *Hub) sweepExpiredMessages() {
+	expired, err := db.DeleteExpiredChatMessages(time.Now(), repo.CHAT_RETENTION_SWEEP_BATCH)
+	if err != nil {
+		log.Printf("Retention sweep failed: %v", err)
+	}
+	for _, conv := range expired {
+		name1, err1 := db.GetUserNameById(conv.UserID1)
+		name2, err2 := db.GetUserNameById(conv.UserID2)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		log.Printf("Retention: deleted %d messages between %s and %s", len(conv.IDs), name1, name2)
+
+		h.pushExpired(name1, name2, conv.UserID2, conv.IDs)
+		h.pushExpired(name2, name1, conv.UserID1, conv.IDs)
+		h.pushUnreadUpdate(conv.UserID1)
+		h.pushUnreadUpdate(conv.UserID2)
+		if payload, err := json.Marshal(messageExpiredEvent{Type: "message_expired", IDs: conv.IDs}); err == nil {
+			h.sendToRoom(CreatePrivateRoomName(name1, name2), payload)
+		}
+	}
+}
+
+// pushExpired records and pushes a message_expired event to one participant
+func (h *Hub) pushExpired(username, otherName string, otherUserID int, ids []int) {
+	payload, err := json.Marshal(messageExpiredEvent{Type: "message_expired", Name: otherName, OtherUserID: otherUserID, IDs: ids})
+	if err != nil {
+		return
+	}
+	h.pushEvent(username, db.Conversation{Kind: db.ConversationUser, ID: otherUserID}, payload)
+}
@@ -2,16 +2,18 @@ package handler
 
 import (
 	db "forum/internal/db"
+	repo "forum/internal/repository"
 	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 )
 
 // GetChatMessagesHandler handles HTTP requests for chat messages
-func GetChatMessagesHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Hub) GetChatMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
         w.Header().Set("Content-Type", "application/json")
         w.WriteHeader(http.StatusMethodNotAllowed)
@@ -59,37 +61,102 @@ func GetChatMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	limit := 50 // default - increased from 10 to 50
+	limit := repo.CHAT_PAGE_DEFAULT_LIMIT
 	if limitStr != "" {
-		if parsedLimit, err := strconv.Atoi(limitStr); err == nil {
-			limit = parsedLimit
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = min(parsedLimit, repo.CHAT_PAGE_MAX_LIMIT)
 		}
 	}
 
-	offset := 0 // default
-	if offsetStr != "" {
-		if parsedOffset, err := strconv.Atoi(offsetStr); err == nil {
-			offset = parsedOffset
-		}
+	beforeStr := r.URL.Query().Get("before_id")
+	afterStr := r.URL.Query().Get("after_id")
+	if beforeStr != "" && afterStr != "" {
+		http.Error(w, "Use either before_id or after_id", http.StatusBadRequest)
+		return
 	}
 
-	// Get messages using db package function
-	messages, err := db.GetChatMessages(currentUserID, otherUserID, limit, offset)
+	var messages []db.ChatMessage
+	var hasOlder, hasNewer bool
+	switch {
+	case afterStr != "":
+		after, ok := resolveChatCursor(w, afterStr, currentUserID, otherUserID)
+		if !ok {
+			return
+		}
+		var hasMore bool
+		messages, hasMore, err = db.GetChatMessagesAfter(currentUserID, otherUserID, after, limit)
+		hasOlder, hasNewer = true, hasMore
+	case beforeStr != "":
+		before, ok := resolveChatCursor(w, beforeStr, currentUserID, otherUserID)
+		if !ok {
+			return
+		}
+		var hasMore bool
+		messages, hasMore, err = db.GetChatMessagesBefore(currentUserID, otherUserID, &before, limit)
+		hasOlder, hasNewer = hasMore, true
+	case offsetStr != "" && offsetStr != "0":
+		// Legacy offset paging, kept for old clients
+		offset, _ := strconv.Atoi(offsetStr)
+		messages, err = db.GetChatMessages(currentUserID, otherUserID, limit, max(offset, 0))
+		hasOlder, hasNewer = len(messages) == limit, true
+	default:
+		var hasMore bool
+		messages, hasMore, err = db.GetChatMessagesBefore(currentUserID, otherUserID, nil, limit)
+		hasOlder = hasMore
+	}
 	if err != nil {
 		http.Error(w, "Failed to get messages", http.StatusInternalServerError)
 		return
 	}
 
-	// Mark messages from other user as read using db package function
-	db.MarkMessagesAsRead(otherUserID, currentUserID)
+	// next_cursor pages back into older history (before_id), prev_cursor towards newer messages (after_id)
+	var nextCursor, prevCursor any
+	if len(messages) > 0 {
+		if hasOlder {
+			nextCursor = messages[0].Cursor
+		}
+		if hasNewer {
+			prevCursor = messages[len(messages)-1].Cursor
+		}
+	}
+
+	// Mark messages from other user as read and tell them if they are connected
+	if receipt, err := db.MarkMessagesAsRead(otherUserID, currentUserID); err != nil {
+		log.Printf("Error marking messages as read: %v", err)
+	} else {
+		h.pushReadReceipt(otherUserID, currentUserID, receipt)
+		if len(receipt.IDs) > 0 {
+			h.pushUnreadUpdate(currentUserID)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"messages": messages,
-		"hasMore":  len(messages) == limit,
+		"messages":    messages,
+		"hasMore":     hasOlder,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
 	})
 }
 
+// resolveChatCursor accepts either an opaque cursor or a plain message id of this conversation
+func resolveChatCursor(w http.ResponseWriter, value string, currentUserID, otherUserID int) (db.ChatCursor, bool) {
+	if messageID, err := strconv.Atoi(value); err == nil {
+		cursor, err := db.ChatCursorForMessage(currentUserID, otherUserID, messageID)
+		if err != nil {
+			http.Error(w, "Unknown message id", http.StatusBadRequest)
+			return cursor, false
+		}
+		return cursor, true
+	}
+	cursor, err := db.ParseChatCursor(value)
+	if err != nil {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return cursor, false
+	}
+	return cursor, true
+}
+
 // GetUserByUsernameHandler gets user ID by username for chat
 func GetUserByUsernameHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -169,8 +236,8 @@ func GetRecentChatsHandler(w http.ResponseWriter, r *http.Request) {
 	recentUsers, err := db.GetRecentChatUsers(currentUserID, 20)
 	if err != nil {
 		log.Printf("GetRecentChatsHandler DB error: %v", err)
-		// Return empty array instead of error to prevent frontend crashes
-		recentUsers = []map[string]interface{}{}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -224,4 +291,85 @@ func GetUnreadCountHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// pushReadReceipt delivers a receipt produced outside the room loop to the sender
+func (h *Hub) pushReadReceipt(senderID, readerID int, receipt db.Receipt) {
+	senderName, err := db.GetUserNameById(senderID)
+	if err != nil {
+		return
+	}
+	readerName, err := db.GetUserNameById(readerID)
+	if err != nil {
+		return
+	}
+	payload := h.notifyReceipt(senderName, readerName, receipt)
+	if payload == nil {
+		return
+	}
+	h.sendToRoom(CreatePrivateRoomName(senderName, readerName), payload)
+}
 
+// SearchChatMessagesHandler searches the caller's private messages
+// (GET ?q=&other_user_id=&limit=&before=)
+func SearchChatMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Only GET is supported.",
+		})
+		return
+	}
+	if containsHTML(r.Header.Get("Accept")) {
+		http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+		return
+	}
+	currentUserID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" || len(query) > repo.CHAT_SEARCH_MAX_LEN {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid search query"})
+		return
+	}
+
+	otherUserID := 0
+	if otherStr := r.URL.Query().Get("other_user_id"); otherStr != "" {
+		parsed, err := strconv.Atoi(otherStr)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid other_user_id"})
+			return
+		}
+		otherUserID = parsed
+	}
+
+	limit := repo.CHAT_SEARCH_DEFAULT_LIMIT
+	if parsedLimit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && parsedLimit > 0 {
+		limit = min(parsedLimit, repo.CHAT_PAGE_MAX_LIMIT)
+	}
+
+	var before *db.ChatCursor
+	if beforeStr := r.URL.Query().Get("before"); beforeStr != "" {
+		cursor, err := db.ParseChatCursor(beforeStr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
+			return
+		}
+		before = &cursor
+	}
+
+	results, hasMore, err := db.SearchChatMessages(currentUserID, otherUserID, query, before, limit)
+	if err != nil {
+		log.Printf("Error searching chat messages: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Search failed"})
+		return
+	}
+
+	var nextCursor any
+	if hasMore {
+		nextCursor = results[len(results)-1].Cursor
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"results":     results,
+		"next_cursor": nextCursor,
+	})
+}
@@ -0,0 +1,340 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	utils "forum/internal/utils"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// chatRoomRequest is the JSON body accepted by the group conversation endpoints
+type chatRoomRequest struct {
+	RoomID   int      `json:"room_id"`
+	Name     string   `json:"name"`
+	Username string   `json:"username"`
+	Members  []string `json:"members"`
+}
+
+// apiSessionUser resolves the session user of an API request, answering 401 when there is none
+func apiSessionUser(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	userID, username, ok := sessionUser(r)
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{
+			"error": "Unauthorized",
+		})
+	}
+	return userID, username, ok
+}
+
+// decodeChatRoomRequest enforces POST and parses the request body
+func decodeChatRoomRequest(w http.ResponseWriter, r *http.Request) (chatRoomRequest, bool) {
+	var input chatRoomRequest
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Use POST",
+		})
+		return input, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid JSON body",
+		})
+		return input, false
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	input.Username = strings.TrimSpace(input.Username)
+	return input, true
+}
+
+// loadChatRoomAsMember loads a room and checks that userID belongs to it
+func loadChatRoomAsMember(w http.ResponseWriter, roomID, userID int) (db.ChatRoom, bool) {
+	room, err := db.GetChatRoom(roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Conversation not found"})
+		return room, false
+	}
+	if err != nil {
+		log.Printf("Error loading chat room %d: %v", roomID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return room, false
+	}
+	for _, member := range room.Members {
+		if member.UserID == userID {
+			return room, true
+		}
+	}
+	writeJSON(w, http.StatusForbidden, map[string]string{"error": "You are not a member of this conversation"})
+	return room, false
+}
+
+// notifyChatRoom tells members (and anyone in extra, e.g. a kicked user) that the room changed
+func (h *Hub) notifyChatRoom(roomID int, action, target string, extra ...string) {
+	room, err := db.GetChatRoom(roomID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Error loading chat room %d: %v", roomID, err)
+		return
+	}
+	payload, err := json.Marshal(map[string]any{
+		"type":    "room_update",
+		"action":  action,
+		"target":  target,
+		"room_id": roomID,
+		"room":    room,
+	})
+	if err != nil {
+		return
+	}
+
+	recipients := append([]string{}, extra...)
+	for _, member := range room.Members {
+		recipients = append(recipients, member.Username)
+	}
+	for _, username := range recipients {
+		h.pushEvent(username, db.Conversation{Kind: db.ConversationRoom, ID: roomID}, payload)
+	}
+	h.sendToRoom(GroupRoomName(roomID), payload)
+}
+
+// ChatRoomsHandler lists the caller's group conversations (GET) or creates a new one (POST)
+func (h *Hub) ChatRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		if containsHTML(r.Header.Get("Accept")) {
+			http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+			return
+		}
+		userID, _, ok := apiSessionUser(w, r)
+		if !ok {
+			return
+		}
+		rooms, err := db.GetChatRoomsForUser(userID)
+		if err != nil {
+			log.Printf("Error listing chat rooms: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"rooms": rooms})
+		return
+	}
+
+	input, ok := decodeChatRoomRequest(w, r)
+	if !ok {
+		return
+	}
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	if !utils.ValidChatRoomName(input.Name) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid conversation name"})
+		return
+	}
+	if len(input.Members)+1 > repo.CHAT_ROOM_MAX_MEMBERS {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Too many members"})
+		return
+	}
+
+	memberIDs := make([]int, 0, len(input.Members))
+	for _, username := range input.Members {
+		memberID, err := db.GetUserIDByUsername(strings.TrimSpace(username))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Unknown user " + username})
+			return
+		}
+		memberIDs = append(memberIDs, memberID)
+	}
+
+	roomID, err := db.CreateChatRoom(userID, input.Name, memberIDs)
+	if err != nil {
+		log.Printf("Error creating chat room: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	room, err := db.GetChatRoom(roomID)
+	if err != nil {
+		log.Printf("Error loading chat room %d: %v", roomID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	h.notifyChatRoom(roomID, "created", "")
+	writeJSON(w, http.StatusCreated, map[string]any{"status": "ok", "room": room})
+}
+
+// RenameChatRoomHandler lets the owner rename a group conversation
+func (h *Hub) RenameChatRoomHandler(w http.ResponseWriter, r *http.Request) {
+	input, ok := decodeChatRoomRequest(w, r)
+	if !ok {
+		return
+	}
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	room, ok := loadChatRoomAsMember(w, input.RoomID, userID)
+	if !ok {
+		return
+	}
+	if room.OwnerID != userID {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Only the owner can rename this conversation"})
+		return
+	}
+	if !utils.ValidChatRoomName(input.Name) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid conversation name"})
+		return
+	}
+	if err := db.RenameChatRoom(room.ID, input.Name); err != nil {
+		log.Printf("Error renaming chat room %d: %v", room.ID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	h.notifyChatRoom(room.ID, "renamed", input.Name)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// InviteChatRoomHandler lets any member add another user to a group conversation
+func (h *Hub) InviteChatRoomHandler(w http.ResponseWriter, r *http.Request) {
+	input, ok := decodeChatRoomRequest(w, r)
+	if !ok {
+		return
+	}
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	room, ok := loadChatRoomAsMember(w, input.RoomID, userID)
+	if !ok {
+		return
+	}
+	if len(room.Members) >= repo.CHAT_ROOM_MAX_MEMBERS {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Too many members"})
+		return
+	}
+	inviteeID, err := db.GetUserIDByUsername(input.Username)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		return
+	}
+	if err := db.AddChatRoomMember(room.ID, inviteeID); err != nil {
+		log.Printf("Error inviting to chat room %d: %v", room.ID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	h.notifyChatRoom(room.ID, "invited", input.Username)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// KickChatRoomHandler lets the owner remove a member from a group conversation
+func (h *Hub) KickChatRoomHandler(w http.ResponseWriter, r *http.Request) {
+	input, ok := decodeChatRoomRequest(w, r)
+	if !ok {
+		return
+	}
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	room, ok := loadChatRoomAsMember(w, input.RoomID, userID)
+	if !ok {
+		return
+	}
+	if room.OwnerID != userID {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "Only the owner can remove members"})
+		return
+	}
+	targetID, err := db.GetUserIDByUsername(input.Username)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		return
+	}
+	if targetID == userID {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Use leave to exit a conversation"})
+		return
+	}
+	removed, err := db.RemoveChatRoomMember(room.ID, targetID)
+	if err != nil {
+		log.Printf("Error kicking from chat room %d: %v", room.ID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	if !removed {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "User is not a member"})
+		return
+	}
+	h.notifyChatRoom(room.ID, "kicked", input.Username, input.Username)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// LeaveChatRoomHandler removes the caller from a group conversation
+func (h *Hub) LeaveChatRoomHandler(w http.ResponseWriter, r *http.Request) {
+	input, ok := decodeChatRoomRequest(w, r)
+	if !ok {
+		return
+	}
+	userID, username, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	room, ok := loadChatRoomAsMember(w, input.RoomID, userID)
+	if !ok {
+		return
+	}
+	if _, err := db.RemoveChatRoomMember(room.ID, userID); err != nil {
+		log.Printf("Error leaving chat room %d: %v", room.ID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	h.notifyChatRoom(room.ID, "left", username, username)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// ChatRoomMessagesHandler returns the stored history of a group conversation
+func ChatRoomMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Only GET is supported.",
+		})
+		return
+	}
+	if containsHTML(r.Header.Get("Accept")) {
+		http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+		return
+	}
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	roomID, err := strconv.Atoi(r.URL.Query().Get("room_id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid room_id"})
+		return
+	}
+	if _, ok := loadChatRoomAsMember(w, roomID, userID); !ok {
+		return
+	}
+
+	limit := repo.CHAT_PAGE_DEFAULT_LIMIT
+	if parsedLimit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && parsedLimit > 0 {
+		limit = min(parsedLimit, repo.CHAT_PAGE_MAX_LIMIT)
+	}
+	offset := 0
+	if parsedOffset, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && parsedOffset > 0 {
+		offset = parsedOffset
+	}
+
+	messages, err := db.GetChatRoomMessages(roomID, limit, offset)
+	if err != nil {
+		log.Printf("Error loading messages of chat room %d: %v", roomID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Failed to get messages"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"messages": messages,
+		"hasMore":  len(messages) == limit,
+	})
+}
@@ -8,7 +8,7 @@ import (
 	"strconv"
 	"strings"
  	"forum/internal/db"
- 
+ 	"forum/internal/moderation"
 	"forum/internal/utils"
 )
 
@@ -69,6 +69,14 @@ func CommentHandler(w http.ResponseWriter, r *http.Request) {
         http.Redirect(w, r, link, http.StatusSeeOther)
         return
     }
+    check := moderate(moderation.KindComment, userId, comment)
+    if reason := check.Rejection(); reason != "" {
+        writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+            "error": "Comment rejected: " + reason,
+        })
+        return
+    }
+    comment = check.Text
     err = db.AddNewComment(userId, int(postId), comment)
     if err != nil {
       
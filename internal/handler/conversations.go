@@ -0,0 +1,59 @@
+package handler
+
+import (
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ConversationsHandler lists the caller's private conversations, most
+// recently active first, a page at a time: ?limit= and ?before= the cursor of
+// the last conversation of the previous page
+func ConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Only GET is supported.",
+		})
+		return
+	}
+	if containsHTML(r.Header.Get("Accept")) {
+		http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+		return
+	}
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	limit := repo.CONVERSATIONS_PAGE_DEFAULT_LIMIT
+	if parsedLimit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && parsedLimit > 0 {
+		limit = min(parsedLimit, repo.CONVERSATIONS_PAGE_MAX_LIMIT)
+	}
+	var before *db.ChatCursor
+	if beforeStr := r.URL.Query().Get("before"); beforeStr != "" {
+		cursor, err := db.ParseChatCursor(beforeStr)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
+			return
+		}
+		before = &cursor
+	}
+
+	conversations, hasMore, err := db.GetConversations(userID, before, limit)
+	if err != nil {
+		log.Printf("Error listing conversations of user %d: %v", userID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	var nextCursor any
+	if hasMore {
+		nextCursor = conversations[len(conversations)-1].Cursor
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"conversations": conversations,
+		"hasMore":       hasMore,
+		"next_cursor":   nextCursor,
+	})
+}
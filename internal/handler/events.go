@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	auth "forum/internal/auth"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventStream writes a connection's frames as Server-Sent Events. Every event
+// carries the catch-up positions reached so far as its id, "last_seen-last_event",
+// which a reconnecting EventSource sends back in Last-Event-ID.
+type eventStream struct {
+	w         http.ResponseWriter
+	rc        *http.ResponseController
+	lastSeen  int
+	lastEvent int
+}
+
+// ServeEvents streams what /notifications carries, plus presence changes, as
+// Server-Sent Events for clients whose WebSocket upgrades do not get through
+func (h *Hub) ServeEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, username, ok := sessionUser(req)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep reverse proxies from holding events back
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		log.Printf("Event stream for %s cannot flush: %v", username, err)
+		return
+	}
+
+	lastSeen, lastEvent, resume := streamPositions(req)
+	conn := h.newUser(nil, username, userID, nil)
+	conn.stream = &eventStream{w: w, rc: rc, lastSeen: lastSeen, lastEvent: lastEvent}
+
+	// Register before replaying so nothing pushed during the replay is lost
+	h.register <- conn
+	auth.AddUserConnection(username)
+
+	defer func() {
+		h.unregister <- conn
+		auth.RemoveUserConnection(username)
+	}()
+
+	if err := conn.replay(lastSeen, lastEvent, resume); err != nil {
+		log.Printf("Catch-up for %s failed: %v", username, err)
+		return
+	}
+	conn.streamEvents(req.Context())
+}
+
+// streamPositions reads the catch-up positions from Last-Event-ID, falling
+// back to the query parameters /notifications takes on a first connection
+func streamPositions(req *http.Request) (int, int, bool) {
+	id := req.Header.Get("Last-Event-ID")
+	if id == "" {
+		return catchUpPositions(req)
+	}
+	seen, event, ok := strings.Cut(id, "-")
+	lastSeen, err := strconv.Atoi(seen)
+	if !ok || err != nil || lastSeen < 0 {
+		return 0, 0, false
+	}
+	lastEvent, err := strconv.Atoi(event)
+	if err != nil || lastEvent < 0 {
+		return 0, 0, false
+	}
+	return lastSeen, lastEvent, true
+}
+
+// streamEvents sends queued frames and keepalive comments until the client
+// goes away or a write fails
+func (c *user) streamEvents(ctx context.Context) {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-c.recieve:
+			if !ok {
+				return
+			}
+			if err := c.writeFrame(msg); err != nil {
+				log.Printf("Event stream write error for user %s: %v", c.name, err)
+				return
+			}
+		case <-ticker.C:
+			if err := c.stream.write(": ping\n\n", c.config.WriteTimeout); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// send writes a frame as an event, under the write deadline
+func (s *eventStream) send(payload []byte, timeout time.Duration) error {
+	s.advance(payload)
+	return s.write(fmt.Sprintf("id: %d-%d\ndata: %s\n\n", s.lastSeen, s.lastEvent, payload), timeout)
+}
+
+func (s *eventStream) write(text string, timeout time.Duration) error {
+	s.rc.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := s.w.Write([]byte(text)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// advance moves the positions past a frame, the way clients of /notifications
+// track them: sync sets both, events move last_event and private messages last_seen
+func (s *eventStream) advance(payload []byte) {
+	var frame struct {
+		Type      string `json:"type"`
+		ID        int    `json:"id"`
+		EventID   int    `json:"event_id"`
+		LastSeen  int    `json:"last_seen"`
+		LastEvent int    `json:"last_event"`
+	}
+	if json.Unmarshal(payload, &frame) != nil {
+		return
+	}
+	switch {
+	case frame.Type == "sync":
+		s.lastSeen, s.lastEvent = frame.LastSeen, frame.LastEvent
+	case frame.EventID > 0:
+		s.lastEvent = max(s.lastEvent, frame.EventID)
+	case frame.Type == "message" && frame.ID > 0:
+		s.lastSeen = max(s.lastSeen, frame.ID)
+	}
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"forum/internal/pubsub"
+	"log"
+)
+
+// Hub tracks live rooms and connections. All of its maps are owned by the
+// run goroutine; every other goroutine talks to it through the channels
+// below, so no locking is needed. Traffic for users and rooms is also relayed
+// through the pub/sub backend to hubs in other server processes.
+type Hub struct {
+	rooms             map[string]*room
+	globalUsers       map[string]map[*user]bool // room connections per username
+	notificationUsers map[string]map[*user]bool // notification sockets per username
+
+	acquire      chan roomRequest
+	release      chan *room
+	register     chan *user
+	unregister   chan *user
+	notify       chan hubMessage
+	roomMessages chan hubMessage
+	broadcast    chan []byte
+	deliveries   chan relay
+
+	notifications chan pendingNotification // drained by notificationLoop
+
+	backend  pubsub.Backend
+	outbound chan outboundRelay // drained by publishLoop
+	node     string             // tells this hub's relays apart from other nodes'
+
+	// Socket applies to connections accepted after it is set
+	Socket SocketConfig
+
+	limits *socketLimits // per-user rate limits, safe for concurrent use
+}
+
+// roomRequest asks the hub for a room, creating it if needed
+type roomRequest struct {
+	name  string
+	reply chan *room
+}
+
+// hubMessage is a payload addressed to a username or a room name
+type hubMessage struct {
+	target  string
+	payload []byte
+}
+
+// Create a new Hub relaying through backend; nil keeps it to this process
+func NewHub(backend pubsub.Backend) *Hub {
+	if backend == nil {
+		backend = pubsub.NewMemory()
+	}
+	h := &Hub{
+		rooms:             make(map[string]*room),
+		globalUsers:       make(map[string]map[*user]bool),
+		notificationUsers: make(map[string]map[*user]bool),
+		acquire:           make(chan roomRequest),
+		release:           make(chan *room),
+		register:          make(chan *user),
+		unregister:        make(chan *user),
+		notify:            make(chan hubMessage, messageBuffersize),
+		roomMessages:      make(chan hubMessage, messageBuffersize),
+		broadcast:         make(chan []byte, messageBuffersize),
+		deliveries:        make(chan relay, messageBuffersize),
+		notifications:     make(chan pendingNotification, messageBuffersize),
+		backend:           backend,
+		outbound:          make(chan outboundRelay, relayQueueSize),
+		node:              newNodeID(),
+		Socket:            DefaultSocketConfig(),
+		limits:            newSocketLimits(),
+	}
+	go h.run()
+	go h.publishLoop()
+	go h.notificationLoop()
+	if err := backend.Subscribe(h.receive, relayNotify, relayRoom, relayBroadcast, relayDelivery); err != nil {
+		log.Printf("pubsub: subscribe failed, relaying to other nodes disabled: %v", err)
+	}
+	return h
+}
+
+// run owns the hub state. It never blocks on a room or a connection: all
+// sends to them are non-blocking, so rooms may call back into the hub freely.
+func (h *Hub) run() {
+	for {
+		select {
+		case req := <-h.acquire:
+			r, ok := h.rooms[req.name]
+			if !ok {
+				r = NewRoom(req.name, h)
+				h.rooms[req.name] = r
+				go r.Run()
+			}
+			r.refs++
+			req.reply <- r
+
+		case r := <-h.release:
+			r.refs--
+			if r.refs <= 0 {
+				// Last connection gone: stop the room so its goroutine does not leak
+				delete(h.rooms, r.name)
+				close(r.done)
+				log.Printf("Room %s closed", r.name)
+			}
+
+		case u := <-h.register:
+			users := h.connections(u)
+			if users[u.name] == nil {
+				users[u.name] = make(map[*user]bool)
+			}
+			users[u.name][u] = true
+
+		case u := <-h.unregister:
+			users := h.connections(u)
+			if _, ok := users[u.name][u]; !ok {
+				continue
+			}
+			delete(users[u.name], u)
+			if len(users[u.name]) == 0 {
+				delete(users, u.name)
+			}
+			if u.room == nil {
+				// The hub is the only writer to notification sockets
+				close(u.recieve)
+			}
+
+		case m := <-h.notify:
+			for u := range h.notificationUsers[m.target] {
+				select {
+				case u.recieve <- u.wrap(m.payload):
+				default:
+					log.Printf("Notification channel of %s full, message dropped", u.name)
+				}
+			}
+
+		case m := <-h.roomMessages:
+			if r, ok := h.rooms[m.target]; ok {
+				select {
+				case r.server <- m.payload:
+				default:
+					log.Printf("Room %s channel full, message dropped", r.name)
+				}
+			}
+
+		case payload := <-h.broadcast:
+			for _, r := range h.rooms {
+				select {
+				case r.server <- payload:
+				default:
+				}
+			}
+			// Broadcasts are presence changes; multiplexed sockets get them
+			// once here instead of through each of their rooms, and event
+			// streams, which have no rooms, get them here too
+			for _, users := range h.notificationUsers {
+				for u := range users {
+					frame := payload
+					switch {
+					case u.session != nil:
+						frame = u.session.encode(envelopePresence, "", eventPayload{Event: payload})
+					case u.stream == nil:
+						continue
+					}
+					select {
+					case u.recieve <- frame:
+					default:
+					}
+				}
+			}
+
+		case d := <-h.deliveries:
+			if r, ok := h.rooms[d.Target]; ok {
+				select {
+				case r.deliveries <- d:
+				default:
+					log.Printf("Room %s channel full, delivery dropped", r.name)
+				}
+			}
+		}
+	}
+}
+
+// connections returns the map a user is tracked in: notification sockets have no room
+func (h *Hub) connections(u *user) map[string]map[*user]bool {
+	if u.room == nil {
+		return h.notificationUsers
+	}
+	return h.globalUsers
+}
+
+// acquireRoom returns the live room with this name, creating it if needed.
+// Every call must be paired with releaseRoom.
+func (h *Hub) acquireRoom(name string) *room {
+	reply := make(chan *room, 1)
+	h.acquire <- roomRequest{name: name, reply: reply}
+	return <-reply
+}
+
+// releaseRoom drops a reference taken by acquireRoom
+func (h *Hub) releaseRoom(r *room) {
+	h.release <- r
+}
+
+// notifyUser pushes a payload to every notification socket of a user, on every node
+func (h *Hub) notifyUser(username string, payload []byte) {
+	h.notify <- hubMessage{target: username, payload: payload}
+	h.publish(relayNotify, relay{Target: username, Payload: payload})
+}
+
+// sendToRoom forwards a server-originated payload to a room wherever it is live
+func (h *Hub) sendToRoom(name string, payload []byte) {
+	h.roomMessages <- hubMessage{target: name, payload: payload}
+	h.publish(relayRoom, relay{Target: name, Payload: payload})
+}
+
+// BroadcastToAllRooms forwards a server-originated payload to every live room on every node
+func (h *Hub) BroadcastToAllRooms(message []byte) {
+	h.broadcast <- message
+	h.publish(relayBroadcast, relay{Payload: message})
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"encoding/json"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	"log"
+)
+
+// mentionEvent tells a user they were mentioned in a chat message
+type mentionEvent struct {
+	Type     string         `json:"type"`
+	Name     string         `json:"name"` // who mentioned them
+	SenderID int            `json:"sender_id"`
+	RoomID   int            `json:"room_id,omitempty"` // 0 for a private message
+	ID       int            `json:"id"`                // the message
+	Message  string         `json:"message"`
+	Mentions []repo.Mention `json:"mentions"`
+}
+
+// recordMentions stores the mentions of a saved or edited message, fills its
+// spans and tells the participants it newly mentions. Anyone else mentioned
+// is only linked to, since they cannot read the conversation.
+func (r *room) recordMentions(chatMsg *ChatMessageData, participants map[int]string) {
+	source, conv := db.MentionMessage, db.Conversation{Kind: db.ConversationUser, ID: chatMsg.SenderID}
+	if r.groupID > 0 {
+		source, conv = db.MentionRoomMessage, db.Conversation{Kind: db.ConversationRoom, ID: r.groupID}
+	}
+	spans, added, err := db.SaveMentions(source, chatMsg.ID, chatMsg.SenderID, chatMsg.Message)
+	if err != nil {
+		log.Printf("Error recording mentions of message %d in room %s: %v", chatMsg.ID, r.name, err)
+		return
+	}
+	chatMsg.Mentions = spans
+
+	payload, err := json.Marshal(mentionEvent{
+		Type:     "mention",
+		Name:     chatMsg.Name,
+		SenderID: chatMsg.SenderID,
+		RoomID:   r.groupID,
+		ID:       chatMsg.ID,
+		Message:  chatMsg.Message,
+		Mentions: spans,
+	})
+	if err != nil {
+		return
+	}
+	for _, userID := range added {
+		username, isParticipant := participants[userID]
+		if !isParticipant || userID == chatMsg.SenderID {
+			continue
+		}
+		if blocked, err := db.IsBlockedBetween(userID, chatMsg.SenderID); err != nil || blocked {
+			continue
+		}
+		r.hub.pushEvent(username, conv, payload)
+	}
+}
+
+// reviseMentions follows an edit or delete of a message: an edit may mention
+// new participants, a deleted message mentions nobody
+func (r *room) reviseMentions(chatMsg *ChatMessageData, participants map[int]string) {
+	if chatMsg.Type == "edit" {
+		r.recordMentions(chatMsg, participants)
+		return
+	}
+	source := db.MentionMessage
+	if r.groupID > 0 {
+		source = db.MentionRoomMessage
+	}
+	if err := db.DeleteMentions(source, chatMsg.ID); err != nil {
+		log.Printf("Error removing mentions of message %d in room %s: %v", chatMsg.ID, r.name, err)
+	}
+	chatMsg.Mentions = nil
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"encoding/json"
+	db "forum/internal/db"
+	"forum/internal/moderation"
+	"log"
+)
+
+// moderate runs user content through the moderation pipeline and records
+// every decision other than a plain allow for moderators
+func moderate(kind moderation.Kind, userID int, text string) moderation.Result {
+	return moderateAll(userID, moderation.Content{Kind: kind, Text: text})[0]
+}
+
+// moderateAll screens the parts of one submission together, so that none of
+// them counts as sent unless all of them pass
+func moderateAll(userID int, parts ...moderation.Content) []moderation.Result {
+	for i := range parts {
+		parts[i].UserID = userID
+	}
+	results := moderation.CheckAll(parts...)
+	for i, result := range results {
+		logModeration(userID, parts[i], result)
+	}
+	return results
+}
+
+// logModeration records a decision other than a plain allow for moderators
+func logModeration(userID int, part moderation.Content, result moderation.Result) {
+	if result.Action == moderation.Allow {
+		return
+	}
+	reasons, err := json.Marshal(result.Reasons)
+	if err != nil {
+		log.Printf("Error encoding moderation reasons: %v", err)
+		return
+	}
+	if err := db.SaveModerationLog(userID, string(part.Kind), result.Action.String(), string(reasons), part.Text); err != nil {
+		log.Printf("Error saving moderation log: %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strings"
 	"forum/internal/db"
+	"forum/internal/moderation"
 	"forum/internal/repository"
 	"forum/internal/utils"
 )
@@ -57,6 +58,22 @@ func PostPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	checks := moderateAll(userID,
+		moderation.Content{Kind: moderation.KindTitle, Text: title},
+		moderation.Content{Kind: moderation.KindPost, Text: content})
+	titleCheck, contentCheck := checks[0], checks[1]
+	if reason := titleCheck.Rejection(); reason != "" {
+		writeJSON(w, http.StatusUnprocessableEntity,
+			map[string]string{"error": "Title rejected: " + reason})
+		return
+	}
+	if reason := contentCheck.Rejection(); reason != "" {
+		writeJSON(w, http.StatusUnprocessableEntity,
+			map[string]string{"error": "Post rejected: " + reason})
+		return
+	}
+	title, content = titleCheck.Text, contentCheck.Text
+
 	categories := r.Form["Categories"]
 	for _, c := range categories {
 		if !repository.IT_MAJOR_FIELDS[c] {
@@ -77,6 +94,12 @@ func PostPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	mentions, err := db.MentionSpans(db.MentionPost, postID, content)
+	if err != nil {
+		http.Redirect(w, r, "/servererror", http.StatusSeeOther)
+		return
+	}
+
 	// final success JSON ...
 	writeJSON(w, http.StatusCreated, map[string]any{
 		"success":    true,
@@ -84,5 +107,6 @@ func PostPostHandler(w http.ResponseWriter, r *http.Request) {
 		"title":      title,
 		"content":    content,
 		"categories": categories,
+		"mentions":   mentions,
 	})
 }
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"encoding/json"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notificationMode is how a notification reaches a user's sockets
+type notificationMode int
+
+const (
+	notifyAlert  notificationMode = iota
+	notifySilent                  // delivered flagged "silent", so unread counts stay right without alerting
+	notifySkip                    // not delivered at all
+)
+
+// notificationEventTypes are the notification socket events users can turn off
+var notificationEventTypes = map[string]bool{
+	"message":       true,
+	"group_message": true,
+	"receipt":       true,
+	"edit":          true,
+	"delete":        true,
+	"room_update":   true,
+	"pin":           true,
+	"unpin":         true,
+
+	"retention_update": true,
+	"message_expired":  true,
+
+	"forum_notification": true,
+	"mention":            true,
+}
+
+// alertingEvents carry chat messages; they are never skipped because the
+// client counts unread messages from them
+var alertingEvents = map[string]bool{
+	"message":       true,
+	"group_message": true,
+}
+
+// notificationModeFor consults the user's settings for an event of this type
+// in conv, which may be the zero Conversation
+func notificationModeFor(userID int, eventType string, conv db.Conversation) notificationMode {
+	settings, err := db.GetNotificationSettings(userID)
+	if err != nil {
+		log.Printf("Error loading notification settings of user %d: %v", userID, err)
+		return notifyAlert
+	}
+	now := time.Now()
+	if !settings.EventEnabled(eventType) {
+		if alertingEvents[eventType] {
+			return notifySilent
+		}
+		return notifySkip
+	}
+	if settings.DoNotDisturb || settings.InQuietHours(now) {
+		return notifySilent
+	}
+	if conv.Kind != "" {
+		muted, err := db.IsConversationMuted(userID, conv, now)
+		if err != nil {
+			log.Printf("Error loading mutes of user %d: %v", userID, err)
+		} else if muted {
+			return notifySilent
+		}
+	}
+	return notifyAlert
+}
+
+// notifyMessage pushes a private message to the receiver's notification
+// sockets, flagged silent when their settings say not to alert. Private
+// messages are replayed from chat_messages, so nothing is recorded.
+func (h *Hub) notifyMessage(username string, conv db.Conversation, payload []byte) {
+	if userID, err := db.GetUserIDByUsername(username); err == nil &&
+		notificationModeFor(userID, "message", conv) == notifySilent {
+		payload = withField(payload, "silent", true)
+	}
+	h.notifyUser(username, payload)
+}
+
+// NotificationSettingsHandler returns (GET) or replaces (POST) the caller's notification settings
+func NotificationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		if containsHTML(r.Header.Get("Accept")) {
+			http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+			return
+		}
+		userID, _, ok := apiSessionUser(w, r)
+		if !ok {
+			return
+		}
+		settings, err := db.GetNotificationSettings(userID)
+		if err != nil {
+			log.Printf("Error loading notification settings: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, settings)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Use GET or POST",
+		})
+		return
+	}
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	var input db.NotificationSettings
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid JSON body"})
+		return
+	}
+
+	input.QuietStart = strings.TrimSpace(input.QuietStart)
+	input.QuietEnd = strings.TrimSpace(input.QuietEnd)
+	if (input.QuietStart == "") != (input.QuietEnd == "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Quiet hours need both a start and an end"})
+		return
+	}
+	if input.QuietStart != "" {
+		if _, err := db.ParseClock(input.QuietStart); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid quiet_hours_start, use HH:MM"})
+			return
+		}
+		if _, err := db.ParseClock(input.QuietEnd); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid quiet_hours_end, use HH:MM"})
+			return
+		}
+	}
+	if input.Timezone == "" {
+		input.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(input.Timezone); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Unknown timezone"})
+		return
+	}
+	for _, eventType := range input.DisabledEvents {
+		if !notificationEventTypes[eventType] {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Unknown event type " + eventType})
+			return
+		}
+	}
+
+	if err := db.SaveNotificationSettings(userID, input); err != nil {
+		log.Printf("Error saving notification settings: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	settings, err := db.GetNotificationSettings(userID)
+	if err != nil {
+		log.Printf("Error loading notification settings: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, settings)
+}
+
+// muteRequest is the JSON body of the mute endpoints. Exactly one of
+// OtherUserID and RoomID names the conversation; Minutes 0 mutes until unmuted.
+type muteRequest struct {
+	OtherUserID int `json:"other_user_id"`
+	RoomID      int `json:"room_id"`
+	Minutes     int `json:"minutes"`
+}
+
+// decodeMuteRequest enforces POST, parses the body and checks the caller
+// takes part in the conversation
+func decodeMuteRequest(w http.ResponseWriter, r *http.Request, userID int) (muteRequest, db.Conversation, bool) {
+	var input muteRequest
+	var conv db.Conversation
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Use POST",
+		})
+		return input, conv, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid JSON body"})
+		return input, conv, false
+	}
+	if input.Minutes < 0 || input.Minutes > repo.CONVERSATION_MUTE_MAX_MINUTES {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid minutes"})
+		return input, conv, false
+	}
+
+	switch {
+	case input.OtherUserID > 0 && input.RoomID == 0:
+		if input.OtherUserID == userID {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid other_user_id"})
+			return input, conv, false
+		}
+		if _, err := db.GetUserNameById(input.OtherUserID); err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+			return input, conv, false
+		}
+		conv = db.Conversation{Kind: db.ConversationUser, ID: input.OtherUserID}
+	case input.RoomID > 0 && input.OtherUserID == 0:
+		if _, ok := loadChatRoomAsMember(w, input.RoomID, userID); !ok {
+			return input, conv, false
+		}
+		conv = db.Conversation{Kind: db.ConversationRoom, ID: input.RoomID}
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Specify either other_user_id or room_id"})
+		return input, conv, false
+	}
+	return input, conv, true
+}
+
+// ConversationMutesHandler lists the caller's muted conversations (GET) or mutes one (POST)
+func ConversationMutesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		if containsHTML(r.Header.Get("Accept")) {
+			http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+			return
+		}
+		userID, _, ok := apiSessionUser(w, r)
+		if !ok {
+			return
+		}
+		mutes, err := db.GetConversationMutes(userID, time.Now())
+		if err != nil {
+			log.Printf("Error listing conversation mutes: %v", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"mutes": mutes})
+		return
+	}
+
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	input, conv, ok := decodeMuteRequest(w, r, userID)
+	if !ok {
+		return
+	}
+	var until *time.Time
+	if input.Minutes > 0 {
+		t := time.Now().Add(time.Duration(input.Minutes) * time.Minute)
+		until = &t
+	}
+	if err := db.MuteConversation(userID, conv, until); err != nil {
+		log.Printf("Error muting conversation: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// UnmuteConversationHandler removes a mute from one of the caller's conversations
+func UnmuteConversationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	_, conv, ok := decodeMuteRequest(w, r, userID)
+	if !ok {
+		return
+	}
+	removed, err := db.UnmuteConversation(userID, conv)
+	if err != nil {
+		log.Printf("Error unmuting conversation: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	if !removed {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Conversation is not muted"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"encoding/json"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// forumNotificationEvent pushes new forum activity with the recipient's unread count
+type forumNotificationEvent struct {
+	Type         string          `json:"type"`
+	Notification db.Notification `json:"notification"`
+	Unread       int             `json:"unread"`
+}
+
+// pendingNotification is a stored forum notification waiting to be pushed
+type pendingNotification struct {
+	userID       int
+	notification db.Notification
+}
+
+// PushNotification queues a stored forum notification for the recipient's
+// notification sockets, making the hub the db package's Notifier. It never
+// blocks the request that caused it: when the queue is full the live push is
+// dropped, and the notification is still listed over REST.
+func (h *Hub) PushNotification(userID int, notification db.Notification) {
+	select {
+	case h.notifications <- pendingNotification{userID: userID, notification: notification}:
+	default:
+		log.Printf("Notification queue full, live push to user %d dropped", userID)
+	}
+}
+
+// notificationLoop pushes queued forum notifications one at a time
+func (h *Hub) notificationLoop() {
+	for p := range h.notifications {
+		h.pushNotification(p.userID, p.notification)
+	}
+}
+
+// pushNotification sends a forum notification with the recipient's unread count
+func (h *Hub) pushNotification(userID int, notification db.Notification) {
+	mode := notificationModeFor(userID, "forum_notification", db.Conversation{})
+	if mode == notifySkip {
+		return
+	}
+	username, err := db.GetUserNameById(userID)
+	if err != nil {
+		return
+	}
+	unread, err := db.CountUnreadNotifications(userID)
+	if err != nil {
+		log.Printf("Error counting notifications of user %d: %v", userID, err)
+	}
+	payload, err := json.Marshal(forumNotificationEvent{Type: "forum_notification", Notification: notification, Unread: unread})
+	if err != nil {
+		return
+	}
+	if mode == notifySilent {
+		payload = withField(payload, "silent", true)
+	}
+	h.notifyUser(username, payload)
+}
+
+// notificationRequest names one notification, or all of them
+type notificationRequest struct {
+	ID  int  `json:"id"`
+	All bool `json:"all"`
+}
+
+// decodeNotificationRequest enforces POST and parses the body
+func decodeNotificationRequest(w http.ResponseWriter, r *http.Request) (notificationRequest, bool) {
+	var input notificationRequest
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Use POST",
+		})
+		return input, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Invalid JSON body",
+		})
+		return input, false
+	}
+	if !input.All && input.ID <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Give a notification id or all"})
+		return input, false
+	}
+	return input, true
+}
+
+// NotificationsHandler lists the caller's notifications, newest first, a page
+// at a time: ?limit= and ?before= the last id of the previous page
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+			"error": "Method not allowed. Only GET is supported.",
+		})
+		return
+	}
+	if containsHTML(r.Header.Get("Accept")) {
+		http.Redirect(w, r, "/unauthorized", http.StatusSeeOther)
+		return
+	}
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+
+	limit := repo.NOTIFICATIONS_PAGE_DEFAULT_LIMIT
+	if parsedLimit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && parsedLimit > 0 {
+		limit = min(parsedLimit, repo.NOTIFICATIONS_PAGE_MAX_LIMIT)
+	}
+	before := 0
+	if beforeStr := r.URL.Query().Get("before"); beforeStr != "" {
+		parsed, err := strconv.Atoi(beforeStr)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid before"})
+			return
+		}
+		before = parsed
+	}
+
+	notifications, hasMore, err := db.GetNotifications(userID, before, limit)
+	if err != nil {
+		log.Printf("Error listing notifications of user %d: %v", userID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	unread, err := db.CountUnreadNotifications(userID)
+	if err != nil {
+		log.Printf("Error counting notifications of user %d: %v", userID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"notifications": notifications,
+		"hasMore":       hasMore,
+		"unread":        unread,
+	})
+}
+
+// ReadNotificationsHandler marks one or all of the caller's notifications read
+func ReadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	input, ok := decodeNotificationRequest(w, r)
+	if !ok {
+		return
+	}
+	if input.All {
+		_, err := db.MarkAllNotificationsRead(userID)
+		if err != nil {
+			log.Printf("Error marking notifications of user %d read: %v", userID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+	} else {
+		found, err := db.MarkNotificationRead(userID, input.ID)
+		if err != nil {
+			log.Printf("Error marking notification %d read: %v", input.ID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+		if !found {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "Notification not found"})
+			return
+		}
+	}
+	writeUnreadNotifications(w, userID)
+}
+
+// DeleteNotificationsHandler deletes one or all of the caller's notifications
+func DeleteNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := apiSessionUser(w, r)
+	if !ok {
+		return
+	}
+	input, ok := decodeNotificationRequest(w, r)
+	if !ok {
+		return
+	}
+	if input.All {
+		_, err := db.DeleteAllNotifications(userID)
+		if err != nil {
+			log.Printf("Error deleting notifications of user %d: %v", userID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+	} else {
+		found, err := db.DeleteNotification(userID, input.ID)
+		if err != nil {
+			log.Printf("Error deleting notification %d: %v", input.ID, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+			return
+		}
+		if !found {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "Notification not found"})
+			return
+		}
+	}
+	writeUnreadNotifications(w, userID)
+}
+
+// writeUnreadNotifications answers a change with the caller's new unread count
+func writeUnreadNotifications(w http.ResponseWriter, userID int) {
+	unread, err := db.CountUnreadNotifications(userID)
+	if err != nil {
+		log.Printf("Error counting notifications of user %d: %v", userID, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "unread": unread})
+}
@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	utils "forum/internal/utils"
+	"slices"
+	"strings"
+)
+
+// The multiplexed socket speaks a versioned protocol. Every frame, in both
+// directions, is an envelope with the protocol version, the frame type, an id
+// the client may choose and replies echo, and a typed payload. Clients open
+// with hello listing the versions they speak; the server answers welcome with
+// the version it picked, or unsupported_version before closing. hello and
+// welcome keep their shape in every version.
+
+// protocolVersions are the versions this server speaks, oldest first
+var protocolVersions = []int{1}
+
+// frame is the envelope of every frame on the multiplexed socket
+type frame struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// payload is the body of a client frame; validate refuses bad values before
+// anything acts on them
+type payload interface {
+	validate() error
+}
+
+// roomPayload is a payload addressed to a subscribed conversation
+type roomPayload interface {
+	payload
+	target() db.Conversation
+	roomFrame(frameType, id string) ChatMessageData
+}
+
+// clientFrames registers the frame types clients may send with their
+// payloads. Frames of any other type are refused, never forwarded.
+var clientFrames = map[string]func() payload{
+	"hello":       func() payload { return &helloPayload{} },
+	"subscribe":   func() payload { return &conversationPayload{} },
+	"unsubscribe": func() payload { return &conversationPayload{} },
+	"message":     func() payload { return &messagePayload{} },
+	"edit":        func() payload { return &editPayload{} },
+	"delete":      func() payload { return &messageRefPayload{} },
+	"ack":         func() payload { return &messageRefPayload{} },
+	"read":        func() payload { return &messageRefPayload{} },
+	"pin":         func() payload { return &messageRefPayload{} },
+	"unpin":       func() payload { return &messageRefPayload{} },
+	"typing":      func() payload { return &conversationPayload{} },
+	"stop_typing": func() payload { return &conversationPayload{} },
+}
+
+// Error codes of refused frames
+const (
+	codeMalformed          = "malformed_frame"
+	codeUnsupportedVersion = "unsupported_version"
+	codeUnknownType        = "unknown_type"
+	codeInvalidPayload     = "invalid_payload"
+	codeHandshakeRequired  = "handshake_required"
+	codeUnexpectedFrame    = "unexpected_frame"
+	codeNotSubscribed      = "not_subscribed"
+	codeForbidden          = "forbidden"
+	codeRateLimited        = "rate_limited"
+)
+
+// protocolError is a refusal sent back to the client
+type protocolError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	FrameType string `json:"frame_type,omitempty"`
+	Versions  []int  `json:"versions,omitempty"` // the versions the server speaks
+}
+
+func (e *protocolError) Error() string { return e.Code + ": " + e.Message }
+
+// decodeFrame parses an envelope and its payload. Before the handshake agreed
+// on a version, version is 0 and frames of any version are decoded.
+func decodeFrame(msg []byte, version int) (frame, payload, *protocolError) {
+	var f frame
+	if err := json.Unmarshal(msg, &f); err != nil {
+		return f, nil, &protocolError{Code: codeMalformed, Message: "Frame is not a JSON envelope"}
+	}
+	if version != 0 && f.V != version && f.Type != "hello" {
+		return f, nil, &protocolError{Code: codeUnsupportedVersion, Message: "Frame version does not match the session",
+			FrameType: f.Type, Versions: protocolVersions}
+	}
+	if len(f.ID) > repo.CHAT_CLIENT_MSG_ID_MAX_LEN {
+		return f, nil, &protocolError{Code: codeMalformed, Message: "Frame id is too long", FrameType: f.Type}
+	}
+	newPayload, ok := clientFrames[f.Type]
+	if !ok {
+		return f, nil, &protocolError{Code: codeUnknownType, Message: "Unknown frame type", FrameType: f.Type}
+	}
+	p := newPayload()
+	if len(f.Payload) > 0 {
+		if err := json.Unmarshal(f.Payload, p); err != nil {
+			return f, nil, &protocolError{Code: codeInvalidPayload, Message: "Payload does not match the frame type", FrameType: f.Type}
+		}
+	}
+	if err := p.validate(); err != nil {
+		return f, nil, &protocolError{Code: codeInvalidPayload, Message: err.Error(), FrameType: f.Type}
+	}
+	return f, p, nil
+}
+
+// helloPayload opens a session: the versions the client speaks and,
+// optionally, its catch-up positions as on /notifications
+type helloPayload struct {
+	Versions  []int `json:"versions"`
+	LastSeen  *int  `json:"last_seen,omitempty"`
+	LastEvent *int  `json:"last_event,omitempty"`
+}
+
+func (p *helloPayload) validate() error {
+	if len(p.Versions) == 0 {
+		return errors.New("versions is required")
+	}
+	if (p.LastSeen != nil && *p.LastSeen < 0) || (p.LastEvent != nil && *p.LastEvent < 0) {
+		return errors.New("positions cannot be negative")
+	}
+	return nil
+}
+
+// pick returns the newest version both sides speak, or 0
+func (p *helloPayload) pick() int {
+	for i := len(protocolVersions) - 1; i >= 0; i-- {
+		if slices.Contains(p.Versions, protocolVersions[i]) {
+			return protocolVersions[i]
+		}
+	}
+	return 0
+}
+
+// positions returns the catch-up positions; without last_seen there is no replay
+func (p *helloPayload) positions() (int, int, bool) {
+	if p.LastSeen == nil {
+		return 0, 0, false
+	}
+	lastEvent := 0
+	if p.LastEvent != nil {
+		lastEvent = *p.LastEvent
+	}
+	return *p.LastSeen, lastEvent, true
+}
+
+// welcomePayload answers hello with the version the session uses
+type welcomePayload struct {
+	Version  int   `json:"version"`
+	Versions []int `json:"versions"`
+}
+
+// eventPayload carries a frame of the single-purpose sockets: a room frame
+// of a conversation, a notification or a presence change
+type eventPayload struct {
+	Conversation *db.Conversation `json:"conversation,omitempty"`
+	Event        json.RawMessage  `json:"event"`
+}
+
+// conversationPayload names a conversation; it is the whole payload of
+// subscribe, unsubscribe and the typing indicators
+type conversationPayload struct {
+	Conversation db.Conversation `json:"conversation"`
+}
+
+func (p *conversationPayload) validate() error {
+	if p.Conversation.Kind != db.ConversationUser && p.Conversation.Kind != db.ConversationRoom {
+		return errors.New("conversation kind must be user or room")
+	}
+	if p.Conversation.ID <= 0 {
+		return errors.New("conversation id must be positive")
+	}
+	return nil
+}
+
+func (p *conversationPayload) target() db.Conversation { return p.Conversation }
+
+func (p *conversationPayload) roomFrame(frameType, id string) ChatMessageData {
+	return ChatMessageData{Type: frameType}
+}
+
+// messagePayload sends a chat message; the frame id deduplicates resends
+type messagePayload struct {
+	conversationPayload
+	Message string `json:"message"`
+}
+
+func (p *messagePayload) validate() error {
+	if err := p.conversationPayload.validate(); err != nil {
+		return err
+	}
+	p.Message = strings.TrimSpace(p.Message)
+	return checkChatText(p.Message)
+}
+
+func (p *messagePayload) roomFrame(frameType, id string) ChatMessageData {
+	return ChatMessageData{Type: frameType, Message: p.Message, ClientMsgID: id}
+}
+
+// messageRefPayload points at a stored message: delete, ack, read, pin and unpin
+type messageRefPayload struct {
+	conversationPayload
+	MessageID int `json:"message_id"`
+}
+
+func (p *messageRefPayload) validate() error {
+	if err := p.conversationPayload.validate(); err != nil {
+		return err
+	}
+	return checkMessageID(p.MessageID)
+}
+
+func (p *messageRefPayload) roomFrame(frameType, id string) ChatMessageData {
+	return ChatMessageData{Type: frameType, ID: p.MessageID}
+}
+
+// editPayload replaces the text of the sender's own message
+type editPayload struct {
+	messageRefPayload
+	Message string `json:"message"`
+}
+
+func (p *editPayload) validate() error {
+	if err := p.messageRefPayload.validate(); err != nil {
+		return err
+	}
+	p.Message = strings.TrimSpace(p.Message)
+	return checkChatText(p.Message)
+}
+
+func (p *editPayload) roomFrame(frameType, id string) ChatMessageData {
+	return ChatMessageData{Type: frameType, ID: p.MessageID, Message: p.Message}
+}
+
+// roomFrameChecks registers the frame types clients may send into a room,
+// on any socket, with their validation. Frames of other types are refused
+// and never reach the room.
+var roomFrameChecks = map[string]func(*ChatMessageData) error{
+	"message":     checkMessageFrame,
+	"edit":        checkEditFrame,
+	"delete":      checkMessageRefFrame,
+	"ack":         checkMessageRefFrame,
+	"read":        checkMessageRefFrame,
+	"pin":         checkMessageRefFrame,
+	"unpin":       checkMessageRefFrame,
+	"typing":      func(*ChatMessageData) error { return nil },
+	"stop_typing": func(*ChatMessageData) error { return nil },
+}
+
+func checkMessageFrame(m *ChatMessageData) error {
+	m.Message = strings.TrimSpace(m.Message)
+	if err := checkChatText(m.Message); err != nil {
+		return err
+	}
+	if len(m.ClientMsgID) > repo.CHAT_CLIENT_MSG_ID_MAX_LEN {
+		return errors.New("client_msg_id is too long")
+	}
+	return nil
+}
+
+func checkEditFrame(m *ChatMessageData) error {
+	if err := checkMessageID(m.ID); err != nil {
+		return err
+	}
+	m.Message = strings.TrimSpace(m.Message)
+	return checkChatText(m.Message)
+}
+
+func checkMessageRefFrame(m *ChatMessageData) error {
+	return checkMessageID(m.ID)
+}
+
+func checkChatText(text string) error {
+	if !utils.ValidChatMessage(text) {
+		return fmt.Errorf("message must be between %d and %d characters", repo.CHAT_MESSAGE_MIN_LEN, repo.CHAT_MESSAGE_MAX_LEN)
+	}
+	return nil
+}
+
+func checkMessageID(id int) error {
+	if id <= 0 {
+		return errors.New("message id must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+)
+
+// Pub/sub channels hub traffic crosses processes on
+const (
+	relayNotify    = "forum:notify"    // payloads for a user's notification sockets
+	relayRoom      = "forum:room"      // server frames for a room
+	relayBroadcast = "forum:broadcast" // server frames for every room
+	relayDelivery  = "forum:delivery"  // client frames a node already processed for a room
+)
+
+// relayQueueSize is how many relays may wait for the backend before new ones are dropped
+const relayQueueSize = 1024
+
+// outboundRelay is an encoded relay waiting to be published
+type outboundRelay struct {
+	channel string
+	payload []byte
+}
+
+// relay is a hub payload travelling between nodes. Each node handles its own
+// payloads directly and ignores them when they come back from the backend.
+type relay struct {
+	Origin  string `json:"origin"`
+	Target  string `json:"target,omitempty"`  // username or room name
+	Skip    string `json:"skip,omitempty"`    // user the delivery must not reach
+	Members []int  `json:"members,omitempty"` // group rooms: users the delivery may reach
+	Payload []byte `json:"payload"`
+}
+
+// memberSet turns the relayed member list back into the map rooms filter by
+func (d relay) memberSet() map[int]string {
+	if d.Members == nil {
+		return nil
+	}
+	members := make(map[int]string, len(d.Members))
+	for _, id := range d.Members {
+		members[id] = ""
+	}
+	return members
+}
+
+// newNodeID names this process among the nodes sharing a backend
+func newNodeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// publish queues a relay for the other nodes. It never waits on the backend:
+// when the queue is full the relay is dropped, which only costs remote delivery.
+func (h *Hub) publish(channel string, d relay) {
+	d.Origin = h.node
+	payload, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	select {
+	case h.outbound <- outboundRelay{channel: channel, payload: payload}:
+	default:
+		log.Printf("pubsub: outbound queue full, relay on %s dropped", channel)
+	}
+}
+
+// publishLoop hands queued relays to the backend one at a time, so a slow or
+// unreachable backend holds up nothing but this goroutine
+func (h *Hub) publishLoop() {
+	for o := range h.outbound {
+		if err := h.backend.Publish(o.channel, o.payload); err != nil {
+			log.Printf("pubsub: publish on %s failed: %v", o.channel, err)
+		}
+	}
+}
+
+// relayDelivery shares a frame a room processed with the same room on other nodes
+func (h *Hub) relayDelivery(roomName, skip string, members map[int]string, payload []byte) {
+	d := relay{Target: roomName, Skip: skip, Payload: payload}
+	if members != nil {
+		d.Members = make([]int, 0, len(members))
+		for id := range members {
+			d.Members = append(d.Members, id)
+		}
+	}
+	h.publish(relayDelivery, d)
+}
+
+// receive hands relays from other nodes to the hub loop
+func (h *Hub) receive(channel string, payload []byte) {
+	var d relay
+	if err := json.Unmarshal(payload, &d); err != nil {
+		log.Printf("pubsub: malformed relay on %s: %v", channel, err)
+		return
+	}
+	if d.Origin == h.node {
+		return
+	}
+	switch channel {
+	case relayNotify:
+		h.notify <- hubMessage{target: d.Target, payload: d.Payload}
+	case relayRoom:
+		h.roomMessages <- hubMessage{target: d.Target, payload: d.Payload}
+	case relayBroadcast:
+		h.broadcast <- d.Payload
+	case relayDelivery:
+		h.deliveries <- d
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"forum/internal/pubsub"
+	"forum/internal/pubsub/pubsubtest"
+)
+
+// newRedisHub starts a hub relaying through the fake server
+func newRedisHub(t *testing.T, server *pubsubtest.FakeRedis) *Hub {
+	t.Helper()
+	backend, err := pubsub.NewRedis(server.Addr())
+	if err != nil {
+		t.Fatalf("connecting to fake redis: %v", err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	return NewHub(backend)
+}
+
+// expectFrame waits for a frame on a user's queue
+func expectFrame(t *testing.T, u *user, want string) {
+	t.Helper()
+	select {
+	case got := <-u.recieve:
+		if string(got) != want {
+			t.Fatalf("%s got %s, want %s", u.name, got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s got nothing, want %s", u.name, want)
+	}
+}
+
+func TestRelayCrossesNodes(t *testing.T) {
+	server, err := pubsubtest.NewFakeRedis("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	sender := newRedisHub(t, server)
+	receiver := newRedisHub(t, server)
+
+	// bob is in a public room and has a notification socket on the receiving node
+	r := receiver.acquireRoom("lobby")
+	defer receiver.releaseRoom(r)
+	inRoom := &user{name: "bob", recieve: make(chan []byte, messageBuffersize), room: r}
+	r.join <- inRoom
+	notifications := &user{name: "bob", recieve: make(chan []byte, messageBuffersize)}
+	receiver.register <- notifications
+
+	t.Run("room", func(t *testing.T) {
+		frame := `{"type":"message","name":"alice","message":"hello"}`
+		sender.sendToRoom("lobby", []byte(frame))
+		expectFrame(t, inRoom, frame)
+	})
+
+	t.Run("notification", func(t *testing.T) {
+		frame := `{"type":"notification","message":"alice liked your post"}`
+		sender.notifyUser("bob", []byte(frame))
+		expectFrame(t, notifications, frame)
+	})
+
+	t.Run("presence", func(t *testing.T) {
+		frame := `{"type":"user_status","name":"alice","online":true}`
+		sender.BroadcastToAllRooms([]byte(frame))
+		expectFrame(t, inRoom, frame)
+	})
+}
@@ -4,47 +4,36 @@ import (
 	"encoding/json"
 	auth "forum/internal/auth"
 	db "forum/internal/db"
+	"forum/internal/moderation"
+	repo "forum/internal/repository"
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/websocket"
 )
 
-type Hub struct {
-	Rooms             map[string]*room
-	globalUsers       map[string]*user
-	notificationUsers map[string]*user
+// receiptEvent tells a sender that the peer received or read their messages
+type receiptEvent struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	db.Receipt
 }
 
-// Create a new Hub
-func NewHub() *Hub {
-	h := &Hub{
-		Rooms:             make(map[string]*room),
-		globalUsers:       make(map[string]*user),
-		notificationUsers: make(map[string]*user),
+// notifyReceipt pushes a receipt to the sender's notification socket and
+// returns the frame, or nil when the receipt covers no messages
+func (h *Hub) notifyReceipt(senderName, readerName string, receipt db.Receipt) []byte {
+	if len(receipt.IDs) == 0 {
+		return nil
 	}
-	go h.run()
-	return h
-}
-
-func (h *Hub) run() {
-}
-
-func (h *Hub) broadcastUsersToAllRooms() {
-}
-
-func (h *Hub) broadcastGlobalUsers() {
-}
-
-func (h *Hub) BroadcastToAllRooms(message []byte) {
-	for _, room := range h.Rooms {
-		select {
-		case room.forward <- message:
-		default:
-		}
+	payload, err := json.Marshal(receiptEvent{Type: "receipt", Name: readerName, Receipt: receipt})
+	if err != nil {
+		return nil
 	}
+	h.pushEvent(senderName, db.Conversation{}, payload)
+	return payload
 }
 
 func CreatePrivateRoomName(user1, user2 string) string {
@@ -53,14 +42,9 @@ func CreatePrivateRoomName(user1, user2 string) string {
 	return "private_" + strings.Join(users, "_")
 }
 
-func (h *Hub) GetRoom(name string) *room {
-	if r, ok := h.Rooms[name]; ok {
-		return r
-	}
-	r := NewRoom(name, h)
-	h.Rooms[name] = r
-	go r.Run()
-	return r
+// GroupRoomName returns the hub room name of a persistent group conversation
+func GroupRoomName(roomID int) string {
+	return "group_" + strconv.Itoa(roomID)
 }
 
 // Room stores users and channels
@@ -68,21 +52,35 @@ type room struct {
 	users   map[*user]bool
 	join    chan *user
 	leave   chan *user
-	forward chan []byte
+	forward chan []byte   // frames from this node's clients
+	server  chan []byte   // frames from the server, on any node
+	done    chan struct{} // closed by the hub once the last connection is released
+	refs    int           // connections holding the room; owned by Hub.run
 	name    string
 	hub     *Hub
+	groupID int // set for persistent group conversations
+
+	deliveries chan relay // frames other nodes processed for this room
 }
 
 // Create a new Room with name
 func NewRoom(name string, hub *Hub) *room {
-	return &room{
+	r := &room{
 		users:   make(map[*user]bool),
 		join:    make(chan *user),
 		leave:   make(chan *user),
-		forward: make(chan []byte),
+		forward: make(chan []byte, messageBuffersize),
+		server:  make(chan []byte, messageBuffersize),
+		done:    make(chan struct{}),
 		name:    name,
 		hub:     hub,
+
+		deliveries: make(chan relay, messageBuffersize),
 	}
+	if id, err := strconv.Atoi(strings.TrimPrefix(name, "group_")); err == nil && strings.HasPrefix(name, "group_") {
+		r.groupID = id
+	}
+	return r
 }
 
 // ChatMessageData represents the structure of chat messages
@@ -93,12 +91,34 @@ type ChatMessageData struct {
 	SenderID  int    `json:"sender_id,omitempty"`
 	CreatedAt string `json:"created_at,omitempty"`
 	ID        int    `json:"id,omitempty"`
+	RoomID    int    `json:"room_id,omitempty"`
+	EditedAt  string `json:"edited_at,omitempty"`
+	DeletedAt string `json:"deleted_at,omitempty"`
+	Silent    bool   `json:"silent,omitempty"` // notification the receiver asked not to be alerted about
+
+	ClientMsgID string `json:"client_msg_id,omitempty"` // chosen by the sender to deduplicate resends
+
+	Mentions []repo.Mention `json:"mentions,omitempty"`
+}
+
+// messageAck tells the sender which stored message a send became
+type messageAck struct {
+	Type        string `json:"type"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	ID          int    `json:"id"`
+	CreatedAt   string `json:"created_at"`
+	Message     string `json:"message"` // as stored, which moderation may have masked
+
+	Mentions []repo.Mention `json:"mentions,omitempty"`
 }
 
 // Run handles all room events
 func (r *room) Run() {
 	for {
 		select {
+		case <-r.done:
+			return
+
 		case u := <-r.join:
 			r.users[u] = true
 			log.Printf("User %s joined room %s (now %d users in room)", u.name, r.name, len(r.users))
@@ -114,86 +134,439 @@ func (r *room) Run() {
 			}
 
 		case msg := <-r.forward:
-			var chatMsg ChatMessageData
-			if err := json.Unmarshal(msg, &chatMsg); err == nil {
-				log.Printf(" Processing message in room %s: %+v", r.name, chatMsg)
-
-				switch chatMsg.Type {
-				case "message":
-					if strings.HasPrefix(r.name, "private_") {
-						usernames := strings.Split(strings.TrimPrefix(r.name, "private_"), "_")
-						if len(usernames) == 2 {
-							// Get sender ID - prioritize sender_id from message
-							var senderID int
-							if chatMsg.SenderID > 0 {
-								senderID = chatMsg.SenderID
-							} else {
-								senderID = r.getUserIDByUsername(chatMsg.Name)
-							}
-
-							// Determine receiver
-							receiverName := usernames[0]
-							if receiverName == chatMsg.Name {
-								receiverName = usernames[1]
-							}
-							receiverID := r.getUserIDByUsername(receiverName)
-
-							if senderID <= 0 || receiverID <= 0 {
-								// Still forward the message even if save fails
-								break
-							}
-
-							// Save message to database
-							err := db.SaveChatMessage(senderID, receiverID, chatMsg.Message)
-							if err == nil {
-								// IMPORTANT: Retrieve the saved message to get the ID and created_at timestamp
-								messages, err := db.GetChatMessages(senderID, receiverID, 1, 0)
-								if err == nil && len(messages) > 0 {
-									// Update the message with the actual ID and created_at from database
-									chatMsg.ID = messages[0].ID
-									chatMsg.CreatedAt = messages[0].CreatedAt
-									// Re-marshal with updated ID and timestamp
-									if updatedMsg, err := json.Marshal(chatMsg); err == nil {
-										msg = updatedMsg
-									}
-								}
-
-								// Send notification to receiver if they're connected for notifications
-								if notifUser, exists := r.hub.notificationUsers[receiverName]; exists {
-									select {
-									case notifUser.recieve <- msg:
-									default:
-									}
-								}
-							}
-						}
-					}
-				case "typing", "stop_typing":
-					log.Printf("Typing indicator: %s from %s", chatMsg.Type, chatMsg.Name)
-				}
+			r.handleFrame(msg, true)
+
+		case msg := <-r.server:
+			r.handleFrame(msg, false)
+
+		case d := <-r.deliveries:
+			r.deliverLocal(d.Payload, d.Skip, d.memberSet())
+		}
+	}
+}
+
+// handleFrame processes a frame and delivers the result to the room. Frames
+// from this node's clients are stored and checked here, once, and the result
+// is relayed to the other nodes; server frames reach every node on their own.
+func (r *room) handleFrame(msg []byte, fromClient bool) {
+	var chatMsg ChatMessageData
+	if err := json.Unmarshal(msg, &chatMsg); err != nil {
+		log.Printf("Dropping malformed frame in room %s", r.name)
+		return
+	}
+	// Sockets validate client frames; anything else never reaches the room
+	if _, known := roomFrameChecks[chatMsg.Type]; fromClient && !known {
+		log.Printf("Dropping %q frame in room %s", chatMsg.Type, r.name)
+		return
+	}
+
+	// Group rooms only ever carry frames from current members (or the server itself)
+	var members map[int]string
+	if r.groupID > 0 {
+		var err error
+		members, err = db.GetChatRoomMemberIDs(r.groupID)
+		if err != nil {
+			log.Printf("Error loading members of room %s: %v", r.name, err)
+			return
+		}
+		if _, isMember := members[chatMsg.SenderID]; chatMsg.SenderID > 0 && !isMember {
+			log.Printf("Dropping frame from non-member %s in room %s", chatMsg.Name, r.name)
+			return
+		}
+		// Members blocked either way with the sender get none of their frames;
+		// relayed deliveries carry the narrowed member list to other nodes
+		if fromClient && chatMsg.SenderID > 0 {
+			hidden, err := db.GetBlockedPeerIDs(chatMsg.SenderID)
+			if err != nil {
+				log.Printf("Error loading blocks of %s in room %s: %v", chatMsg.Name, r.name, err)
+				return
+			}
+			for id := range hidden {
+				delete(members, id)
 			}
+		}
+	}
+
+	if fromClient {
+		log.Printf(" Processing message in room %s: %+v", r.name, chatMsg)
 
-			// Forward message to all users in the room
-			log.Printf(" DEBUG: Room %s has %d users", r.name, len(r.users))
-			var senderName string
-			if chatMsg.Type == "message" {
-				senderName = chatMsg.Name
+		// A resend of a stored message is acked without being screened again
+		if chatMsg.Type == "message" && r.ackResend(chatMsg) {
+			return
+		}
+		// Every chat message and edit is screened, whatever room carries it
+		if chatMsg.Type == "message" || chatMsg.Type == "edit" {
+			if chatMsg.Type == "edit" {
+				chatMsg.Message = strings.TrimSpace(chatMsg.Message)
+			}
+			if !r.moderateMessage(&chatMsg) {
+				return
 			}
-			for usr := range r.users {
-				// Skip sending the message back to the sender to prevent duplicates
-				if usr.name == senderName {
-					log.Printf(" DEBUG: Skipping sender %s", usr.name)
-					continue
+		}
+
+		switch chatMsg.Type {
+		case "message":
+			if r.groupID > 0 {
+				saved, created, err := db.SaveChatRoomMessage(r.groupID, chatMsg.SenderID, chatMsg.Message, chatMsg.ClientMsgID)
+				if err != nil {
+					log.Printf("Error saving message in room %s: %v", r.name, err)
+					r.sendTo(chatMsg.Name, r.refusal(chatMsg, "Message could not be sent"))
+					return
+				}
+				chatMsg.ID = saved.ID
+				chatMsg.CreatedAt = saved.CreatedAt
+				chatMsg.RoomID = r.groupID
+				chatMsg.Mentions = saved.Mentions
+				if created {
+					r.recordMentions(&chatMsg, members)
+				}
+				r.ackSender(chatMsg)
+				if !created {
+					// A resend of a stored message; the members already have it
+					return
+				}
+				if updatedMsg, err := json.Marshal(chatMsg); err == nil {
+					msg = updatedMsg
 				}
-				log.Printf(" DEBUG: Forwarding to user %s, message: %s", usr.name, string(msg))
-				select {
-				case usr.recieve <- msg:
-					log.Printf(" Message forwarded to user %s", usr.name)
-				default:
-					log.Printf(" User %s channel full, message dropped", usr.name)
+				r.notifyAbsentMembers(members, chatMsg)
+			} else if strings.HasPrefix(r.name, "private_") {
+				// Sender identity is stamped by user.read from the session
+				senderID := chatMsg.SenderID
+				receiverName, ok := r.privatePeer(chatMsg.Name)
+				receiverID := 0
+				if ok {
+					receiverID = r.getUserIDByUsername(receiverName)
+				}
+				if senderID <= 0 || receiverID <= 0 {
+					r.sendTo(chatMsg.Name, r.refusal(chatMsg, "Message could not be sent"))
+					return
+				}
+
+				// A block made while both sockets were open stops delivery too
+				if blocked, err := db.IsBlockedBetween(senderID, receiverID); err != nil || blocked {
+					r.sendTo(chatMsg.Name, r.refusal(chatMsg, "You cannot message this user"))
+					return
 				}
+
+				// Save message to database
+				saved, created, err := db.SaveChatMessage(senderID, receiverID, chatMsg.Message, chatMsg.ClientMsgID)
+				if err != nil {
+					log.Printf("Error saving message in room %s: %v", r.name, err)
+					r.sendTo(chatMsg.Name, r.refusal(chatMsg, "Message could not be sent"))
+					return
+				}
+				chatMsg.ID = saved.ID
+				chatMsg.CreatedAt = saved.CreatedAt
+				chatMsg.Mentions = saved.Mentions
+				if created {
+					r.recordMentions(&chatMsg, map[int]string{receiverID: receiverName})
+				}
+				r.ackSender(chatMsg)
+				if !created {
+					// A resend of a stored message; the receiver already has it
+					return
+				}
+				// Re-marshal with the stored ID and timestamp
+				if updatedMsg, err := json.Marshal(chatMsg); err == nil {
+					msg = updatedMsg
+				}
+
+				// Send notification to receiver if they're connected for notifications
+				r.hub.notifyMessage(receiverName, db.Conversation{Kind: db.ConversationUser, ID: senderID}, msg)
+				r.hub.pushUnreadUpdate(receiverID)
 			}
+		case "ack", "read":
+			// Receipts only go back to the peer whose messages were acknowledged
+			payload := r.applyReceipt(chatMsg)
+			if payload == nil {
+				return
+			}
+			msg = payload
+			chatMsg.Type = "receipt"
+		case "edit", "delete":
+			if !r.applyRevision(&chatMsg, members) {
+				return
+			}
+			if updatedMsg, err := json.Marshal(chatMsg); err == nil {
+				msg = updatedMsg
+			}
+		case "pin", "unpin":
+			payload := r.applyPin(chatMsg)
+			if payload == nil {
+				return
+			}
+			msg = payload
+		case "typing", "stop_typing":
+			if r.blockedPeer(chatMsg) {
+				return
+			}
+			log.Printf("Typing indicator: %s from %s", chatMsg.Type, chatMsg.Name)
+		}
+	}
+
+	// Forward message to all users in the room
+	var senderName string
+	if chatMsg.Type == "message" || chatMsg.Type == "receipt" {
+		senderName = chatMsg.Name
+	}
+	r.deliverLocal(msg, senderName, members)
+	if fromClient {
+		r.hub.relayDelivery(r.name, senderName, members, msg)
+	}
+}
+
+// deliverLocal sends a frame to this node's connections in the room, except
+// those of skip and, in group rooms, of non-members
+func (r *room) deliverLocal(msg []byte, skip string, members map[int]string) {
+	for usr := range r.users {
+		if _, isMember := members[usr.userID]; r.groupID > 0 && !isMember {
+			continue
+		}
+		// Skip sending the message back to the sender to prevent duplicates
+		if usr.name == skip {
+			continue
+		}
+		select {
+		case usr.recieve <- msg:
+		default:
+			log.Printf(" User %s channel full, message dropped", usr.name)
+		}
+	}
+}
+
+// ackSender confirms a stored message to the sender's connections in this room
+func (r *room) ackSender(chatMsg ChatMessageData) {
+	payload, err := json.Marshal(messageAck{
+		Type:        "ack",
+		ClientMsgID: chatMsg.ClientMsgID,
+		ID:          chatMsg.ID,
+		CreatedAt:   chatMsg.CreatedAt,
+		Message:     chatMsg.Message,
+		Mentions:    chatMsg.Mentions,
+	})
+	if err != nil {
+		return
+	}
+	r.sendTo(chatMsg.Name, payload)
+}
+
+// refusal builds the frame telling a sender their message was not delivered
+func (r *room) refusal(chatMsg ChatMessageData, reason string) []byte {
+	payload, _ := json.Marshal(map[string]string{
+		"type":          "error",
+		"client_msg_id": chatMsg.ClientMsgID,
+		"message":       reason,
+	})
+	return payload
+}
+
+// moderateMessage screens a chat message or edit before it is stored,
+// masking it in place. It reports false, after telling the sender why, when
+// the message is rejected.
+func (r *room) moderateMessage(chatMsg *ChatMessageData) bool {
+	result := moderate(moderation.KindChat, chatMsg.SenderID, chatMsg.Message)
+	if reason := result.Rejection(); reason != "" {
+		r.sendTo(chatMsg.Name, r.refusal(*chatMsg, "Message rejected: "+reason))
+		return false
+	}
+	chatMsg.Message = result.Text
+	return true
+}
+
+// sendTo queues a server frame for one user's connections in this room
+func (r *room) sendTo(username string, payload []byte) {
+	if payload == nil {
+		return
+	}
+	for usr := range r.users {
+		if usr.name != username {
+			continue
+		}
+		select {
+		case usr.recieve <- payload:
+		default:
+			log.Printf(" User %s channel full, frame dropped", usr.name)
+		}
+	}
+}
+
+// privatePeer returns the other participant of a private room. The room name
+// is matched against the participant's own name rather than split on "_",
+// which usernames may contain.
+func (r *room) privatePeer(username string) (string, bool) {
+	pair, ok := strings.CutPrefix(r.name, "private_")
+	if !ok || username == "" {
+		return "", false
+	}
+	if peer, ok := strings.CutPrefix(pair, username+"_"); ok && peer != "" {
+		return peer, true
+	}
+	if peer, ok := strings.CutSuffix(pair, "_"+username); ok && peer != "" {
+		return peer, true
+	}
+	return "", false
+}
+
+// ackResend acks a message the sender already stored under the same client
+// id, reporting whether the frame was one
+func (r *room) ackResend(chatMsg ChatMessageData) bool {
+	if chatMsg.ClientMsgID == "" || chatMsg.SenderID <= 0 {
+		return false
+	}
+	if r.groupID > 0 {
+		stored, err := db.GetChatRoomMessageByClientID(r.groupID, chatMsg.SenderID, chatMsg.ClientMsgID)
+		if err != nil {
+			return false
+		}
+		chatMsg.ID, chatMsg.CreatedAt, chatMsg.Message = stored.ID, stored.CreatedAt, stored.Message
+		chatMsg.Mentions = stored.Mentions
+		r.ackSender(chatMsg)
+		return true
+	}
+	receiverName, ok := r.privatePeer(chatMsg.Name)
+	if !ok {
+		return false
+	}
+	stored, err := db.GetChatMessageByClientID(chatMsg.SenderID, r.getUserIDByUsername(receiverName), chatMsg.ClientMsgID)
+	if err != nil {
+		return false
+	}
+	chatMsg.ID, chatMsg.CreatedAt, chatMsg.Message = stored.ID, stored.CreatedAt, stored.Message
+	chatMsg.Mentions = stored.Mentions
+	r.ackSender(chatMsg)
+	return true
+}
+
+// blockedPeer reports whether the sender and the other participant of a
+// private room have blocked each other
+func (r *room) blockedPeer(chatMsg ChatMessageData) bool {
+	peer, ok := r.privatePeer(chatMsg.Name)
+	if !ok || chatMsg.SenderID <= 0 {
+		return false
+	}
+	blocked, err := db.IsBlockedBetween(chatMsg.SenderID, r.getUserIDByUsername(peer))
+	return err != nil || blocked
+}
+
+// applyRevision persists an edit or delete of the sender's own message and
+// fills chatMsg with the stored result. It reports false when the change is
+// not allowed, in which case nothing is broadcast. members are those of a
+// group room, who may be mentioned by an edit.
+func (r *room) applyRevision(chatMsg *ChatMessageData, members map[int]string) bool {
+	if chatMsg.ID <= 0 || chatMsg.SenderID <= 0 {
+		return false
+	}
+	// Edits arrive trimmed and screened by handleFrame
+	if chatMsg.Type == "edit" && chatMsg.Message == "" {
+		return false
+	}
+
+	if r.groupID > 0 {
+		var saved db.ChatRoomMessage
+		var err error
+		if chatMsg.Type == "edit" {
+			saved, err = db.EditChatRoomMessage(r.groupID, chatMsg.ID, chatMsg.SenderID, chatMsg.Message)
+		} else {
+			saved, err = db.DeleteChatRoomMessage(r.groupID, chatMsg.ID, chatMsg.SenderID)
+		}
+		if err != nil {
+			log.Printf("Rejected %s of message %d by %s: %v", chatMsg.Type, chatMsg.ID, chatMsg.Name, err)
+			return false
+		}
+		chatMsg.Message, chatMsg.CreatedAt = saved.Message, saved.CreatedAt
+		chatMsg.EditedAt, chatMsg.DeletedAt = saved.EditedAt, saved.DeletedAt
+		chatMsg.RoomID = r.groupID
+		r.reviseMentions(chatMsg, members)
+		return true
+	}
+
+	receiverName, ok := r.privatePeer(chatMsg.Name)
+	if !ok {
+		return false
+	}
+	receiverID := r.getUserIDByUsername(receiverName)
+	if blocked, err := db.IsBlockedBetween(chatMsg.SenderID, receiverID); err != nil || blocked {
+		r.sendTo(chatMsg.Name, r.refusal(*chatMsg, "You cannot message this user"))
+		return false
+	}
+
+	var saved db.ChatMessage
+	var err error
+	if chatMsg.Type == "edit" {
+		saved, err = db.EditChatMessage(chatMsg.ID, chatMsg.SenderID, receiverID, chatMsg.Message)
+	} else {
+		saved, err = db.DeleteChatMessage(chatMsg.ID, chatMsg.SenderID, receiverID)
+	}
+	if err != nil {
+		log.Printf("Rejected %s of message %d by %s: %v", chatMsg.Type, chatMsg.ID, chatMsg.Name, err)
+		return false
+	}
+	chatMsg.Message, chatMsg.CreatedAt = saved.Message, saved.CreatedAt
+	chatMsg.EditedAt, chatMsg.DeletedAt = saved.EditedAt, saved.DeletedAt
+	r.reviseMentions(chatMsg, map[int]string{receiverID: receiverName})
+	if chatMsg.Type == "delete" {
+		// A deleted message no longer counts as unread
+		r.hub.pushUnreadUpdate(receiverID)
+	}
+
+	// Let the receiver update a conversation they are not currently viewing
+	if payload, err := json.Marshal(chatMsg); err == nil {
+		r.hub.pushEvent(receiverName, db.Conversation{Kind: db.ConversationUser, ID: chatMsg.SenderID}, payload)
+	}
+	return true
+}
+
+// applyReceipt records that the reader received ("ack") or saw ("read") the
+// peer's messages up to chatMsg.ID. It returns the receipt frame for the room,
+// or nil when nothing changed.
+func (r *room) applyReceipt(chatMsg ChatMessageData) []byte {
+	if r.groupID > 0 || chatMsg.ID <= 0 || chatMsg.SenderID <= 0 {
+		return nil
+	}
+	senderName, ok := r.privatePeer(chatMsg.Name)
+	if !ok {
+		return nil
+	}
+	senderID := r.getUserIDByUsername(senderName)
+	if senderID <= 0 {
+		return nil
+	}
+
+	var receipt db.Receipt
+	var err error
+	if chatMsg.Type == "ack" {
+		receipt, err = db.MarkMessagesDelivered(senderID, chatMsg.SenderID, chatMsg.ID)
+	} else {
+		receipt, err = db.MarkMessagesReadUpTo(senderID, chatMsg.SenderID, chatMsg.ID)
+	}
+	if err != nil {
+		log.Printf("Error recording %s receipt in room %s: %v", chatMsg.Type, r.name, err)
+		return nil
+	}
+	if receipt.Status == "read" && len(receipt.IDs) > 0 {
+		r.hub.pushUnreadUpdate(chatMsg.SenderID)
+	}
+	return r.hub.notifyReceipt(senderName, chatMsg.Name, receipt)
+}
+
+// notifyAbsentMembers pushes a group message to members who are not connected to the room
+func (r *room) notifyAbsentMembers(members map[int]string, chatMsg ChatMessageData) {
+	present := make(map[int]bool)
+	for usr := range r.users {
+		present[usr.userID] = true
+	}
+
+	notification := chatMsg
+	notification.Type = "group_message"
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return
+	}
+	for memberID, username := range members {
+		if memberID == chatMsg.SenderID || present[memberID] {
+			continue
 		}
+		r.hub.pushEvent(username, db.Conversation{Kind: db.ConversationRoom, ID: r.groupID}, payload)
 	}
 }
 
@@ -207,11 +580,6 @@ func (r *room) getUserIDByUsername(username string) int {
 	return userID
 }
 
-// broadcastUsers sends the current online users in the room
-func (r *room) broadcastUsers() {
-	// No longer broadcasting - users stay online based on session
-}
-
 // Constants for WebSocket buffer sizes
 const (
 	socketBuffersize  = 1024
@@ -244,60 +612,55 @@ func (h *Hub) ServeWs(w http.ResponseWriter, req *http.Request) {
 		http.Redirect(w, req, "/unauthorized", http.StatusSeeOther)
 		return
 	}
+	// The socket identity always comes from the session, never from the query
+	currentUserID, currentUser, ok := sessionUser(req)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	roomName := req.URL.Query().Get("room")
 	user1 := req.URL.Query().Get("user1")
 	user2 := req.URL.Query().Get("user2")
-	currentUser := req.URL.Query().Get("username")
-
-	if currentUser == "" {
-		currentUser = "Anonymous"
-	}
 
 	log.Printf("WebSocket connection request - Room: %s, User1: %s, User2: %s, Current: %s",
 		roomName, user1, user2, currentUser)
 
-	// Get current user ID for database operations
-	var currentUserID int
-	if sessionCookie, err := req.Cookie("session_token"); err == nil {
-		if userID, hasSession, err := db.SelectUserSession(sessionCookie.Value); err == nil && hasSession {
-			currentUserID = userID
-			log.Printf("Current user ID from session: %d", currentUserID)
+	// Persistent group conversations are joined by id and require membership
+	if groupParam := req.URL.Query().Get("group"); groupParam != "" {
+		groupID, err := strconv.Atoi(groupParam)
+		if err != nil || groupID <= 0 {
+			http.Error(w, "Invalid group", http.StatusBadRequest)
+			return
 		}
+		isMember, err := db.IsChatRoomMember(groupID, currentUserID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !isMember {
+			http.Error(w, "You are not a member of this conversation", http.StatusForbidden)
+			return
+		}
+		roomName = GroupRoomName(groupID)
+	} else if strings.HasPrefix(roomName, "group_") {
+		http.Error(w, "Group conversations are joined with ?group=", http.StatusForbidden)
+		return
 	}
 
 	// Case 1: Public room
 	if roomName != "" {
+		// Private rooms can only be reached through the user1/user2 membership check below
+		if strings.HasPrefix(roomName, "private_") {
+			http.Error(w, "You can only join your own private chats", http.StatusForbidden)
+			return
+		}
 		socket, err := upgrader.Upgrade(w, req, nil)
 		if err != nil {
 			log.Println("Upgrade error:", err)
 			return
 		}
-
-		r := h.GetRoom(roomName)
-		user := &user{
-			name:    currentUser,
-			socket:  socket,
-			recieve: make(chan []byte, messageBuffersize),
-			room:    r,
-			userID:  currentUserID,
-		}
-		r.join <- user
-
-		// Add to global users but don't manage online status via WebSocket
-		h.globalUsers[user.name] = user
-		if currentUser != "" {
-			auth.AddUserConnection(currentUser)
-		}
-
-		defer func() {
-			r.leave <- user
-			delete(h.globalUsers, user.name)
-			if currentUser != "" {
-				auth.RemoveUserConnection(currentUser)
-			}
-		}()
-		go user.write()
-		user.read()
+		h.serveRoom(socket, roomName, currentUserID, currentUser)
 		return
 	}
 
@@ -312,6 +675,22 @@ func (h *Hub) ServeWs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	peer := user1
+	if peer == currentUser {
+		peer = user2
+	}
+	if peerID, err := db.GetUserIDByUsername(peer); err == nil {
+		blocked, err := db.IsBlockedBetween(currentUserID, peerID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			http.Error(w, "You cannot chat with this user", http.StatusForbidden)
+			return
+		}
+	}
+
 	roomName = CreatePrivateRoomName(user1, user2)
 	log.Printf("Creating/joining private room: %s", roomName)
 
@@ -321,49 +700,52 @@ func (h *Hub) ServeWs(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	r := h.GetRoom(roomName)
-	user := &user{
-		name:    currentUser,
-		socket:  socket,
-		recieve: make(chan []byte, messageBuffersize),
-		room:    r,
-		userID:  currentUserID,
-	}
+	h.serveRoom(socket, roomName, currentUserID, currentUser)
+}
 
-	log.Printf("DEBUG: Created user struct: name=%s, userID=%d, room=%s", user.name, user.userID, r.name)
+// serveRoom attaches an upgraded socket to a room until the connection ends
+func (h *Hub) serveRoom(socket *websocket.Conn, roomName string, userID int, username string) {
+	r := h.acquireRoom(roomName)
+	user := h.newUser(socket, username, userID, r)
 
 	r.join <- user
-	log.Printf("DEBUG: User sent to join channel")
-
-	// Add to global hub but track online status through connection counts
-	h.globalUsers[user.name] = user
-	if currentUser != "" {
-		auth.AddUserConnection(currentUser)
-	}
-	log.Printf("DEBUG: User added to global users")
+	h.register <- user
+	// Online status is tracked through connection counts
+	auth.AddUserConnection(username)
 
 	defer func() {
-		log.Printf("DEBUG: Defer cleanup starting for user %s", user.name)
 		r.leave <- user
-		delete(h.globalUsers, user.name)
-		if currentUser != "" {
-			auth.RemoveUserConnection(currentUser)
-		}
-		log.Printf("DEBUG: Defer cleanup complete for user %s", user.name)
+		h.unregister <- user
+		h.releaseRoom(r)
+		auth.RemoveUserConnection(username)
 	}()
 
-	log.Printf("DEBUG: Starting write() goroutine for user %s", user.name)
 	go user.write()
-	log.Printf("DEBUG: Starting read() for user %s", user.name)
 	user.read()
-	log.Printf("DEBUG: read() exited for user %s", user.name)
+}
+
+// sessionUser resolves the authenticated user behind the session_token cookie
+func sessionUser(req *http.Request) (int, string, bool) {
+	sessionCookie, err := req.Cookie("session_token")
+	if err != nil || sessionCookie.Value == "" {
+		return 0, "", false
+	}
+	userID, hasSession, err := db.SelectUserSession(sessionCookie.Value)
+	if err != nil || !hasSession {
+		return 0, "", false
+	}
+	username, err := db.GetUserNameById(userID)
+	if err != nil {
+		return 0, "", false
+	}
+	return userID, username, true
 }
 
 // ServeNotifications handles WebSocket connections for global notifications
 func (h *Hub) ServeNotifications(w http.ResponseWriter, req *http.Request) {
-	username := req.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "Username required", http.StatusBadRequest)
+	userID, username, ok := sessionUser(req)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
@@ -372,25 +754,24 @@ func (h *Hub) ServeNotifications(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	user := &user{
-		name:    username,
-		socket:  socket,
-		recieve: make(chan []byte, messageBuffersize),
-	}
+	user := h.newUser(socket, username, userID, nil)
 
-	h.notificationUsers[username] = user
-	if username != "" {
-		auth.AddUserConnection(username)
-	}
+	// Register before replaying so nothing pushed during the replay is lost
+	h.register <- user
+	auth.AddUserConnection(username)
 
 	defer func() {
-		delete(h.notificationUsers, username)
-		if username != "" {
-			auth.RemoveUserConnection(username)
-		}
+		h.unregister <- user
+		auth.RemoveUserConnection(username)
 		socket.Close()
 	}()
 
+	lastSeen, lastEvent, resume := catchUpPositions(req)
+	if err := user.replay(lastSeen, lastEvent, resume); err != nil {
+		log.Printf("Catch-up for %s failed: %v", username, err)
+		return
+	}
+
 	go user.write()
 	user.read()
 }
@@ -0,0 +1,287 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	auth "forum/internal/auth"
+	db "forum/internal/db"
+	repo "forum/internal/repository"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame types the server sends on the multiplexed socket, besides welcome
+// and error
+const (
+	envelopeChat         = "chat"         // a frame of a subscribed conversation
+	envelopeNotification = "notification" // what /notifications carries
+	envelopePresence     = "presence"     // users coming online or going offline
+	envelopeSubscribed   = "subscribed"
+	envelopeUnsubscribed = "unsubscribed"
+)
+
+// socketSession is the state of one multiplexed socket. Only the socket's
+// read goroutine touches it, and after that the cleanup in ServeSocket.
+type socketSession struct {
+	hub     *Hub
+	conn    *user // registered for notifications; writes every frame
+	version int   // agreed in the handshake, before the socket is registered
+	subs    map[db.Conversation]*subscription
+}
+
+// subscription is a conversation room joined on behalf of a socket
+type subscription struct {
+	conv   db.Conversation
+	room   *room
+	member *user         // the socket's seat in the room
+	done   chan struct{} // closed once the room's last frame is queued on the socket
+}
+
+// ServeSocket serves the multiplexed socket: one per tab, carrying
+// notifications, presence and every conversation the client subscribes to
+func (h *Hub) ServeSocket(w http.ResponseWriter, req *http.Request) {
+	userID, username, ok := sessionUser(req)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	socket, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return
+	}
+
+	conn := h.newUser(socket, username, userID, nil)
+	conn.envelope = envelopeNotification
+	s := &socketSession{hub: h, conn: conn, subs: make(map[db.Conversation]*subscription)}
+	conn.session = s
+
+	hello, ok := s.handshake()
+	if !ok {
+		socket.Close()
+		return
+	}
+
+	// Register before replaying so nothing pushed during the replay is lost
+	h.register <- conn
+	auth.AddUserConnection(username)
+
+	defer func() {
+		for _, sub := range s.subs {
+			s.unsubscribe(sub)
+		}
+		h.unregister <- conn
+		auth.RemoveUserConnection(username)
+		socket.Close()
+	}()
+
+	lastSeen, lastEvent, resume := hello.positions()
+	if err := conn.replay(lastSeen, lastEvent, resume); err != nil {
+		log.Printf("Catch-up for %s failed: %v", username, err)
+		return
+	}
+
+	go conn.write()
+	conn.read()
+}
+
+// handshake reads the client's hello and answers with the version the
+// session will use. It runs before the write goroutine, so it owns the
+// socket. It reports false, after telling the client why, when no session
+// can be agreed on.
+func (s *socketSession) handshake() (*helloPayload, bool) {
+	c := s.conn
+	c.socket.SetReadLimit(c.config.MaxMessageSize)
+	c.socket.SetReadDeadline(time.Now().Add(c.config.PongTimeout))
+	_, msg, err := c.socket.ReadMessage()
+	if err != nil {
+		return nil, false
+	}
+
+	f, p, perr := decodeFrame(msg, 0)
+	if perr == nil && f.Type != "hello" {
+		perr = &protocolError{Code: codeHandshakeRequired, Message: "The first frame must be hello", FrameType: f.Type}
+	}
+	var hello *helloPayload
+	if perr == nil {
+		hello = p.(*helloPayload)
+		if s.version = hello.pick(); s.version == 0 {
+			perr = &protocolError{Code: codeUnsupportedVersion, Message: "No protocol version in common",
+				FrameType: f.Type, Versions: protocolVersions}
+		}
+	}
+	if perr != nil {
+		// Answer in the oldest version, which every client understands
+		s.version = protocolVersions[0]
+		c.writeFrame(s.encode("error", f.ID, perr))
+		c.socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, perr.Code),
+			time.Now().Add(c.config.WriteTimeout))
+		return nil, false
+	}
+	if err := c.writeFrame(s.encode("welcome", f.ID, welcomePayload{Version: s.version, Versions: protocolVersions})); err != nil {
+		return nil, false
+	}
+	return hello, true
+}
+
+// encode builds a frame of the session's version
+func (s *socketSession) encode(frameType, id string, body any) []byte {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil
+	}
+	encoded, err := json.Marshal(frame{V: s.version, Type: frameType, ID: id, Payload: payload})
+	if err != nil {
+		return nil
+	}
+	return encoded
+}
+
+// handle processes a client frame. Frames that fail to decode or validate are
+// refused and go no further. It reports true when the socket must close.
+func (s *socketSession) handle(msg []byte) bool {
+	f, p, perr := decodeFrame(msg, s.version)
+	if perr != nil {
+		s.reply("error", f.ID, perr)
+		return false
+	}
+
+	switch f.Type {
+	case "hello":
+		s.reply("error", f.ID, &protocolError{Code: codeUnexpectedFrame, Message: "The session is already open", FrameType: f.Type})
+	case "subscribe":
+		s.subscribe(f.ID, p.(*conversationPayload).Conversation)
+	case "unsubscribe":
+		conv := p.(*conversationPayload).Conversation
+		if sub, ok := s.subs[conv]; ok {
+			s.unsubscribe(sub)
+		}
+		s.reply(envelopeUnsubscribed, f.ID, conversationPayload{Conversation: conv})
+	default:
+		body := p.(roomPayload)
+		sub, ok := s.subs[body.target()]
+		if !ok {
+			s.reply("error", f.ID, &protocolError{Code: codeNotSubscribed, Message: "Not subscribed to this conversation", FrameType: f.Type})
+			return false
+		}
+		return sub.member.forward(body.roomFrame(f.Type, f.ID))
+	}
+	return false
+}
+
+// subscribe joins the room of a conversation the user belongs to
+func (s *socketSession) subscribe(id string, conv db.Conversation) {
+	if _, ok := s.subs[conv]; ok {
+		s.reply(envelopeSubscribed, id, conversationPayload{Conversation: conv})
+		return
+	}
+	if len(s.subs) >= repo.WS_MAX_SUBSCRIPTIONS {
+		s.reply("error", id, &protocolError{Code: codeForbidden, Message: "Too many open conversations", FrameType: "subscribe"})
+		return
+	}
+	roomName, err := conversationRoom(s.conn.userID, s.conn.name, conv)
+	if err != nil {
+		s.reply("error", id, &protocolError{Code: codeForbidden, Message: err.Error(), FrameType: "subscribe"})
+		return
+	}
+
+	r := s.hub.acquireRoom(roomName)
+	member := s.hub.newUser(s.conn.socket, s.conn.name, s.conn.userID, r)
+	member.strikes = s.conn.strikes
+	member.session = s // refusals go out as protocol errors
+	sub := &subscription{conv: conv, room: r, member: member, done: make(chan struct{})}
+	s.subs[conv] = sub
+
+	// Confirm first so the client hears of the subscription before its frames
+	s.reply(envelopeSubscribed, id, conversationPayload{Conversation: conv})
+	r.join <- member
+	go sub.pump(s)
+}
+
+// unsubscribe leaves the room once everything it sent is queued on the socket
+func (s *socketSession) unsubscribe(sub *subscription) {
+	sub.room.leave <- sub.member
+	<-sub.done
+	s.hub.releaseRoom(sub.room)
+	delete(s.subs, sub.conv)
+}
+
+// reply queues a frame answering the client frame with this id
+func (s *socketSession) reply(frameType, id string, body any) {
+	select {
+	case s.conn.recieve <- s.encode(frameType, id, body):
+	default:
+		log.Printf("Socket channel of %s full, %s reply dropped", s.conn.name, frameType)
+	}
+}
+
+// pump wraps the room's frames for the socket until the room lets the seat go
+func (sub *subscription) pump(s *socketSession) {
+	defer close(sub.done)
+	for msg := range sub.member.recieve {
+		if presenceFrame(msg) {
+			continue
+		}
+		select {
+		case s.conn.recieve <- s.encode(envelopeChat, "", eventPayload{Conversation: &sub.conv, Event: msg}):
+		default:
+			log.Printf("Socket channel of %s full, %s frame dropped", s.conn.name, sub.room.name)
+		}
+	}
+}
+
+// presenceFrame reports whether a room frame is a presence broadcast, which
+// the multiplexed socket already gets once outside its rooms
+func presenceFrame(payload []byte) bool {
+	var frame struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(payload, &frame) != nil {
+		return false
+	}
+	switch frame.Type {
+	case "user_joined", "user_left", "users_update":
+		return true
+	}
+	return false
+}
+
+// conversationRoom resolves the room of a conversation, applying the same
+// membership and block checks as ServeWs. Errors are meant for the client.
+func conversationRoom(userID int, username string, conv db.Conversation) (string, error) {
+	switch conv.Kind {
+	case db.ConversationUser:
+		if conv.ID == userID {
+			return "", errors.New("You cannot chat with yourself")
+		}
+		peer, err := db.GetUserNameById(conv.ID)
+		if err != nil {
+			return "", errors.New("User not found")
+		}
+		blocked, err := db.IsBlockedBetween(userID, conv.ID)
+		if err != nil {
+			log.Printf("Error checking blocks between %d and %d: %v", userID, conv.ID, err)
+			return "", errors.New("Internal server error")
+		}
+		if blocked {
+			return "", errors.New("You cannot chat with this user")
+		}
+		return CreatePrivateRoomName(username, peer), nil
+	case db.ConversationRoom:
+		isMember, err := db.IsChatRoomMember(conv.ID, userID)
+		if err != nil {
+			log.Printf("Error checking membership of room %d: %v", conv.ID, err)
+			return "", errors.New("Internal server error")
+		}
+		if !isMember {
+			return "", errors.New("You are not a member of this conversation")
+		}
+		return GroupRoomName(conv.ID), nil
+	}
+	return "", errors.New("Unknown conversation kind")
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"encoding/json"
+	"forum/internal/ratelimiter"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketLimits hands out the token buckets of each user. Buckets are shared
+// by all of a user's sockets, so opening more connections buys no extra
+// rate, and they live as long as the hub: there is at most one per account.
+type socketLimits struct {
+	mu    sync.Mutex
+	users map[int]*userLimits
+}
+
+// userLimits are the buckets a user's frames draw from
+type userLimits struct {
+	messages *ratelimiter.TokenBucketLimiter
+	typing   *ratelimiter.TokenBucketLimiter
+}
+
+func newSocketLimits() *socketLimits {
+	return &socketLimits{users: make(map[int]*userLimits)}
+}
+
+// forUser returns the buckets of a user, creating them from cfg on first use
+func (s *socketLimits) forUser(userID int, cfg SocketConfig) *userLimits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.users[userID]
+	if !ok {
+		l = &userLimits{
+			messages: ratelimiter.NewWholeTokenBucketLimiter(cfg.MessageRate, cfg.MessageBurst),
+			typing:   ratelimiter.NewWholeTokenBucketLimiter(cfg.TypingRate, cfg.TypingBurst),
+		}
+		s.users[userID] = l
+	}
+	return l
+}
+
+// allow takes a token for a frame; frames other than messages and typing
+// indicators are not limited
+func (l *userLimits) allow(frameType string) bool {
+	switch frameType {
+	case "message", "edit", "delete":
+		return l.messages.Allow()
+	case "typing", "stop_typing":
+		return l.typing.Allow()
+	}
+	return true
+}
+
+// frameError tells a client a frame was dropped, for going over its limit
+// or failing validation
+type frameError struct {
+	Type        string `json:"type"`
+	Code        string `json:"code"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	FrameType   string `json:"frame_type,omitempty"`
+	Message     string `json:"message"`
+}
+
+// rateLimited tells the client its frame was dropped and counts a strike. It
+// reports true, after closing the connection with a policy violation, once
+// the client went over its limits MaxStrikes times within StrikeWindow.
+func (c *user) rateLimited(chatMsg ChatMessageData) bool {
+	now := time.Now()
+	if now.Sub(c.strikes.from) > c.config.StrikeWindow {
+		c.strikes.n, c.strikes.from = 0, now
+	}
+	c.strikes.n++
+	if c.strikes.n >= c.config.MaxStrikes {
+		log.Printf("Closing socket of %s: rate limit exceeded %d times", c.name, c.strikes.n)
+		c.socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+			now.Add(c.config.WriteTimeout))
+		// Closing with the flood still unread would reset the connection and
+		// lose the close frame; discard until the client answers it
+		c.socket.SetReadDeadline(now.Add(c.config.WriteTimeout))
+		for {
+			if _, _, err := c.socket.ReadMessage(); err != nil {
+				break
+			}
+		}
+		return true
+	}
+
+	c.refuseFrame(chatMsg, codeRateLimited, "You are sending too fast, slow down")
+	return false
+}
+
+// refuseFrame tells the client a frame was dropped and why
+func (c *user) refuseFrame(chatMsg ChatMessageData, code, reason string) {
+	if c.session != nil {
+		c.session.reply("error", chatMsg.ClientMsgID, &protocolError{Code: code, Message: reason, FrameType: chatMsg.Type})
+		return
+	}
+	payload, err := json.Marshal(frameError{
+		Type:        "error",
+		Code:        code,
+		ClientMsgID: chatMsg.ClientMsgID,
+		FrameType:   chatMsg.Type,
+		Message:     reason,
+	})
+	if err != nil {
+		return
+	}
+	select {
+	case c.recieve <- payload:
+	default:
+		// A client flooding faster than it reads loses these notices first
+	}
+}
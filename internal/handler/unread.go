@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"encoding/json"
+	db "forum/internal/db"
+	"log"
+)
+
+// unreadUpdateEvent carries a user's unread private message counts, in full,
+// whenever they change. It is not recorded for catch-up: every connection
+// gets the current counts after its replay instead.
+type unreadUpdateEvent struct {
+	Type          string                  `json:"type"`
+	Total         int                     `json:"total"`
+	Conversations []db.ConversationUnread `json:"conversations"`
+}
+
+// unreadUpdate builds the unread_update frame of a user
+func unreadUpdate(userID int) ([]byte, error) {
+	conversations, total, err := db.GetUnreadCounts(userID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(unreadUpdateEvent{Type: "unread_update", Total: total, Conversations: conversations})
+}
+
+// pushUnreadUpdate sends a user's current unread counts to their
+// notification sockets, after a message to them was saved or read
+func (h *Hub) pushUnreadUpdate(userID int) {
+	username, err := db.GetUserNameById(userID)
+	if err != nil {
+		return
+	}
+	payload, err := unreadUpdate(userID)
+	if err != nil {
+		log.Printf("Error counting unread messages of %s: %v", username, err)
+		return
+	}
+	h.notifyUser(username, payload)
+}
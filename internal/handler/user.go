@@ -2,9 +2,11 @@ package handler
 
 import (
 	db "forum/internal/db"
+	repo "forum/internal/repository"
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
 	"github.com/gorilla/websocket"
 )
 
@@ -14,8 +16,113 @@ type user struct {
 	recieve chan []byte
 	room    *room
 	userID  int
+	config  SocketConfig
+	limits  *userLimits
+	strikes *strikeCount // shared by a multiplexed socket and its subscriptions
+
+	// Multiplexed sockets and their subscriptions only: the frame type the
+	// hub wraps queued frames in, and the protocol session
+	envelope string
+	session  *socketSession
+
+	stream *eventStream // Server-Sent Events connections, which have no socket
+}
+
+// strikeCount tracks over-limit frames of one socket; only its read goroutine touches it
+type strikeCount struct {
+	n    int
+	from time.Time
+}
+
+// SocketConfig controls keepalive and limits of every WebSocket connection
+type SocketConfig struct {
+	PingInterval   time.Duration // how often the server pings an idle client
+	PongTimeout    time.Duration // silence after which a client is considered dead
+	WriteTimeout   time.Duration // maximum time a single write may block
+	MaxMessageSize int64         // largest frame accepted from a client
+
+	// Per-user rate limits shared by all of a user's sockets
+	MessageRate  float64       // chat messages, edits and deletes per second
+	MessageBurst uint64        // messages accepted at once after a quiet period
+	TypingRate   float64       // typing indicators per second
+	TypingBurst  uint64        // typing indicators accepted at once
+	MaxStrikes   int           // over-limit frames after which a socket is closed
+	StrikeWindow time.Duration // period over which strikes are counted
+}
+
+// DefaultSocketConfig returns the keepalive and rate limit settings from the repository config
+func DefaultSocketConfig() SocketConfig {
+	return SocketConfig{
+		PingInterval:   repo.WS_PING_INTERVAL_SECONDS * time.Second,
+		PongTimeout:    repo.WS_PONG_TIMEOUT_SECONDS * time.Second,
+		WriteTimeout:   repo.WS_WRITE_TIMEOUT_SECONDS * time.Second,
+		MaxMessageSize: repo.WS_MAX_MESSAGE_SIZE,
+		MessageRate:    repo.WS_MESSAGE_RATE,
+		MessageBurst:   repo.WS_MESSAGE_BURST,
+		TypingRate:     repo.WS_TYPING_RATE,
+		TypingBurst:    repo.WS_TYPING_BURST,
+		MaxStrikes:     repo.WS_RATE_LIMIT_STRIKES,
+		StrikeWindow:   repo.WS_RATE_LIMIT_WINDOW_SECONDS * time.Second,
+	}
+}
+
+// normalized fills unset fields and keeps pings inside the pong timeout
+func (cfg SocketConfig) normalized() SocketConfig {
+	defaults := DefaultSocketConfig()
+	if cfg.PongTimeout <= 0 {
+		cfg.PongTimeout = defaults.PongTimeout
+	}
+	if cfg.PingInterval <= 0 || cfg.PingInterval >= cfg.PongTimeout {
+		cfg.PingInterval = cfg.PongTimeout * 9 / 10
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = defaults.WriteTimeout
+	}
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = defaults.MaxMessageSize
+	}
+	if cfg.MessageRate <= 0 || cfg.MessageBurst == 0 {
+		cfg.MessageRate, cfg.MessageBurst = defaults.MessageRate, defaults.MessageBurst
+	}
+	if cfg.TypingRate <= 0 || cfg.TypingBurst == 0 {
+		cfg.TypingRate, cfg.TypingBurst = defaults.TypingRate, defaults.TypingBurst
+	}
+	if cfg.MaxStrikes <= 0 {
+		cfg.MaxStrikes = defaults.MaxStrikes
+	}
+	if cfg.StrikeWindow <= 0 {
+		cfg.StrikeWindow = defaults.StrikeWindow
+	}
+	return cfg
+}
+
+// newUser wraps an upgraded socket with the hub's socket settings
+func (h *Hub) newUser(socket *websocket.Conn, name string, userID int, r *room) *user {
+	cfg := h.Socket.normalized()
+	return &user{
+		name:    name,
+		socket:  socket,
+		recieve: make(chan []byte, messageBuffersize),
+		room:    r,
+		userID:  userID,
+		config:  cfg,
+		limits:  h.limits.forUser(userID, cfg),
+		strikes: &strikeCount{},
+	}
 }
 
+// wrap puts a frame queued by the hub in a frame of the socket's protocol,
+// if it speaks one
+func (c *user) wrap(payload []byte) []byte {
+	if c.session == nil {
+		return payload
+	}
+	return c.session.encode(c.envelope, "", eventPayload{Event: payload})
+}
+
+// read pumps frames from the client into its room. It returns when the client
+// goes away or stays silent (no frame and no pong) for longer than PongTimeout,
+// which is what lets the caller clean up half-open connections.
 func (c *user) read() {
 	log.Printf("DEBUG read(): Starting for user %s", c.name)
 	defer func() {
@@ -23,10 +130,6 @@ func (c *user) read() {
 		if r := recover(); r != nil {
 			log.Printf("PANIC in read() for user %s: %v", c.name, r)
 		}
-		if c.room != nil {
-			log.Printf("DEBUG read(): Sending leave for user %s", c.name)
-			c.room.leave <- c
-		}
 		if c.socket != nil {
 			log.Printf("DEBUG read(): Closing socket for user %s", c.name)
 			c.socket.Close()
@@ -34,6 +137,12 @@ func (c *user) read() {
 		log.Printf("DEBUG read(): Defer cleanup complete for user %s", c.name)
 	}()
 
+	c.socket.SetReadLimit(c.config.MaxMessageSize)
+	c.socket.SetReadDeadline(time.Now().Add(c.config.PongTimeout))
+	c.socket.SetPongHandler(func(string) error {
+		return c.socket.SetReadDeadline(time.Now().Add(c.config.PongTimeout))
+	})
+
 	for {
 		log.Printf("DEBUG read(): Waiting for message for user %s", c.name)
 		_, msg, err := c.socket.ReadMessage()
@@ -46,41 +155,70 @@ func (c *user) read() {
 			}
 			return
 		}
+		c.socket.SetReadDeadline(time.Now().Add(c.config.PongTimeout))
 
 		log.Printf(" Received message from %s: %s", c.name, string(msg))
 
-		if c.room != nil {
-			// Add sender ID to message before forwarding
-			var msgData map[string]interface{}
-			if err := json.Unmarshal(msg, &msgData); err == nil {
-				msgData["sender_id"] = c.userID
-				msgData["created_at"] = "" // Will be set by database
-				if modifiedMsg, err := json.Marshal(msgData); err == nil {
-					select {
-					case c.room.forward <- modifiedMsg:
-						log.Printf(" Message forwarded to room with sender_id %d", c.userID)
-					default:
-						log.Printf(" Room channel full, message dropped")
-					}
-				} else {
-					log.Printf(" Error marshaling modified message: %v", err)
-				}
-			} else {
-				// Fallback: forward original message
-				select {
-				case c.room.forward <- msg:
-					log.Printf(" Message forwarded to room (fallback)")
-				default:
-					log.Printf(" Room channel full, message dropped")
-				}
+		if c.session != nil {
+			if c.session.handle(msg) {
+				return
 			}
+			continue
+		}
+		if c.room == nil {
+			continue
+		}
+		var chatMsg ChatMessageData
+		if err := json.Unmarshal(msg, &chatMsg); err != nil {
+			c.refuseFrame(chatMsg, codeMalformed, "Frame is not valid JSON")
+			continue
+		}
+		if c.forward(chatMsg) {
+			return
 		}
 	}
 }
 
+// forward validates a client frame, stamps it with the sender identity, so
+// clients cannot spoof it, and hands it to the room. Invalid frames are
+// refused and go no further. It reports true when the socket was closed for
+// going over its rate limits.
+func (c *user) forward(chatMsg ChatMessageData) bool {
+	check, ok := roomFrameChecks[chatMsg.Type]
+	if !ok {
+		c.refuseFrame(chatMsg, codeUnknownType, "Unknown frame type")
+		return false
+	}
+	if err := check(&chatMsg); err != nil {
+		c.refuseFrame(chatMsg, codeInvalidPayload, err.Error())
+		return false
+	}
+	if !c.limits.allow(chatMsg.Type) {
+		return c.rateLimited(chatMsg)
+	}
+	chatMsg.Name = c.name
+	chatMsg.SenderID = c.userID
+	chatMsg.CreatedAt = "" // Will be set by database
+	chatMsg.Mentions = nil // Found by the room in what is stored
+	msg, err := json.Marshal(chatMsg)
+	if err != nil {
+		log.Printf(" Error marshaling frame from %s: %v", c.name, err)
+		return false
+	}
+	// Blocking send: the room outlives every connection holding it,
+	// and a slow room throttles this client instead of losing messages
+	c.room.forward <- msg
+	log.Printf(" Message forwarded to room with sender_id %d", c.userID)
+	return false
+}
+
+// write sends queued messages and keepalive pings. Every write is bounded by
+// WriteTimeout; a failed write closes the socket, which in turn ends read.
 func (c *user) write() {
 	log.Printf("DEBUG write(): Starting for user %s", c.name)
+	ticker := time.NewTicker(c.config.PingInterval)
 	defer func() {
+		ticker.Stop()
 		log.Printf("DEBUG write(): Defer cleanup for user %s", c.name)
 		if r := recover(); r != nil {
 			log.Printf("PANIC in write() for user %s: %v", c.name, r)
@@ -92,23 +230,39 @@ func (c *user) write() {
 		log.Printf("DEBUG write(): Defer cleanup complete for user %s", c.name)
 	}()
 
-	for msg := range c.recieve {
-		log.Printf("DEBUG write(): Got message for user %s, message size: %d", c.name, len(msg))
-		if c.socket == nil {
-			log.Printf("Socket is nil for user %s", c.name)
-			return
-		}
+	if c.socket == nil {
+		log.Printf("Socket is nil for user %s", c.name)
+		return
+	}
+	for {
+		select {
+		case msg, ok := <-c.recieve:
+			c.socket.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+			if !ok {
+				log.Printf("DEBUG write(): Channel closed for user %s", c.name)
+				c.socket.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
 
-		log.Printf("DEBUG write(): Writing message for user %s", c.name)
-		err := c.socket.WriteMessage(websocket.TextMessage, msg)
-		if err != nil {
-			log.Printf("Write error for user %s: %v", c.name, err)
-			return
-		}
+			log.Printf("DEBUG write(): Writing message for user %s", c.name)
+			if err := c.socket.WriteMessage(websocket.TextMessage, msg); err != nil {
+				if err == websocket.ErrCloseSent {
+					// read is finishing the close handshake; drop what is left
+					continue
+				}
+				log.Printf("Write error for user %s: %v", c.name, err)
+				return
+			}
+			log.Printf("Message sent to %s: %s", c.name, string(msg))
 
-		log.Printf("Message sent to %s: %s", c.name, string(msg))
+		case <-ticker.C:
+			c.socket.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+			if err := c.socket.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("Ping failed for user %s: %v", c.name, err)
+				return
+			}
+		}
 	}
-	log.Printf("DEBUG write(): Channel closed for user %s", c.name)
 }
 
 func GetLastMessagesHandler(w http.ResponseWriter, r *http.Request) {
@@ -4,6 +4,7 @@ package handler
 import (
 	auth "forum/internal/auth"
 	db "forum/internal/db"
+	repo "forum/internal/repository"
 	"encoding/json"
 	"net/http"
 )
@@ -40,11 +41,17 @@ func OnlineUsersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Build list of online users (excluding current user)
+	blocked, err := db.GetBlockedUsernames(r.Context().Value(repo.USER_ID_KEY).(int))
+	if err != nil {
+		http.Error(w, "Failed to load users", http.StatusInternalServerError)
+		return
+	}
+
+	// Build list of online users (excluding current user and blocked users)
 	onlineUsersList := auth.GetOnlineUsersList()
 	var onlineUsers []string
 	for _, username := range onlineUsersList {
-		if username != currentUsername {
+		if username != currentUsername && !blocked[username] {
 			onlineUsers = append(onlineUsers, username)
 		}
 	}
@@ -86,6 +93,17 @@ func AllUsersHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to load users", http.StatusInternalServerError)
 		return
 	}
+	blocked, err := db.GetBlockedUsernames(r.Context().Value(repo.USER_ID_KEY).(int))
+	if err != nil {
+		http.Error(w, "Failed to load users", http.StatusInternalServerError)
+		return
+	}
+	visible := users[:0]
+	for _, username := range users {
+		if !blocked[username] {
+			visible = append(visible, username)
+		}
+	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{"users": users})
+	json.NewEncoder(w).Encode(map[string]interface{}{"users": visible})
 }
@@ -0,0 +1,47 @@
+package moderation
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// LinkLimit rejects content with more than Max links from accounts younger
+// than MinAge, a common shape of spam from freshly registered accounts
+type LinkLimit struct {
+	Max    int
+	MinAge time.Duration
+	// CreatedAt looks up when an account was registered; it is only called
+	// for content over the limit
+	CreatedAt func(userID int) (time.Time, error)
+}
+
+// NewLinkLimit returns a link limit for accounts younger than minAge
+func NewLinkLimit(max int, minAge time.Duration, createdAt func(userID int) (time.Time, error)) *LinkLimit {
+	return &LinkLimit{Max: max, MinAge: minAge, CreatedAt: createdAt}
+}
+
+func (l *LinkLimit) Name() string { return "links" }
+
+func (l *LinkLimit) Check(c Content) Verdict {
+	links := len(linkPattern.FindAllStringIndex(c.Text, l.Max+1))
+	if links <= l.Max {
+		return Verdict{Action: Allow}
+	}
+	created, err := l.CreatedAt(c.UserID)
+	if err != nil {
+		// Unknown age: let it through rather than block an established user
+		log.Printf("Moderation: account age of user %d unknown: %v", c.UserID, err)
+		return Verdict{Action: Allow}
+	}
+	if time.Since(created) >= l.MinAge {
+		return Verdict{Action: Allow}
+	}
+	return Verdict{
+		Action: Reject,
+		Reason: fmt.Sprintf("new accounts may include at most %d link(s)", l.Max),
+	}
+}
@@ -0,0 +1,203 @@
+// Package moderation screens user content before it is stored. Content runs
+// through a Pipeline of Filters, each of which can allow it, mask parts of it,
+// flag it for moderators or reject it outright.
+package moderation
+
+import (
+	"strings"
+	"sync"
+)
+
+// Action is what a filter decided; later actions are stricter
+type Action int
+
+const (
+	Allow  Action = iota
+	Flag          // stored as is, recorded for moderators
+	Mask          // stored with the offending parts replaced
+	Reject        // not stored
+)
+
+func (a Action) String() string {
+	switch a {
+	case Flag:
+		return "flag"
+	case Mask:
+		return "mask"
+	case Reject:
+		return "reject"
+	}
+	return "allow"
+}
+
+// MarshalText makes actions readable in the moderation log
+func (a Action) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// Kind is the kind of content being checked
+type Kind string
+
+const (
+	KindChat    Kind = "chat"
+	KindPost    Kind = "post"
+	KindTitle   Kind = "title"
+	KindComment Kind = "comment"
+)
+
+// Content is one piece of user content to check
+type Content struct {
+	Kind   Kind
+	UserID int
+	Text   string
+}
+
+// Verdict is a single filter's decision; Text is only read for Mask
+type Verdict struct {
+	Action Action
+	Text   string
+	Reason string // shown to the author when the content is rejected
+}
+
+// Filter checks content; filters must be safe for concurrent use
+type Filter interface {
+	Name() string
+	Check(c Content) Verdict
+}
+
+// Recorder is a filter that remembers the content it allowed, such as the
+// repeat filter. Peek decides like Check without remembering; Record
+// remembers content once the whole submission it belongs to passed.
+type Recorder interface {
+	Filter
+	Peek(c Content) Verdict
+	Record(c Content)
+}
+
+// Reason records why a filter did not simply allow content
+type Reason struct {
+	Filter string `json:"filter"`
+	Action Action `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// Result is the outcome of a whole pipeline
+type Result struct {
+	Action  Action   // strictest verdict
+	Text    string   // content to store, masked where a filter asked
+	Reasons []Reason // every verdict other than Allow
+}
+
+// Rejection returns the reason content was rejected, or "" if it was not
+func (r Result) Rejection() string {
+	for _, reason := range r.Reasons {
+		if reason.Action == Reject {
+			return reason.Reason
+		}
+	}
+	return ""
+}
+
+// Pipeline runs filters in order. Each filter sees the text as masked by the
+// ones before it, and the first rejection stops the run.
+type Pipeline struct {
+	filters []Filter
+}
+
+// NewPipeline returns a pipeline of the given filters; with none it allows everything
+func NewPipeline(filters ...Filter) *Pipeline {
+	return &Pipeline{filters: filters}
+}
+
+// Check runs content through every filter
+func (p *Pipeline) Check(c Content) Result {
+	return p.CheckAll(c)[0]
+}
+
+// CheckAll runs the parts of one submission, such as a post's title and
+// body, through every filter. Recorders only remember the parts when none of
+// them was rejected, so a rejected submission costs nothing when resent.
+func (p *Pipeline) CheckAll(parts ...Content) []Result {
+	results := make([]Result, len(parts))
+	var seen []func()
+	rejected := false
+	for i, c := range parts {
+		var record []func()
+		results[i], record = p.check(c)
+		seen = append(seen, record...)
+		rejected = rejected || results[i].Action == Reject
+	}
+	if !rejected {
+		for _, record := range seen {
+			record()
+		}
+	}
+	return results
+}
+
+// check runs one part, returning what recorders should remember if the
+// submission passes
+func (p *Pipeline) check(c Content) (Result, []func()) {
+	result := Result{Action: Allow, Text: c.Text}
+	var record []func()
+	for _, f := range p.filters {
+		c.Text = result.Text
+		var v Verdict
+		if r, ok := f.(Recorder); ok {
+			v = r.Peek(c)
+			if v.Action != Reject {
+				seen := c
+				record = append(record, func() { r.Record(seen) })
+			}
+		} else {
+			v = f.Check(c)
+		}
+		if v.Action == Allow {
+			continue
+		}
+		result.Reasons = append(result.Reasons, Reason{Filter: f.Name(), Action: v.Action, Reason: v.Reason})
+		if v.Action > result.Action {
+			result.Action = v.Action
+		}
+		if v.Action == Mask {
+			result.Text = v.Text
+		}
+		if v.Action == Reject {
+			break
+		}
+	}
+	return result, record
+}
+
+var (
+	defaultMu       sync.RWMutex
+	defaultPipeline = NewPipeline()
+)
+
+// SetDefault replaces the pipeline used by Check
+func SetDefault(p *Pipeline) {
+	defaultMu.Lock()
+	defaultPipeline = p
+	defaultMu.Unlock()
+}
+
+// Check runs content through the default pipeline
+func Check(c Content) Result {
+	defaultMu.RLock()
+	p := defaultPipeline
+	defaultMu.RUnlock()
+	return p.Check(c)
+}
+
+// CheckAll runs the parts of one submission through the default pipeline
+func CheckAll(parts ...Content) []Result {
+	defaultMu.RLock()
+	p := defaultPipeline
+	defaultMu.RUnlock()
+	return p.CheckAll(parts...)
+}
+
+// normalize folds case and whitespace so trivial variations compare equal
+func normalize(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
@@ -0,0 +1,112 @@
+package moderation
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// RepeatFilter rejects content a user already sent Limit times within
+// Window. Only allowed content counts, so a rejected repeat does not extend
+// the window.
+type RepeatFilter struct {
+	Limit  int
+	Window time.Duration
+
+	mu     sync.Mutex
+	recent map[repeatKey][]repeatEntry
+	checks int
+}
+
+type repeatKey struct {
+	userID int
+	kind   Kind
+}
+
+type repeatEntry struct {
+	hash uint64
+	at   time.Time
+}
+
+// repeatSweepEvery is how many checks pass between sweeps of idle users
+const repeatSweepEvery = 1000
+
+// NewRepeatFilter returns a repeat filter allowing limit copies per window
+func NewRepeatFilter(limit int, window time.Duration) *RepeatFilter {
+	return &RepeatFilter{Limit: limit, Window: window, recent: make(map[repeatKey][]repeatEntry)}
+}
+
+func (f *RepeatFilter) Name() string { return "repeat" }
+
+func (f *RepeatFilter) Check(c Content) Verdict {
+	v := f.Peek(c)
+	if v.Action == Allow {
+		f.Record(c)
+	}
+	return v
+}
+
+// Peek rejects content already sent Limit times without remembering it
+func (f *RepeatFilter) Peek(c Content) Verdict {
+	sum := contentHash(c.Text)
+	now := time.Now()
+	key := repeatKey{userID: c.UserID, kind: c.Kind}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries := f.live(f.recent[key], now)
+	f.recent[key] = entries
+	copies := 0
+	for _, e := range entries {
+		if e.hash == sum {
+			copies++
+		}
+	}
+	if copies >= f.Limit {
+		return Verdict{Action: Reject, Reason: "repeated the same content too often, wait a moment"}
+	}
+	return Verdict{Action: Allow}
+}
+
+// Record counts content towards its author's repeats
+func (f *RepeatFilter) Record(c Content) {
+	sum := contentHash(c.Text)
+	now := time.Now()
+	key := repeatKey{userID: c.UserID, kind: c.Kind}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.checks++
+	if f.checks%repeatSweepEvery == 0 {
+		f.sweep(now)
+	}
+	f.recent[key] = append(f.live(f.recent[key], now), repeatEntry{hash: sum, at: now})
+}
+
+// contentHash identifies content up to case and whitespace
+func contentHash(text string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(normalize(text)))
+	return h.Sum64()
+}
+
+// live drops entries that fell out of the window; entries are in time order
+func (f *RepeatFilter) live(entries []repeatEntry, now time.Time) []repeatEntry {
+	cutoff := now.Add(-f.Window)
+	i := 0
+	for i < len(entries) && !entries[i].at.After(cutoff) {
+		i++
+	}
+	return entries[i:]
+}
+
+// sweep forgets users with nothing left in the window
+func (f *RepeatFilter) sweep(now time.Time) {
+	for key, entries := range f.recent {
+		if len(f.live(entries, now)) == 0 {
+			delete(f.recent, key)
+		}
+	}
+}
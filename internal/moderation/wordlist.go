@@ -0,0 +1,101 @@
+package moderation
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// WordList matches configured words and phrases, case-insensitively and on
+// word boundaries. Each entry masks, flags or rejects the content it is found in.
+type WordList struct {
+	reject *regexp.Regexp
+	mask   *regexp.Regexp
+	flag   *regexp.Regexp
+}
+
+// NewWordList builds a word list; nil or empty slices disable that action
+func NewWordList(reject, mask, flag []string) *WordList {
+	return &WordList{reject: wordsPattern(reject), mask: wordsPattern(mask), flag: wordsPattern(flag)}
+}
+
+// LoadWordList reads a word list file with one entry per line. Plain entries
+// are masked, entries starting with "!" reject the content and entries
+// starting with "?" flag it. Blank lines and lines starting with "#" are
+// ignored. On error the returned list is empty but usable.
+func LoadWordList(path string) (*WordList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return NewWordList(nil, nil, nil), err
+	}
+	defer f.Close()
+
+	var reject, mask, flag []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch line[0] {
+		case '!':
+			reject = append(reject, strings.TrimSpace(line[1:]))
+		case '?':
+			flag = append(flag, strings.TrimSpace(line[1:]))
+		default:
+			mask = append(mask, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return NewWordList(nil, nil, nil), err
+	}
+	return NewWordList(reject, mask, flag), nil
+}
+
+// wordsPattern compiles entries into one alternation, or nil if there are none
+func wordsPattern(words []string) *regexp.Regexp {
+	var quoted []string
+	for _, w := range words {
+		fields := strings.Fields(w)
+		if len(fields) == 0 {
+			continue
+		}
+		// Words of a phrase may be separated by any run of whitespace
+		for i, f := range fields {
+			fields[i] = regexp.QuoteMeta(f)
+		}
+		quoted = append(quoted, strings.Join(fields, `\s+`))
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+}
+
+func (l *WordList) Name() string { return "wordlist" }
+
+func (l *WordList) Check(c Content) Verdict {
+	if l.reject != nil && l.reject.MatchString(c.Text) {
+		return Verdict{Action: Reject, Reason: "contains a banned word"}
+	}
+	if l.mask != nil && l.mask.MatchString(c.Text) {
+		masked := l.mask.ReplaceAllStringFunc(c.Text, maskWord)
+		return Verdict{Action: Mask, Text: masked, Reason: "contains masked words"}
+	}
+	if l.flag != nil && l.flag.MatchString(c.Text) {
+		return Verdict{Action: Flag, Reason: "contains watched words"}
+	}
+	return Verdict{Action: Allow}
+}
+
+// maskWord stars out every visible character of a match
+func maskWord(word string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return r
+		}
+		return '*'
+	}, word)
+}
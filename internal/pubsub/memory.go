@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// memoryQueueSize is how many messages a slow in-process subscriber may fall behind
+const memoryQueueSize = 1024
+
+// ErrClosed is returned by backends used after Close
+var ErrClosed = errors.New("pubsub: backend closed")
+
+// Memory is an in-process backend: enough for a single server, and for
+// running several hubs in one process
+type Memory struct {
+	mu     sync.RWMutex
+	subs   []*memorySub
+	closed bool
+}
+
+type memorySub struct {
+	channels map[string]bool
+	queue    chan memoryMessage
+}
+
+type memoryMessage struct {
+	channel string
+	payload []byte
+}
+
+// NewMemory returns an empty in-process backend
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Publish queues the payload for every subscriber of the channel. It never
+// blocks: a subscriber too far behind loses the message.
+func (m *Memory) Publish(channel string, payload []byte) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+	for _, s := range m.subs {
+		if !s.channels[channel] {
+			continue
+		}
+		select {
+		case s.queue <- memoryMessage{channel: channel, payload: payload}:
+		default:
+			log.Printf("pubsub: subscriber of %s is behind, message dropped", channel)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(handler Handler, channels ...string) error {
+	s := &memorySub{channels: make(map[string]bool), queue: make(chan memoryMessage, memoryQueueSize)}
+	for _, c := range channels {
+		s.channels[c] = true
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	m.subs = append(m.subs, s)
+	m.mu.Unlock()
+
+	go func() {
+		for msg := range s.queue {
+			handler(msg.channel, msg.payload)
+		}
+	}()
+	return nil
+}
+
+// Close stops every subscription once its queued messages are handled
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	for _, s := range m.subs {
+		close(s.queue)
+	}
+	m.subs = nil
+	return nil
+}
@@ -0,0 +1,20 @@
+// Package pubsub carries hub traffic between server processes, so that
+// several instances behind a load balancer reach every connected user.
+//
+// Delivery is at most once: messages published while a node is disconnected
+// are lost. Chat clients already recover from gaps through the catch-up
+// replay of the notification socket.
+package pubsub
+
+// Handler receives a message published on a subscribed channel. Handlers of
+// one subscription are called one at a time, in publish order.
+type Handler func(channel string, payload []byte)
+
+// Backend publishes to and subscribes on named channels. Every subscriber of
+// a channel gets every message published on it, including its own.
+type Backend interface {
+	Publish(channel string, payload []byte) error
+	// Subscribe calls handler for messages on the channels until Close
+	Subscribe(handler Handler, channels ...string) error
+	Close() error
+}
@@ -0,0 +1,212 @@
+// Package pubsubtest provides an embedded Redis stand-in for tests of code
+// relaying through the Redis pub/sub backend.
+package pubsubtest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakeRedis is an embedded server speaking just enough of the Redis protocol
+// for the Redis backend: PING, PUBLISH, SUBSCRIBE, UNSUBSCRIBE and QUIT. It
+// lets several hubs exercise the Redis code path without a real server.
+type FakeRedis struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	clients map[*fakeClient]bool
+	closed  bool
+}
+
+type fakeClient struct {
+	conn     net.Conn
+	wmu      sync.Mutex // serializes replies and pushed messages
+	wr       *bufio.Writer
+	channels map[string]bool // guarded by FakeRedis.mu
+}
+
+// NewFakeRedis starts a fake server on addr; use "127.0.0.1:0" for a free port
+func NewFakeRedis(addr string) (*FakeRedis, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &FakeRedis{ln: ln, clients: make(map[*fakeClient]bool)}
+	go s.serve()
+	return s, nil
+}
+
+// Addr is the host:port the server listens on
+func (s *FakeRedis) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and drops every client
+func (s *FakeRedis) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+	return s.ln.Close()
+}
+
+func (s *FakeRedis) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeClient{conn: conn, wr: bufio.NewWriter(conn), channels: make(map[string]bool)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[c] = true
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+// handle runs the commands of one client until it disconnects
+func (s *FakeRedis) handle(c *fakeClient) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	rd := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(rd)
+		if err == errBadCommand {
+			c.send("-ERR expected a command array\r\n")
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			c.send("+PONG\r\n")
+		case "QUIT":
+			c.send("+OK\r\n")
+			return
+		case "PUBLISH":
+			if len(args) != 3 {
+				c.send("-ERR wrong number of arguments for 'publish' command\r\n")
+				continue
+			}
+			n := s.publish(args[1], []byte(args[2]))
+			c.send(":" + strconv.Itoa(n) + "\r\n")
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			subscribe := strings.ToUpper(args[0]) == "SUBSCRIBE"
+			for _, ch := range args[1:] {
+				s.mu.Lock()
+				if subscribe {
+					c.channels[ch] = true
+				} else {
+					delete(c.channels, ch)
+				}
+				count := len(c.channels)
+				s.mu.Unlock()
+				c.push(strings.ToLower(args[0]), ch, nil, count)
+			}
+		default:
+			c.send("-ERR unknown command '" + args[0] + "'\r\n")
+		}
+	}
+}
+
+// publish pushes a message to every subscriber of the channel
+func (s *FakeRedis) publish(channel string, payload []byte) int {
+	s.mu.Lock()
+	var receivers []*fakeClient
+	for c := range s.clients {
+		if c.channels[channel] {
+			receivers = append(receivers, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range receivers {
+		c.push("message", channel, payload, -1)
+	}
+	return len(receivers)
+}
+
+// send writes a raw reply
+func (c *fakeClient) send(reply string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wr.WriteString(reply)
+	c.wr.Flush()
+}
+
+// push writes a three element pub/sub array: a message with its payload, or
+// a subscription change with the client's channel count
+func (c *fakeClient) push(kind, channel string, payload []byte, count int) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wr.WriteString("*3\r\n$" + strconv.Itoa(len(kind)) + "\r\n" + kind + "\r\n$" + strconv.Itoa(len(channel)) + "\r\n" + channel + "\r\n")
+	if count >= 0 {
+		c.wr.WriteString(":" + strconv.Itoa(count) + "\r\n")
+	} else {
+		c.wr.WriteString("$" + strconv.Itoa(len(payload)) + "\r\n")
+		c.wr.Write(payload)
+		c.wr.WriteString("\r\n")
+	}
+	c.wr.Flush()
+}
+
+var errBadCommand = errors.New("fakeredis: malformed command")
+
+// readCommand reads one command, an array of bulk strings
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, errBadCommand
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n <= 0 {
+		return nil, errBadCommand
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(rd)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(line, "$"))
+		if err != nil || line[0] != '$' || size < 0 {
+			return nil, errBadCommand
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// readLine reads a CRLF terminated line without the terminator
+func readLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
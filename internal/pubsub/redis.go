@@ -0,0 +1,237 @@
+package pubsub
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout  = 5 * time.Second
+	redisWriteTimeout = 5 * time.Second
+	redisMaxBackoff   = 30 * time.Second
+)
+
+// Redis is a backend on Redis pub/sub, speaking the protocol directly. It
+// publishes on one connection and opens one more per subscription; broken
+// subscriptions reconnect with backoff.
+type Redis struct {
+	addr string
+	done chan struct{}
+	once sync.Once
+
+	mu   sync.Mutex // guards the publishing connection
+	conn net.Conn
+	rd   *bufio.Reader
+	wr   *bufio.Writer
+
+	subMu sync.Mutex
+	subs  map[net.Conn]bool
+}
+
+// NewRedis connects to the Redis server at addr (host:port)
+func NewRedis(addr string) (*Redis, error) {
+	c := &Redis{addr: addr, done: make(chan struct{}), subs: make(map[net.Conn]bool)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect opens the publishing connection and checks the server answers
+func (c *Redis) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, redisDialTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn, c.rd, c.wr = conn, bufio.NewReader(conn), bufio.NewWriter(conn)
+	if _, err := c.do([]byte("PING")); err != nil {
+		c.drop()
+		return err
+	}
+	return nil
+}
+
+// drop closes the publishing connection so the next call reconnects
+func (c *Redis) drop() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// do sends one command on the publishing connection and reads its reply
+func (c *Redis) do(args ...[]byte) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(redisWriteTimeout))
+	if err := writeCommand(c.wr, args...); err != nil {
+		return nil, err
+	}
+	if err := c.wr.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := readReply(c.rd)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(respError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func (c *Redis) Publish(channel string, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	// Retry once on a fresh connection: the old one may have gone stale
+	for attempt := 0; ; attempt++ {
+		if c.conn == nil {
+			if err := c.connect(); err != nil {
+				return err
+			}
+		}
+		_, err := c.do([]byte("PUBLISH"), []byte(channel), payload)
+		if _, ok := err.(respError); err == nil || ok {
+			return err
+		}
+		c.drop()
+		if attempt == 1 {
+			return err
+		}
+	}
+}
+
+func (c *Redis) Subscribe(handler Handler, channels ...string) error {
+	conn, rd, err := c.subscribe(channels)
+	if err != nil {
+		return err
+	}
+	go c.listen(conn, rd, handler, channels)
+	return nil
+}
+
+// subscribe opens a connection subscribed to the channels
+func (c *Redis) subscribe(channels []string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, redisDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	rd, wr := bufio.NewReader(conn), bufio.NewWriter(conn)
+	args := [][]byte{[]byte("SUBSCRIBE")}
+	for _, ch := range channels {
+		args = append(args, []byte(ch))
+	}
+	conn.SetDeadline(time.Now().Add(redisWriteTimeout))
+	err = writeCommand(wr, args...)
+	if err == nil {
+		err = wr.Flush()
+	}
+	// One confirmation per channel
+	for i := 0; err == nil && i < len(channels); i++ {
+		var reply any
+		if reply, err = readReply(rd); err == nil {
+			if e, ok := reply.(respError); ok {
+				err = e
+			} else if items, ok := reply.([]any); !ok || len(items) != 3 {
+				err = fmt.Errorf("redis: unexpected reply to SUBSCRIBE: %v", reply)
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// Subscriptions idle for as long as nobody publishes
+	conn.SetDeadline(time.Time{})
+
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	select {
+	case <-c.done:
+		conn.Close()
+		return nil, nil, ErrClosed
+	default:
+	}
+	c.subs[conn] = true
+	return conn, rd, nil
+}
+
+// listen hands published messages to handler, resubscribing whenever the
+// connection breaks, until Close
+func (c *Redis) listen(conn net.Conn, rd *bufio.Reader, handler Handler, channels []string) {
+	for {
+		err := c.receive(rd, handler)
+
+		c.subMu.Lock()
+		delete(c.subs, conn)
+		c.subMu.Unlock()
+		conn.Close()
+
+		backoff := time.Second
+		for {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			log.Printf("pubsub: redis subscription lost (%v), reconnecting", err)
+			select {
+			case <-c.done:
+				return
+			case <-time.After(backoff):
+			}
+			if conn, rd, err = c.subscribe(channels); err == nil {
+				break
+			}
+			backoff = min(backoff*2, redisMaxBackoff)
+		}
+	}
+}
+
+// receive reads pushed messages until the connection fails
+func (c *Redis) receive(rd *bufio.Reader, handler Handler) error {
+	for {
+		reply, err := readReply(rd)
+		if err != nil {
+			return err
+		}
+		items, ok := reply.([]any)
+		if !ok || len(items) != 3 {
+			continue
+		}
+		if kind, _ := replyString(items[0]); kind != "message" {
+			continue
+		}
+		channel, ok1 := replyString(items[1])
+		payload, ok2 := items[2].([]byte)
+		if ok1 && ok2 {
+			handler(channel, payload)
+		}
+	}
+}
+
+// Close ends every subscription and the publishing connection
+func (c *Redis) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.subMu.Lock()
+		for conn := range c.subs {
+			conn.Close()
+		}
+		c.subMu.Unlock()
+		c.mu.Lock()
+		c.drop()
+		c.mu.Unlock()
+	})
+	return nil
+}
@@ -14,6 +14,8 @@ type TokenBucketLimiter struct {
 	fillRate          float64
 	capacity          uint64
 	lastTime          time.Time
+	wholeTokens       bool // refill only once a whole token accrued
+	clock             func() time.Time
 }
 
 func GetIP(r *http.Request) string {
@@ -31,18 +33,30 @@ func NewTokenBucketLimiter(f float64, b uint64) *TokenBucketLimiter {
 		fillRate: f,
 		capacity: b,
 		lastTime: time.Now(),
+		clock:    time.Now,
 	}
 }
 
+// NewWholeTokenBucketLimiter returns a bucket that keeps fractions of a token
+// between calls instead of discarding them, for callers such as WebSocket
+// frames that may call Allow far more often than once per token
+func NewWholeTokenBucketLimiter(f float64, b uint64) *TokenBucketLimiter {
+	t := NewTokenBucketLimiter(f, b)
+	t.wholeTokens = true
+	return t
+}
+
 func (t *TokenBucketLimiter) Allow() bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	now := time.Now()
+	now := t.clock()
 	timePassed := now.Sub(t.lastTime).Seconds()
 	tokensToAdd := timePassed * t.fillRate
 
-	if tokensToAdd > 0 {
+	if t.wholeTokens {
+		t.refillWhole(now, tokensToAdd)
+	} else if tokensToAdd > 0 {
 		t.tokens = min(t.capacity, t.tokens+uint64(tokensToAdd))
 		t.lastTime = now
 	}
@@ -54,3 +68,19 @@ func (t *TokenBucketLimiter) Allow() bool {
 
 	return false
 }
+
+// refillWhole adds the whole tokens accrued and moves lastTime forward only by
+// the time they account for, so the fraction of the next token is kept. A
+// full bucket accrues nothing, so its clock restarts.
+func (t *TokenBucketLimiter) refillWhole(now time.Time, tokensToAdd float64) {
+	whole := uint64(tokensToAdd)
+	if whole == 0 {
+		return
+	}
+	t.tokens = min(t.capacity, t.tokens+whole)
+	if t.tokens == t.capacity {
+		t.lastTime = now
+		return
+	}
+	t.lastTime = t.lastTime.Add(time.Duration(float64(whole) / t.fillRate * float64(time.Second)))
+}
@@ -0,0 +1,35 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWholeTokenBucketKeepsFractions(t *testing.T) {
+	now := time.Now()
+	bucket := NewWholeTokenBucketLimiter(1, 5)
+	bucket.lastTime = now
+	bucket.clock = func() time.Time { return now }
+
+	for range 5 {
+		if !bucket.Allow() {
+			t.Fatal("burst not allowed")
+		}
+	}
+	if bucket.Allow() {
+		t.Fatal("allowed past an empty bucket")
+	}
+
+	// Ten refills of 1.9s each accrue 19 tokens; a bucket discarding the
+	// fraction every time would only grant 10
+	allowed := 0
+	for range 10 {
+		now = now.Add(1900 * time.Millisecond)
+		for bucket.Allow() {
+			allowed++
+		}
+	}
+	if allowed != 19 {
+		t.Fatalf("allowed %d frames over 19s at 1/s, want 19", allowed)
+	}
+}
@@ -40,6 +40,7 @@ type Post struct {
 	IsDislikedByUser bool
 	HasCategories    bool
 	Owned            bool
+	Mentions         []Mention
 }
 
 type PageData struct {
@@ -59,6 +60,17 @@ type Comment struct {
 	IsCommentDislikedByUser bool `json:"isCommentDislikedByUser"`
 	CommentLikes            int  `json:"commentLikes"`
 	CommentDislikes         int  `json:"commentDislikes"`
+
+	Mentions []Mention `json:"mentions"`
+}
+
+// Mention locates an @username reference to a user in a text. Start and end
+// are UTF-16 offsets, so clients can slice JavaScript strings with them.
+type Mention struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
 }
 
 // fit with json data who i will send to front
@@ -87,6 +99,13 @@ const (
 	DATABASE_LOCATION        = "./database/forum.db"
 	DATABASE_SCHEMA_LOCATION = "./database/schema.sql"
 
+	// environment variable holding the Redis address (host:port) hub traffic
+	// is relayed through when several instances run; unset keeps it in process
+	PUBSUB_REDIS_ADDR_ENV = "FORUM_REDIS_ADDR"
+
+	// moderation word list, see moderation.LoadWordList for the format
+	MODERATION_WORDLIST_LOCATION = "./database/moderation_words.txt"
+
 	// error messages
 	FAILED_OPEN_DATABES     = "failed to open the database: %v"
 	FAILED_CREAT_TABELS     = "failed to create tables: %v"
@@ -108,6 +127,24 @@ const (
 	PAGE_COMMENT_QUANTITY = 10
 	DAY_POST_LIMIT        = 20
 	DAY_COMMENTS_LIMIT    = 50
+
+	// WebSocket keepalive defaults, in seconds; the ping interval must stay below the pong timeout
+	WS_PING_INTERVAL_SECONDS = 30
+	WS_PONG_TIMEOUT_SECONDS  = 60
+	WS_WRITE_TIMEOUT_SECONDS = 10
+	WS_MAX_MESSAGE_SIZE      = 16 * 1024 // bytes per incoming frame
+
+	// Per-user WebSocket rate limits, in frames per second and burst size.
+	// Messages include edits and deletes; typing covers stop_typing too.
+	WS_MESSAGE_RATE  = 2
+	WS_MESSAGE_BURST = 10
+	WS_TYPING_RATE   = 1
+	WS_TYPING_BURST  = 5
+	// A socket going over its limits this often within the window is closed
+	WS_RATE_LIMIT_STRIKES        = 20
+	WS_RATE_LIMIT_WINDOW_SECONDS = 30
+	// Conversations one multiplexed socket may be subscribed to at once
+	WS_MAX_SUBSCRIPTIONS = 50
 )
 
 // IT major fields
@@ -143,4 +180,60 @@ const (
 	// Comment limitations
 	COMMENT_MIN_LEN = 1
 	COMMENT_MAX_LEN = 1_000 // Reasonable upper bound for a comment
+
+	// Group conversation limitations
+	CHAT_ROOM_NAME_MIN_LEN = 1
+	CHAT_ROOM_NAME_MAX_LEN = 64
+	CHAT_ROOM_MAX_MEMBERS  = 50 // Keeps fan-out per message bounded
+
+	// Chat message limitations
+	CHAT_MESSAGE_MIN_LEN = 1
+	CHAT_MESSAGE_MAX_LEN = 2_000
+
+	// Chat history page size
+	CHAT_PAGE_DEFAULT_LIMIT = 50
+	CHAT_PAGE_MAX_LIMIT     = 200
+
+	// Pinned messages per private conversation
+	CHAT_PINNED_MAX_PER_CONVERSATION = 50
+
+	// Chat search limitations
+	CHAT_SEARCH_MAX_LEN       = 200
+	CHAT_SEARCH_DEFAULT_LIMIT = 20
+
+	// Conversation list page size and last message preview length
+	CONVERSATIONS_PAGE_DEFAULT_LIMIT = 20
+	CONVERSATIONS_PAGE_MAX_LIMIT     = 100
+	CONVERSATION_PREVIEW_MAX_LEN     = 80 // characters
+
+	// Forum notifications page size
+	NOTIFICATIONS_PAGE_DEFAULT_LIMIT = 20
+	NOTIFICATIONS_PAGE_MAX_LIMIT     = 100
+
+	// Longest timed conversation mute; 0 minutes mutes until unmuted
+	CONVERSATION_MUTE_MAX_MINUTES = 365 * 24 * 60
+
+	// Users linked and notified per post, comment or message; later @names are plain text
+	MENTIONS_MAX_PER_TEXT = 10
+
+	// Offline catch-up limitations
+	CHAT_CATCHUP_MAX_ITEMS     = 500 // per stream; clients reload history past this
+	CHAT_EVENTS_RETENTION_DAYS = 30
+
+	// Client message ids deduplicate resent messages
+	CHAT_CLIENT_MSG_ID_MAX_LEN = 64
+
+	// Transcript exports are read and flushed this many messages at a time
+	CHAT_EXPORT_CHUNK_SIZE = 500
+
+	// Retention sweeper: how often it runs and how many messages it deletes per conversation each run
+	CHAT_RETENTION_SWEEP_SECONDS = 60
+	CHAT_RETENTION_SWEEP_BATCH   = 500
+
+	// Moderation: accounts younger than this may only include a few links,
+	// and the same content may only be repeated so often per window
+	MODERATION_NEW_ACCOUNT_HOURS     = 24
+	MODERATION_NEW_ACCOUNT_MAX_LINKS = 1
+	MODERATION_REPEAT_LIMIT          = 3
+	MODERATION_REPEAT_WINDOW_SECONDS = 60
 )
@@ -21,17 +21,14 @@ const (
                 UPDATE post_metadata SET post_count = post_count - 1;`
 
 	// SELECT queries
-	GET_POST_COUNT_BY_CAT  = `SELECT pcc.post_count FROM categories_count pcc JOIN categories c ON pcc.category_id = c.id WHERE c.name = ?`
-	IS_POST_EXIST          = `SELECT 1 FROM posts WHERE id = ? LIMIT 1`
-	IS_LIKED               = `SELECT is_like FROM likes_dislikes WHERE user_id = ? AND post_id = ?`
-	IS_DISLIKED            = `SELECT is_dislike FROM likes_dislikes WHERE user_id = ? AND post_id = ?`
-	SELECT_TODAY_POSTS     = `SELECT COUNT(*) FROM posts WHERE user_id = ?  AND created_at >= DATE('now')`
-	SELECT_CATEGORY_ID     = `SELECT id FROM categories WHERE name = ?`
-	GET_POST_COUNT         = `SELECT post_count FROM post_metadata`
-	GET_OWNED_POST_COUNT   = `SELECT COUNT(*) FROM posts WHERE user_id = ?`
-	GET_LIKED_POST_COUNT   = `SELECT COUNT(*) FROM likes_dislikes WHERE user_id = ? AND is_like == 1`
-	GET_COMMENT_POST_COUNT = `SELECT COUNT(*) FROM comments WHERE post_id == ?`
-	SELECT_TODAY_COMMENTS  = `SELECT COUNT(*) FROM comments WHERE user_id = ?  AND created_at >= DATE('now')`
+	IS_POST_EXIST         = `SELECT 1 FROM posts WHERE id = ? LIMIT 1`
+	IS_LIKED              = `SELECT is_like FROM likes_dislikes WHERE user_id = ? AND post_id = ?`
+	IS_DISLIKED           = `SELECT is_dislike FROM likes_dislikes WHERE user_id = ? AND post_id = ?`
+	SELECT_TODAY_POSTS    = `SELECT COUNT(*) FROM posts WHERE user_id = ?  AND created_at >= DATE('now')`
+	SELECT_CATEGORY_ID    = `SELECT id FROM categories WHERE name = ?`
+	GET_OWNED_POST_COUNT  = `SELECT COUNT(*) FROM posts WHERE user_id = ?`
+	GET_LIKED_POST_COUNT  = `SELECT COUNT(*) FROM likes_dislikes WHERE user_id = ? AND is_like == 1`
+	SELECT_TODAY_COMMENTS = `SELECT COUNT(*) FROM comments WHERE user_id = ?  AND created_at >= DATE('now')`
 
 	// UDDATE queries
 	UPDATE_LIKE    = `UPDATE likes_dislikes SET is_like = ?, is_dislike = 0 WHERE user_id = ? AND post_id = ?`
@@ -103,6 +100,7 @@ const (
     LEFT JOIN categories c ON c.id = pc.category_id
     LEFT JOIN likes_dislikes ld ON ld.post_id = p.id
     WHERE c.name = ?
+      AND p.user_id NOT IN (SELECT blocked_id FROM blocked_users WHERE blocker_id = ?)
     GROUP BY p.id
     ORDER BY p.created_at DESC
     LIMIT ? OFFSET ?;
@@ -125,6 +123,7 @@ const (
     LEFT JOIN post_categories pc ON pc.post_id = p.id
     LEFT JOIN categories c ON c.id = pc.category_id
     LEFT JOIN likes_dislikes ld ON ld.post_id = p.id
+    WHERE p.user_id NOT IN (SELECT blocked_id FROM blocked_users WHERE blocker_id = ?)
     GROUP BY p.id
     ORDER BY p.created_at DESC
     LIMIT ? OFFSET ?;
@@ -150,8 +149,25 @@ const (
     FROM comments
     JOIN users ON comments.user_id = users.id
     WHERE comments.post_id = ?
+      AND comments.user_id NOT IN (SELECT blocked_id FROM blocked_users WHERE blocker_id = ?)
     ORDER BY comments.created_at DESC
     LIMIT ? OFFSET ?;
+  `
+	GET_VISIBLE_COMMENT_POST_COUNT = `
+  SELECT COUNT(*) FROM comments
+    WHERE post_id = ?
+      AND user_id NOT IN (SELECT blocked_id FROM blocked_users WHERE blocker_id = ?)
+  `
+	GET_VISIBLE_POST_COUNT = `
+  SELECT COUNT(*) FROM posts
+    WHERE user_id NOT IN (SELECT blocked_id FROM blocked_users WHERE blocker_id = ?)
+  `
+	GET_VISIBLE_POST_COUNT_BY_CAT = `
+  SELECT COUNT(DISTINCT p.id) FROM posts p
+    JOIN post_categories pc ON pc.post_id = p.id
+    JOIN categories c ON c.id = pc.category_id
+    WHERE c.name = ?
+      AND p.user_id NOT IN (SELECT blocked_id FROM blocked_users WHERE blocker_id = ?)
   `
 	IS_COMMENT_EXIST = `SELECT 1 FROM comments WHERE post_id = ? AND id = ?`
 
@@ -4,11 +4,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	auth "forum/internal/auth"
 	db "forum/internal/db"
 	handler "forum/internal/handler"
 	middleware "forum/internal/middleware"
+	moderation "forum/internal/moderation"
+	pubsub "forum/internal/pubsub"
 	repo "forum/internal/repository"
 	utils "forum/internal/utils"
 
@@ -21,15 +25,50 @@ func InitDependencies() {
 	// reset all users offline when server start
 	db.ResetAllUsersOffline()
 	auth.LoadOnlineUsersFromDB()
+	initModeration()
+}
+
+// initModeration sets up the filters every chat message, post, title and comment goes through
+func initModeration() {
+	words, err := moderation.LoadWordList(repo.MODERATION_WORDLIST_LOCATION)
+	if err != nil {
+		log.Printf("Moderation word list not loaded: %v", err)
+	}
+	moderation.SetDefault(moderation.NewPipeline(
+		words,
+		moderation.NewLinkLimit(repo.MODERATION_NEW_ACCOUNT_MAX_LINKS,
+			time.Duration(repo.MODERATION_NEW_ACCOUNT_HOURS)*time.Hour, db.GetUserCreatedAt),
+		moderation.NewRepeatFilter(repo.MODERATION_REPEAT_LIMIT,
+			time.Duration(repo.MODERATION_REPEAT_WINDOW_SECONDS)*time.Second),
+	))
+}
+
+// pubsubBackend relays hub traffic through Redis when an address is
+// configured, so several instances can serve the same users
+func pubsubBackend() pubsub.Backend {
+	addr := os.Getenv(repo.PUBSUB_REDIS_ADDR_ENV)
+	if addr == "" {
+		return pubsub.NewMemory()
+	}
+	backend, err := pubsub.NewRedis(addr)
+	if err != nil {
+		log.Fatalf("connecting to redis at %s: %v", addr, err)
+	}
+	log.Printf("Relaying hub traffic through redis at %s", addr)
+	return backend
 }
 
 func forumMux() *http.ServeMux {
 	forumux := http.NewServeMux()
 
 	// Create the WebSocket hub for managing connections
-	hub := handler.NewHub()
+	hub := handler.NewHub(pubsubBackend())
 	// Set the global hub in the auth package to avoid import cycles
 	auth.GlobalHub = hub
+	// Forum activity recorded by the db package is pushed live through the hub
+	db.LiveNotifier = hub
+	// Delete private messages past their conversation's retention and stale catch-up events
+	go hub.RunRetentionSweeper(time.Duration(repo.CHAT_RETENTION_SWEEP_SECONDS) * time.Second)
 
 	// API endpoints for user and application state
 	forumux.HandleFunc("/api/me", middleware.InjectUser(handler.FirststateHandler))
@@ -37,11 +76,40 @@ func forumMux() *http.ServeMux {
 	// API endpoint for retrieving online users for chat functionality
 	forumux.HandleFunc("/api/online-users", middleware.InjectUser(handler.OnlineUsersHandler))
 	forumux.HandleFunc("/api/all-users", middleware.InjectUser(handler.AllUsersHandler))
-	forumux.HandleFunc("/api/chat-messages", handler.GetChatMessagesHandler)
+	forumux.HandleFunc("/api/chat-messages", hub.GetChatMessagesHandler)
+	forumux.HandleFunc("/api/chat-search", handler.SearchChatMessagesHandler)
+	forumux.HandleFunc("/api/chat-export", handler.ChatExportHandler)
+	forumux.HandleFunc("/api/chat-retention", hub.ChatRetentionHandler)
 	forumux.HandleFunc("/api/user-by-username", handler.GetUserByUsernameHandler)
 	forumux.HandleFunc("/api/recent-chats", handler.GetRecentChatsHandler)
 	forumux.HandleFunc("/api/unread-count", handler.GetUnreadCountHandler)
 	forumux.HandleFunc("/api/last-messages", middleware.InjectUser(handler.GetLastMessagesHandler))
+	forumux.HandleFunc("/api/conversations", handler.ConversationsHandler)
+	forumux.HandleFunc("/api/starred-messages", handler.StarredMessagesHandler)
+	forumux.HandleFunc("/api/starred-messages/unstar", handler.UnstarMessageHandler)
+	forumux.HandleFunc("/api/pinned-messages", handler.PinnedMessagesHandler)
+
+	// Group conversations
+	forumux.HandleFunc("/api/chat-rooms", hub.ChatRoomsHandler)
+	forumux.HandleFunc("/api/chat-rooms/rename", hub.RenameChatRoomHandler)
+	forumux.HandleFunc("/api/chat-rooms/invite", hub.InviteChatRoomHandler)
+	forumux.HandleFunc("/api/chat-rooms/kick", hub.KickChatRoomHandler)
+	forumux.HandleFunc("/api/chat-rooms/leave", hub.LeaveChatRoomHandler)
+	forumux.HandleFunc("/api/chat-rooms/messages", handler.ChatRoomMessagesHandler)
+
+	// Blocking
+	forumux.HandleFunc("/api/blocked-users", handler.BlockedUsersHandler)
+	forumux.HandleFunc("/api/blocked-users/unblock", handler.UnblockUserHandler)
+
+	// Notification preferences
+	forumux.HandleFunc("/api/notification-settings", handler.NotificationSettingsHandler)
+	forumux.HandleFunc("/api/conversation-mutes", handler.ConversationMutesHandler)
+	forumux.HandleFunc("/api/conversation-mutes/unmute", handler.UnmuteConversationHandler)
+
+	// Forum activity notifications
+	forumux.HandleFunc("/api/notifications", handler.NotificationsHandler)
+	forumux.HandleFunc("/api/notifications/read", handler.ReadNotificationsHandler)
+	forumux.HandleFunc("/api/notifications/delete", handler.DeleteNotificationsHandler)
 
 	// Authentication routes
 	forumux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
@@ -84,6 +152,10 @@ func forumMux() *http.ServeMux {
 	forumux.HandleFunc("/room", hub.ServeWs)
 	// WebSocket endpoint for global notifications
 	forumux.HandleFunc("/notifications", hub.ServeNotifications)
+	// One multiplexed socket per tab: notifications, presence and subscribed conversations
+	forumux.HandleFunc("/ws", hub.ServeSocket)
+	// Server-Sent Events fallback for notifications when WebSocket upgrades fail
+	forumux.HandleFunc("/events", hub.ServeEvents)
 
 	// Root handler for the main page
 	forumux.HandleFunc("/", middleware.InjectUser(handler.RootHandler))
@@ -52,6 +52,14 @@ func ValidPostTitle(title string) bool {
 	return len(title) >= repo.TITLE_MIN_LEN && len(title) <= repo.TITLE_MAX_LEN
 }
 
+func ValidChatRoomName(name string) bool {
+	return len(name) >= repo.CHAT_ROOM_NAME_MIN_LEN && len(name) <= repo.CHAT_ROOM_NAME_MAX_LEN
+}
+
+func ValidChatMessage(message string) bool {
+	return len(message) >= repo.CHAT_MESSAGE_MIN_LEN && len(message) <= repo.CHAT_MESSAGE_MAX_LEN
+}
+
 func Contain(query string) bool {
 	_, exists := repo.IT_MAJOR_FIELDS[query]
 	return exists
@@ -1,4 +1,5 @@
-import { loadUsersWithStatus, initUserWebSocket, closeUserWebSocket} from "./users.js"
+import { loadUsersWithStatus, initUserPresence, closeUserPresence} from "./users.js"
+import { connectSocket, onSocketEvent, closeSocket } from "./socket.js"
 import { updateUsersList, updateWebSocketStatus } from "./chat-users.js"
 
 // Store interval IDs for cleanup
@@ -127,8 +128,8 @@ export function creatchatisland() {
         chatSection.classList.add('open');
     });
     
-    // Initialize WebSocket for real-time user updates
-    initUserWebSocket(updateUsersList);
+    // Refresh the user list on presence events
+    initUserPresence(updateUsersList);
     
     // Load initial users list
     loadUsersWithStatus().then(users => {
@@ -158,17 +159,64 @@ export function creatchatisland() {
             window.recentMessages = new Map();
         }
 
-        const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const host = window.location.hostname;
-        const port = window.location.port || (protocol === 'wss:' ? '443' : '80');
-        const wsUrl = `${protocol}//${host}:${port}/notifications?username=${encodeURIComponent(window.currentUsername)}`;
+        // Catch-up positions survive reloads so missed messages are replayed on reconnect
+        const positionsKey = `chatPositions_${window.currentUsername}`;
+        let positions = null;
+        try {
+            positions = JSON.parse(localStorage.getItem(positionsKey));
+        } catch (e) {}
+
+        const savePositions = () => {
+            try {
+                localStorage.setItem(positionsKey, JSON.stringify(positions));
+            } catch (e) {}
+        };
 
-        window.globalWS = new WebSocket(wsUrl);
+        // Notifications arrive on the tab's single socket, which replays what
+        // was missed since the saved positions whenever it (re)connects
+        connectSocket(() => positions ? { last_seen: positions.last_seen, last_event: positions.last_event } : {});
 
-        window.globalWS.onmessage = (event) => {
+        if (window.removeNotificationListener) window.removeNotificationListener();
+        window.removeNotificationListener = onSocketEvent('notification', (data) => {
             try {
-                const data = JSON.parse(event.data);
+                if (data.type === 'sync') {
+                    positions = { last_seen: data.last_seen, last_event: data.last_event };
+                    savePositions();
+                    if (data.truncated) {
+                        // Too much was missed to replay; let the REST endpoints catch up
+                        loadUsersWithStatus().then(users => {
+                            if (users) updateUsersList(users);
+                        }).catch(err => {});
+                    }
+                    return;
+                }
+
+                if (data.type === 'unread_update') {
+                    import('./chat-users.js').then(module => module.applyUnreadCounts(data));
+                    return;
+                }
+
+                if (data.event_id) {
+                    // Events are replayed once more if they arrive during catch-up
+                    if (positions && data.event_id <= positions.last_event) return;
+                    if (positions) {
+                        positions.last_event = data.event_id;
+                        savePositions();
+                    }
+                }
+
+                if (data.type === 'message_expired' && data.name === window.activeChatUsername) {
+                    import('./chat-ui.js').then(module => module.removeExpiredMessages(data.ids));
+                    return;
+                }
+
                 if (data.type === 'message' && data.name !== window.currentUsername) {
+                    if (data.id && positions) {
+                        if (data.id <= positions.last_seen) return;
+                        positions.last_seen = data.id;
+                        savePositions();
+                    }
+
                     // Create unique message key for deduplication
                     const messageKey = `${data.name}_${data.created_at || data.message}`;
                     const now = Date.now();
@@ -192,15 +240,17 @@ export function creatchatisland() {
                         }
                     }
 
+                    // Unread counts follow in an unread_update
                     import('./chat-users.js').then(module => {
-                        module.addUnreadMessage(data.name);
-                        module.showNotification(data.name);
+                        // Muted conversations, do-not-disturb and quiet hours still count as unread
+                        if (!data.silent) {
+                            module.showNotification(data.name);
+                        }
                         module.updateUserListOrder(data.name, data.message);
-                        module.updateTotalUnreadBadge();
                     });
                 }
             } catch (e) {}
-        };
+        });
     }
 
     // Update WebSocket status indicator periodically
@@ -252,16 +302,21 @@ export function destroyChatIsland() {
         window.typingTimer = null;
     }
     
-    // Close chat WebSocket
-    if (window.chatWebSocket) {
+    // Leave the open conversation
+    if (window.chatChannel) {
         try {
-            window.chatWebSocket.close();
+            window.chatChannel.close();
         } catch (e) {}
-        window.chatWebSocket = null;
+        window.chatChannel = null;
     }
-    
-    // Close user WebSocket
-    closeUserWebSocket();
+
+    // Stop listening, then close the tab's socket without triggering a reconnect
+    if (window.removeNotificationListener) {
+        window.removeNotificationListener();
+        window.removeNotificationListener = null;
+    }
+    closeUserPresence();
+    closeSocket();
     
     // Reset state
     window.activeChatUsername = null;
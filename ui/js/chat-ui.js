@@ -7,7 +7,8 @@ import { throttle } from "./chat-utils.js";
 import { updateTotalUnreadBadge } from "./chat-users.js";
 
 // UI state
-export let messageOffset = 0;
+// Opaque cursor of the oldest loaded message, sent back as before_id to page into older history
+let historyCursor = null;
 let lastMessageDate = null;
 
 // Maximum number of messages to keep visible in the chat window
@@ -19,23 +20,23 @@ export async function startChatWithUser(username) {
   console.log('[Chat UI] Current window.currentUsername:', window.currentUsername);
   console.log('[Chat UI] Previous window.activeChatUsername:', window.activeChatUsername);
 
-  // FIRST: Close old WebSocket and clear old state
-  if (window.chatWebSocket) {
+  // FIRST: Leave the old conversation and clear old state
+  if (window.chatChannel) {
     try {
-      console.log('[Chat UI] Closing old WebSocket before switching to new user');
-      window.chatWebSocket.close();
+      console.log('[Chat UI] Leaving old conversation before switching to new user');
+      window.chatChannel.close();
     } catch (e) {
-      console.error('Error closing existing WebSocket:', e);
+      console.error('Error leaving existing conversation:', e);
     }
-    window.chatWebSocket = null;
+    window.chatChannel = null;
   }
 
-  // Clear message container and reset offset BEFORE changing active user
+  // Clear message container and reset the history cursor BEFORE changing active user
   const container = document.getElementById("chatMessagesContainer");
   if (container) {
     container.innerHTML = "";
   }
-  messageOffset = 0;
+  historyCursor = null;
   lastMessageDate = null;
 
   // Clear typing indicator when switching chats
@@ -102,10 +103,10 @@ export async function startChatWithUser(username) {
     }
 
     // Load chat history
-    messageOffset = 0;
-    await loadChatHistory(window.activeChatUserId, 10, 0);
+    historyCursor = null;
+    await loadChatHistory(window.activeChatUserId, 10);
 
-    // Set up WebSocket for real-time messages (NEW connection for new user)
+    // Subscribe to real-time messages of this conversation
     setupChatWebSocket(window.currentUsername, username);
 
     // Set up send message handler
@@ -115,12 +116,14 @@ export async function startChatWithUser(username) {
   }
 }
 
-// Load chat history
-export async function loadChatHistory(otherUserId, limit = 10, offset = 0) {
+// Load chat history; pass the cursor of the oldest loaded message to page further back
+export async function loadChatHistory(otherUserId, limit = 10, before = null) {
   try {
-    const res = await fetch(
-      `/api/chat-messages?other_user_id=${otherUserId}&limit=${limit}&offset=${offset}`
-    );
+    let url = `/api/chat-messages?other_user_id=${otherUserId}&limit=${limit}`;
+    if (before) {
+      url += `&before_id=${encodeURIComponent(before)}`;
+    }
+    const res = await fetch(url);
     if (!res.ok) return;
 
     const data = await res.json();
@@ -130,19 +133,18 @@ export async function loadChatHistory(otherUserId, limit = 10, offset = 0) {
     if (!container) return;
 
     // Reset on first load
-    if (offset === 0) {
+    if (!before) {
       container.innerHTML = "";
-      messageOffset = 0;
-      window.allMessagesLoaded = false;
     }
 
-    if (messages.length < limit) {
-      window.allMessagesLoaded = true;
-
+    // The server only returns next_cursor when older messages remain
+    window.allMessagesLoaded = !data.next_cursor;
+    if (data.next_cursor) {
+      historyCursor = data.next_cursor;
     }
 
     // Show messages
-    if (offset === 0) {
+    if (!before) {
       // Initial load - normal order
       messages.forEach((m) => {
         const isSent = String(m.sender_id) === String(window.currentUserId);
@@ -182,16 +184,13 @@ export async function loadChatHistory(otherUserId, limit = 10, offset = 0) {
       container.addEventListener(
         "scroll",
         throttle(() => {
-          if (container.scrollTop === 0 && !window.allMessagesLoaded) {
-            loadChatHistory(otherUserId, limit, messageOffset);
+          if (container.scrollTop === 0 && !window.allMessagesLoaded && historyCursor) {
+            loadChatHistory(window.activeChatUserId, limit, historyCursor);
           }
         }, 500)
       );
       container.dataset.scrollHandler = "true";
     }
-
-    // Update offset
-    messageOffset += messages.length;
   } catch (e) {
     console.error("Error loading chat history:", e);
   }
@@ -224,6 +223,10 @@ export function displayMessage(message, isSent) {
   if (messageId) {
     el.dataset.messageId = String(messageId);
   }
+  // Unconfirmed local messages are matched to the server's ack by client id
+  if (message.client_msg_id) {
+    el.dataset.clientMsgId = message.client_msg_id;
+  }
   
   container.appendChild(el);
 
@@ -261,34 +264,123 @@ export function createMessageElement(message, isSent) {
   const text = document.createElement("div");
   text.className = "message-text";
   text.textContent = message.message;
+  if (message.is_deleted) {
+    text.textContent = "Message deleted";
+    wrapper.classList.add("deleted");
+  } else if (message.is_edited) {
+    wrapper.classList.add("edited");
+  }
+  if (isSent) {
+    if (message.read_at) {
+      wrapper.dataset.receipt = "read";
+    } else if (message.delivered_at) {
+      wrapper.dataset.receipt = "delivered";
+    } else {
+      wrapper.dataset.receipt = "sent";
+    }
+  }
   //    console.log('Creating message element for:', message.ID || message.id || message.message_id, 'Sent by:', isSent ? 'self' : 'other');
   // Full date + time
   const time = document.createElement("div");
   time.className = "message-time";
+  time.textContent = formatMessageTime(message.created_at);
+  console.log("Message time:", time.textContent);
+
+  bubble.appendChild(name);
+  bubble.appendChild(text);
+  bubble.appendChild(time);
+  wrapper.appendChild(bubble);
+
+  return wrapper;
+}
+
+// Format a message timestamp for display
+function formatMessageTime(createdAt) {
   // Handle both ISO 8601 format (string) and milliseconds (number)
   let d;
-  if (typeof message.created_at === "string" && message.created_at.includes("T")) {
+  if (typeof createdAt === "string" && createdAt.includes("T")) {
     // ISO 8601 format (e.g., "2025-01-15T10:30:45Z")
-    d = new Date(message.created_at);
+    d = new Date(createdAt);
   } else {
     // Unix milliseconds (legacy/WebSocket format)
-    d = new Date(parseInt(message.created_at));
+    d = new Date(parseInt(createdAt));
   }
-  time.textContent = d.toLocaleString("en-US", {
+  return d.toLocaleString("en-US", {
     year: "numeric",
     month: "short",
     day: "numeric",
     hour: "2-digit",
     minute: "2-digit",
   });
-  console.log("Message time:", time.textContent);
+}
 
-  bubble.appendChild(name);
-  bubble.appendChild(text);
-  bubble.appendChild(time);
-  wrapper.appendChild(bubble);
+// Give a locally echoed message the id and timestamp the server stored it with
+export function confirmSentMessage(ack) {
+  const container = document.getElementById("chatMessagesContainer");
+  if (!container || !ack.client_msg_id || !ack.id) return;
+  const row = container.querySelector(`.message-row[data-client-msg-id="${CSS.escape(ack.client_msg_id)}"]`);
+  if (!row) return;
+  row.dataset.messageId = String(ack.id);
+  delete row.dataset.clientMsgId;
+  const time = row.querySelector(".message-time");
+  if (time && ack.created_at) {
+    time.textContent = formatMessageTime(ack.created_at);
+  }
+  // Moderation may have masked part of the message
+  const text = row.querySelector(".message-text");
+  if (text && typeof ack.message === "string" && ack.message !== text.textContent) {
+    text.textContent = ack.message;
+  }
+}
 
-  return wrapper;
+// Drop messages removed by the conversation's retention policy
+export function removeExpiredMessages(ids) {
+  const container = document.getElementById("chatMessagesContainer");
+  if (!container || !Array.isArray(ids)) return;
+  for (const id of ids) {
+    const row = container.querySelector(`.message-row[data-message-id="${id}"]`);
+    if (row) row.remove();
+  }
+}
+
+// Flag a locally echoed message the server refused to deliver
+export function markMessageFailed(clientMsgId, reason) {
+  const container = document.getElementById("chatMessagesContainer");
+  if (!container || !clientMsgId) return;
+  const row = container.querySelector(`.message-row[data-client-msg-id="${CSS.escape(clientMsgId)}"]`);
+  if (!row) return;
+  row.classList.add("failed");
+  row.title = reason || "Message not delivered";
+}
+
+// Apply an edit or delete received over the socket to a rendered message
+export function applyMessageRevision(data) {
+  const container = document.getElementById("chatMessagesContainer");
+  if (!container || !data.id) return;
+  const row = container.querySelector(`.message-row[data-message-id="${data.id}"]`);
+  if (!row) return;
+  const text = row.querySelector(".message-text");
+  if (!text) return;
+  if (data.type === "delete") {
+    text.textContent = "Message deleted";
+    row.classList.remove("edited");
+    row.classList.add("deleted");
+  } else {
+    text.textContent = data.message;
+    row.classList.add("edited");
+  }
+}
+
+// Apply a delivered/read receipt to our own rendered messages
+export function applyReceipt(data) {
+  const container = document.getElementById("chatMessagesContainer");
+  if (!container || !Array.isArray(data.ids)) return;
+  const ids = new Set(data.ids.map(String));
+  container.querySelectorAll(".message-row.sent").forEach((row) => {
+    if (!ids.has(row.dataset.messageId)) return;
+    if (data.status === "delivered" && row.dataset.receipt === "read") return;
+    row.dataset.receipt = data.status;
+  });
 }
 
 // Set up send message handler
@@ -380,7 +472,7 @@ export function scrollToBottom() {
 window.closeChat = function () {
   window.activeChatUsername = null;
   window.activeChatUserId = null;
-  messageOffset = 0;
+  historyCursor = null;
   window.chatReconnectAttempts = 0;
 
   // Clear typing state
@@ -388,14 +480,14 @@ window.closeChat = function () {
   window.isTyping = false;
   hideTypingIndicator();
 
-  // Close WebSocket connection
-  if (window.chatWebSocket) {
+  // Leave the conversation
+  if (window.chatChannel) {
     try {
-      window.chatWebSocket.close();
+      window.chatChannel.close();
     } catch (e) {
-      console.error("Error closing WebSocket:", e);
+      console.error("Error leaving conversation:", e);
     }
-    window.chatWebSocket = null;
+    window.chatChannel = null;
   }
 
   const activeChatUser = document.getElementById("activeChatUser");
@@ -89,8 +89,6 @@ export function updateUsersList(data) {
         // Check for recent activity override first
         const override = window.userOrderOverrides.get(user.username);
         const lastMessage = override ? override.lastMessage : user.last_message;
-        const lastMessagePreview = lastMessage ? 
-            `<div class="user-last-message">${lastMessage.length > 30 ? lastMessage.substring(0, 30) + '...' : lastMessage}</div>` : '';
         
         const unreadCount = window.unreadCounts.get(username) || 0;
         
@@ -104,9 +102,15 @@ export function updateUsersList(data) {
             <div class="user-info">
                 <span class="user-name">${username}</span>
                 <span class="user-status ${statusClass}">●</span>
-                ${lastMessagePreview}
             </div>
         `;
+        // Message text is user input, so it is set as text
+        if (lastMessage) {
+            const preview = document.createElement('div');
+            preview.className = 'user-last-message';
+            preview.textContent = lastMessage.length > 30 ? lastMessage.substring(0, 30) + '...' : lastMessage;
+            item.querySelector('.user-info').appendChild(preview);
+        }
         
         // Add unread badge after creating the element
         if (unreadCount > 0) {
@@ -196,6 +200,21 @@ export function addUnreadMessage(senderName) {
     updateTotalUnreadBadge();
 }
 
+// Replace the unread counts with the server's, pushed whenever they change
+export function applyUnreadCounts(update) {
+    const previous = window.unreadCounts ? [...window.unreadCounts.keys()] : [];
+    window.unreadCounts = new Map();
+    for (const conv of update.conversations || []) {
+        // The open conversation is read as its messages arrive
+        if (conv.username === window.activeChatUsername) continue;
+        window.unreadCounts.set(conv.username, conv.unread);
+    }
+    for (const username of new Set([...previous, ...window.unreadCounts.keys()])) {
+        updateUserBadge(username);
+    }
+    updateTotalUnreadBadge();
+}
+
 function updateUserBadge(username) {
     const usersList = document.getElementById('chatUsersList');
     if (!usersList) return;
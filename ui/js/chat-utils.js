@@ -54,7 +54,7 @@ export function initializeGlobalState() {
     // Store active chat state
     window.activeChatUsername = null;
     window.activeChatUserId = null;
-    window.chatWebSocket = null;
+    window.chatChannel = null;
     window.currentUserId = null;
     window.currentUsername = null;
     window.lastReceivedMessage = null;
@@ -1,175 +1,180 @@
-import { displayMessage, scrollToBottom, showTypingIndicator, hideTypingIndicator, messageOffset } from "./chat-ui.js"
-import { updateUserListOrder, addUnreadMessage, updateTotalUnreadBadge, showNotification } from "./chat-users.js"
+import { displayMessage, scrollToBottom, showTypingIndicator, hideTypingIndicator, applyMessageRevision, applyReceipt, confirmSentMessage, markMessageFailed, removeExpiredMessages } from "./chat-ui.js"
+import { updateUserListOrder, showNotification } from "./chat-users.js"
+import { openConversation, onSocketEvent } from "./socket.js"
+
+// Tell the sender we received a message, and that we read it if the tab is visible
+function sendReceipt(messageId) {
+    if (!messageId || messageId <= 0) return;
+    if (!window.chatChannel || window.chatChannel.readyState !== WebSocket.OPEN) return;
+    const type = document.hidden ? 'ack' : 'read';
+    if (type === 'ack') {
+        window.pendingReadReceiptId = messageId;
+    }
+    try {
+        window.chatChannel.send(type, { message_id: messageId });
+    } catch (e) {
+        console.error('[WebSocket] Error sending receipt:', e);
+    }
+}
 
-// WebSocket state
-let chatReconnectAttempts = 0;
-const MAX_CHAT_RECONNECT_ATTEMPTS = 5;
+// Sent messages the server has not acknowledged yet, by client_msg_id. They
+// are resent when the conversation is resubscribed; the server drops duplicates.
+const pendingMessages = new Map();
 
-// Set up WebSocket for chat
+// A message the server refused never reaches the room; the refusal echoes its id
+onSocketEvent('error', (error, id) => {
+    if (id && pendingMessages.has(id)) {
+        pendingMessages.delete(id);
+        markMessageFailed(id, error.message);
+    }
+});
+
+// Generate an id the server uses to recognise a resent message
+function newClientMsgId() {
+    if (window.crypto && typeof window.crypto.randomUUID === 'function') {
+        return window.crypto.randomUUID();
+    }
+    return `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+}
+
+// Messages acknowledged while the tab was hidden become read once it is shown again
+document.addEventListener('visibilitychange', () => {
+    if (!document.hidden && window.pendingReadReceiptId) {
+        const messageId = window.pendingReadReceiptId;
+        window.pendingReadReceiptId = null;
+        sendReceipt(messageId);
+    }
+});
+
+// Subscribe to the private conversation with user2 on the tab's socket
 export function setupChatWebSocket(user1, user2) {
     try {
         console.log('[WebSocket] setupChatWebSocket called with user1:', user1, 'user2:', user2);
-        console.log('[WebSocket] Current window.activeChatUsername:', window.activeChatUsername);
-        console.log('[WebSocket] Current window.currentUsername:', window.currentUsername);
 
-        // Close existing chat WebSocket if any
-        if (window.chatWebSocket) {
+        // Leave the previous conversation if any
+        if (window.chatChannel) {
             try {
-                console.log('[WebSocket] Closing existing WebSocket');
-                window.chatWebSocket.close();
+                window.chatChannel.close();
             } catch (e) {
-                console.error('Error closing existing WebSocket:', e);
+                console.error('Error leaving previous conversation:', e);
             }
-            window.chatWebSocket = null;
+            window.chatChannel = null;
         }
+        window.pendingReadReceiptId = null;
 
-        const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const host = window.location.hostname;
-        const port = window.location.port ? `:${window.location.port}` : '';
-        const wsUrl = `${protocol}//${host}${port}/room?user1=${encodeURIComponent(user1)}&user2=${encodeURIComponent(user2)}&username=${encodeURIComponent(user1)}`;
-
-        console.log('[WebSocket] Full URL:', wsUrl);
-        console.log('[WebSocket] Connecting to room: user1=' + user1 + ', user2=' + user2);
-
-        try {
-            window.chatWebSocket = new WebSocket(wsUrl);
-        } catch (error) {
-            console.error('[WebSocket] Failed to create WebSocket:', error);
-            return;
-        }
-        // Generate a unique token for this connection to avoid stale handlers
-        const socketToken = `${Date.now()}-${Math.random().toString(36).slice(2)}`;
-        window.currentChatSocketToken = socketToken;
-
-        window.chatWebSocket.addEventListener('open', () => {
-            console.log('[WebSocket] Connection opened');
-            chatReconnectAttempts = 0;
-        });
-
-        window.chatWebSocket.addEventListener('message', (event) => {
-            // Ignore events from stale sockets
-            if (socketToken !== window.currentChatSocketToken) {
-                console.log('[WebSocket] Ignoring message from stale socket');
-                return;
-            }
-            try {
-                console.log('[WebSocket] Message received:', event.data);
-                const data = JSON.parse(event.data);
-
-                if (data.type === 'message') {
-                    const isSent = data.name === window.currentUsername;
-                    console.log("Received message:", data);
-                    console.log("Is sent:", isSent);
+        const channel = openConversation({ kind: 'user', id: window.activeChatUserId }, {
+            onOpen: () => {
+                console.log('[WebSocket] Subscribed to conversation with', user2);
 
+                // Resend messages to this peer that were sent before the connection dropped
+                for (const [clientMsgId, pending] of pendingMessages) {
+                    if (pending.to !== user2) continue;
                     try {
-                        hideTypingIndicator();
+                        channel.send('message', { message: pending.message }, clientMsgId);
+                    } catch (e) {
+                        console.error('[WebSocket] Error resending message:', clientMsgId, e);
+                    }
+                }
+            },
+            onFrame: (data) => {
+                try {
+                    if (data.type === 'message') {
+                        const isSent = data.name === window.currentUsername;
+                        console.log("Received message:", data);
+                        console.log("Is sent:", isSent);
+
+                        try {
+                            hideTypingIndicator();
 
-                        // Always include the ID from the server when available
-                        const message = {
-                            id: data.id || data.ID,
-                            message: data.message,
-                            sender_id: isSent ? window.currentUserId : window.activeChatUserId,
-                            receiver_id: isSent ? window.activeChatUserId : window.currentUserId,
-                            created_at: data.created_at || new Date().toISOString()
-                        };
+                            // Always include the ID from the server when available
+                            const message = {
+                                id: data.id || data.ID,
+                                message: data.message,
+                                sender_id: isSent ? window.currentUserId : window.activeChatUserId,
+                                receiver_id: isSent ? window.activeChatUserId : window.currentUserId,
+                                created_at: data.created_at || new Date().toISOString()
+                            };
+
+                            // Display message for both sent and received messages
+                            // For received messages, only display if from active chat
+                            if (!isSent && data.name === window.activeChatUsername) {
+                                displayMessage(message, isSent);
+                                scrollToBottom();
+                                sendReceipt(message.id);
+                            } else if (isSent) {
+                                // For sent messages, always update the user list order
+                                // The local display is handled in sendMessage()
+                                updateUserListOrder(window.activeChatUsername, data.message);
+                            }
 
-                        // Display message for both sent and received messages
-                        // For received messages, only display if from active chat
-                        if (!isSent && data.name === window.activeChatUsername) {
-                            displayMessage(message, isSent);
-                            scrollToBottom();
-                        } else if (isSent) {
-                            // For sent messages, always update the user list order
-                            // The local display is handled in sendMessage()
-                            updateUserListOrder(window.activeChatUsername, data.message);
+                            if (!isSent) {
+                                showNotification(data.name);
+                                updateUserListOrder(data.name, data.message);
+                            }
+                        } catch (msgError) {
+                            console.error('[WebSocket] Error processing message type:', msgError);
                         }
-
-                        if (!isSent) {
-                            addUnreadMessage(data.name);
-                            showNotification(data.name);
-                            updateUserListOrder(data.name, data.message);
+                    } else if (data.type === 'ack') {
+                        pendingMessages.delete(data.client_msg_id);
+                        confirmSentMessage(data);
+                    } else if (data.type === 'message_expired') {
+                        removeExpiredMessages(data.ids);
+                    } else if (data.type === 'error') {
+                        if (data.client_msg_id) {
+                            pendingMessages.delete(data.client_msg_id);
+                            markMessageFailed(data.client_msg_id, data.message);
                         }
-
-                        updateTotalUnreadBadge();
-                    } catch (msgError) {
-                        console.error('[WebSocket] Error processing message type:', msgError);
-                    }
-                } else if (data.type === 'typing') {
-                    try {
-                        if (data.name !== window.currentUsername && data.name === window.activeChatUsername) {
-                            // Clear any existing safety timeout
-                            if (window.typingSafetyTimeout) {
-                                clearTimeout(window.typingSafetyTimeout);
-                                window.typingSafetyTimeout = null;
+                    } else if (data.type === 'edit' || data.type === 'delete') {
+                        applyMessageRevision(data);
+                    } else if (data.type === 'receipt') {
+                        if (data.name === window.activeChatUsername) {
+                            applyReceipt(data);
+                        }
+                    } else if (data.type === 'typing') {
+                        try {
+                            if (data.name !== window.currentUsername && data.name === window.activeChatUsername) {
+                                // Clear any existing safety timeout
+                                if (window.typingSafetyTimeout) {
+                                    clearTimeout(window.typingSafetyTimeout);
+                                    window.typingSafetyTimeout = null;
+                                }
+
+                                showTypingIndicator();
+
+                                // Set a safety timeout to hide the indicator if we don't get another 'typing' 
+                                // or 'stop_typing' event within 5 seconds (providing a buffer over the 1.5s heartbeat)
+                                window.typingSafetyTimeout = setTimeout(() => {
+                                    hideTypingIndicator();
+                                    console.log('[WebSocket] Hiding typing indicator due to safety timeout');
+                                }, 5000);
                             }
-
-                            showTypingIndicator();
-
-                            // Set a safety timeout to hide the indicator if we don't get another 'typing' 
-                            // or 'stop_typing' event within 5 seconds (providing a buffer over the 1.5s heartbeat)
-                            window.typingSafetyTimeout = setTimeout(() => {
-                                hideTypingIndicator();
-                                console.log('[WebSocket] Hiding typing indicator due to safety timeout');
-                            }, 5000);
+                        } catch (typingError) {
+                            console.error('[WebSocket] Error showing typing indicator:', typingError);
                         }
-                    } catch (typingError) {
-                        console.error('[WebSocket] Error showing typing indicator:', typingError);
-                    }
-                } else if (data.type === 'stop_typing') {
-                    try {
-                        if (data.name !== window.currentUsername && data.name === window.activeChatUsername) {
-                            // Clear safety timeout as we have an explicit stop
-                            if (window.typingSafetyTimeout) {
-                                clearTimeout(window.typingSafetyTimeout);
-                                window.typingSafetyTimeout = null;
+                    } else if (data.type === 'stop_typing') {
+                        try {
+                            if (data.name !== window.currentUsername && data.name === window.activeChatUsername) {
+                                // Clear safety timeout as we have an explicit stop
+                                if (window.typingSafetyTimeout) {
+                                    clearTimeout(window.typingSafetyTimeout);
+                                    window.typingSafetyTimeout = null;
+                                }
+                                hideTypingIndicator();
                             }
-                            hideTypingIndicator();
+                        } catch (stopTypingError) {
+                            console.error('[WebSocket] Error hiding typing indicator:', stopTypingError);
                         }
-                    } catch (stopTypingError) {
-                        console.error('[WebSocket] Error hiding typing indicator:', stopTypingError);
                     }
+                } catch (error) {
+                    console.error('[WebSocket] Error processing frame:', error, data);
                 }
-            } catch (error) {
-                console.error('[WebSocket] Error processing message:', error, event.data);
-            }
-        });
-
-        window.chatWebSocket.addEventListener('error', (error) => {
-            console.error('[WebSocket] Error:', error);
-        });
-
-        window.chatWebSocket.addEventListener('close', (event) => {
-            console.log(`[WebSocket] Connection closed. Code: ${event.code}, Reason: ${event.reason}, Clean: ${event.wasClean}`);
-            window.chatWebSocket = null;
-
-            // Clear typing indicator on disconnect to prevent zombie typing state
-            hideTypingIndicator();
-
-            // Only reconnect if this socket is still the active one for the same peer
-            if (
-                socketToken === window.currentChatSocketToken &&
-                window.activeChatUsername === user2 &&
-                window.currentUsername === user1 &&
-                chatReconnectAttempts < MAX_CHAT_RECONNECT_ATTEMPTS
-            ) {
-                chatReconnectAttempts++;
-                const delay = Math.min(1000 * (2 ** (chatReconnectAttempts - 1)), 5000);
-                console.log(`[WebSocket] Reconnecting in ${delay}ms (attempt ${chatReconnectAttempts})`);
-
-                setTimeout(() => {
-                    // Re-check the token and active user before reconnecting
-                    if (
-                        socketToken === window.currentChatSocketToken &&
-                        window.activeChatUsername === user2 &&
-                        window.currentUsername === user1
-                    ) {
-                        setupChatWebSocket(user1, user2);
-                    }
-                }, delay);
-            } else if (chatReconnectAttempts >= MAX_CHAT_RECONNECT_ATTEMPTS) {
-                alert('Lost connection to chat. Please refresh the page.');
-            }
+            },
+            onClose: () => {
+                // Clear typing indicator on disconnect to prevent zombie typing state
+                hideTypingIndicator();
+            },
         });
+        window.chatChannel = channel;
     } catch (setupError) {
         console.error('[WebSocket] Fatal error in setupChatWebSocket:', setupError);
     }
@@ -177,7 +182,7 @@ export function setupChatWebSocket(user1, user2) {
 
 // Typing indicator functions
 export function handleTyping() {
-    if (!window.chatWebSocket || window.chatWebSocket.readyState !== WebSocket.OPEN) {
+    if (!window.chatChannel || window.chatChannel.readyState !== WebSocket.OPEN) {
         return;
     }
 
@@ -191,10 +196,7 @@ export function handleTyping() {
     if (!window.isTyping || !window.lastTypingSentTime || (now - window.lastTypingSentTime > heartbeatInterval)) {
         window.isTyping = true;
         try {
-            window.chatWebSocket.send(JSON.stringify({
-                type: 'typing',
-                name: window.currentUsername
-            }));
+            window.chatChannel.send('typing');
             window.lastTypingSentTime = now;
             console.log(`[WebSocket] Sent typing heartbeat at ${now}`);
         } catch (e) {
@@ -206,15 +208,12 @@ export function handleTyping() {
     // Reset the "stop typing" timer - keep typing active
     clearTimeout(window.typingTimer);
     window.typingTimer = setTimeout(() => {
-        if (window.chatWebSocket && window.chatWebSocket.readyState === WebSocket.OPEN) {
+        if (window.chatChannel && window.chatChannel.readyState === WebSocket.OPEN) {
             window.isTyping = false;
             // Reset last sent time so next key press triggers immediate send
             window.lastTypingSentTime = 0;
             try {
-                window.chatWebSocket.send(JSON.stringify({
-                    type: 'stop_typing',
-                    name: window.currentUsername
-                }));
+                window.chatChannel.send('stop_typing');
                 console.log(`[WebSocket] Sent stop_typing at ${Date.now()}`);
             } catch (e) {
                 console.error('[WebSocket] Error sending stop_typing:', e);
@@ -236,7 +235,7 @@ export function sendMessage() {
 
     console.log('[sendMessage] Sending message to:', window.activeChatUsername);
     console.log('[sendMessage] Current user:', window.currentUsername);
-    console.log('[sendMessage] WebSocket state:', window.chatWebSocket?.readyState);
+    console.log('[sendMessage] Conversation state:', window.chatChannel?.readyState);
     console.log('[sendMessage] Input value BEFORE clear:', chatInput.value);
 
     // Immediately stop typing and clear input to prevent conflicts
@@ -256,24 +255,20 @@ export function sendMessage() {
         }
     });
 
-    if (!window.chatWebSocket || window.chatWebSocket.readyState !== WebSocket.OPEN) {
-        console.error('[sendMessage] WebSocket not open! State:', window.chatWebSocket?.readyState);
+    if (!window.chatChannel || window.chatChannel.readyState !== WebSocket.OPEN) {
+        console.error('[sendMessage] Conversation not open! State:', window.chatChannel?.readyState);
         chatInput.value = message;
         return;
     }
 
-    const messageData = {
-        type: 'message',
-        name: window.currentUsername,
-        message: message,
-        sender_id: window.currentUserId
-    };
-
-    console.log('[sendMessage] Message data:', messageData);
+    // The frame id doubles as the client_msg_id the server deduplicates resends by
+    const clientMsgId = newClientMsgId();
+    console.log('[sendMessage] Message id:', clientMsgId);
 
     // FIRST: Try to send via WebSocket
     try {
-        window.chatWebSocket.send(JSON.stringify(messageData));
+        window.chatChannel.send('message', { message }, clientMsgId);
+        pendingMessages.set(clientMsgId, { to: window.activeChatUsername, message });
     } catch (error) {
         console.error('[sendMessage] Failed to send via WebSocket:', error);
         // Only restore input if the actual network send failed
@@ -283,11 +278,10 @@ export function sendMessage() {
 
     // SECOND: Update UI (if this fails, do NOT restore input since message was sent)
     try {
-        // Display the message locally for the sender immediately
-        // Use a temporary negative ID to mark this as a local unsaved message
-        // The actual ID will come from the server response
+        // Display the message locally for the sender immediately; the server's
+        // ack fills in the stored id and timestamp, matched by client_msg_id
         const localMessage = {
-            id: -Date.now(), // Temporary negative ID to identify this as a local message
+            client_msg_id: clientMsgId,
             message: message,
             sender_id: window.currentUserId,
             receiver_id: window.activeChatUserId,
@@ -296,7 +290,6 @@ export function sendMessage() {
         displayMessage(localMessage, true);
         scrollToBottom();
         updateUserListOrder(window.activeChatUsername, message);
-        messageOffset++;
     } catch (error) {
         console.error('[sendMessage] Error updating UI after send:', error);
         // Message was sent successfully, so we don't restore the input
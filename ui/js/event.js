@@ -136,10 +136,10 @@ export async function loginbuilding(user) {
 }
 
 export async function Logoutfunc() {
-  // Close all WebSocket connections before logout
-  if (window.chatWebSocket) {
-    window.chatWebSocket.close();
-    window.chatWebSocket = null;
+  // Leave the open conversation before logout
+  if (window.chatChannel) {
+    window.chatChannel.close();
+    window.chatChannel = null;
   }
   
   try {
@@ -276,7 +276,11 @@ export function Create({ post, comments = [], user, footerEl, Pagination = null
 
       try {
         const res = await fetch("/comment", { method: "POST", body: formData });
-        if (!res.ok) throw new Error("Failed to submit comment");
+        if (!res.ok) {
+          const data = await res.json().catch(() => ({}));
+          alert(data.error || "Failed to submit comment. Please try again.");
+          return;
+        }
         const newComment = await res.json();
 
         // If user is on another page, redirect to page 1
@@ -0,0 +1,229 @@
+// One WebSocket per tab (/ws). Notifications, presence and every open
+// conversation travel over it as frames: { v, type, id, payload }. The socket
+// opens with hello; the server answers welcome with the version it picked.
+
+const PROTOCOL_VERSIONS = [1];
+
+let socket = null;
+let reconnectAttempts = 0;
+let reconnectTimer = null;
+let version = 0;
+let buildPositions = () => ({});
+
+const listeners = { notification: new Set(), presence: new Set(), error: new Set() };
+
+// Server-Sent Events stream carrying notifications and presence while the
+// socket cannot get through, e.g. behind a proxy that breaks upgrades
+let events = null;
+const PRESENCE_TYPES = new Set(['user_joined', 'user_left', 'users_update']);
+
+// Open conversations by key; each is resubscribed whenever the socket reconnects
+const conversations = new Map();
+
+function conversationKey(conversation) {
+    return `${conversation.kind}:${conversation.id}`;
+}
+
+function sendFrame(ws, type, payload = {}, id) {
+    const frame = { v: version, type, payload };
+    if (id) frame.id = id;
+    ws.send(JSON.stringify(frame));
+}
+
+// Connect the socket; positions() supplies the catch-up positions
+// ({ last_seen, last_event }) on every (re)connect
+export function connectSocket(positions) {
+    if (positions) buildPositions = positions;
+    if (socket && socket.readyState <= WebSocket.OPEN) return;
+    clearTimeout(reconnectTimer);
+
+    const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+    const host = window.location.hostname;
+    const port = window.location.port ? `:${window.location.port}` : '';
+    const ws = new WebSocket(`${protocol}//${host}${port}/ws`);
+    socket = ws;
+    version = 0;
+
+    ws.addEventListener('open', () => {
+        ws.send(JSON.stringify({ v: PROTOCOL_VERSIONS[0], type: 'hello', payload: { versions: PROTOCOL_VERSIONS, ...buildPositions() } }));
+    });
+
+    ws.addEventListener('message', (event) => {
+        let frame;
+        try {
+            frame = JSON.parse(event.data);
+        } catch (e) {
+            console.error('[Socket] Malformed frame:', event.data);
+            return;
+        }
+        dispatch(ws, frame);
+    });
+
+    ws.addEventListener('close', (event) => {
+        if (socket !== ws) return;
+        const welcomed = version !== 0;
+        socket = null;
+        version = 0;
+        for (const entry of conversations.values()) {
+            entry.subscribed = false;
+            if (entry.onClose) entry.onClose();
+        }
+        // Logout clears currentUsername; anything else is a dropped connection.
+        // A protocol error will not go away by reconnecting.
+        if (!window.currentUsername || event.code === 1002) return;
+        // A socket that never opened is likely blocked; keep notifications
+        // coming over /events while retrying
+        if (!welcomed) openEventStream();
+        const delay = Math.min(30000, 1000 * 2 ** reconnectAttempts);
+        reconnectAttempts++;
+        reconnectTimer = setTimeout(() => {
+            if (window.currentUsername) connectSocket();
+        }, delay);
+    });
+}
+
+function openEventStream() {
+    if (events || typeof EventSource === 'undefined') return;
+    // Positions only matter on the first connection; EventSource resumes
+    // through Last-Event-ID on its own
+    const positions = buildPositions();
+    const query = positions.last_seen !== undefined
+        ? `?last_seen=${positions.last_seen}&last_event=${positions.last_event}`
+        : '';
+    events = new EventSource(`/events${query}`);
+    events.addEventListener('message', (event) => {
+        let data;
+        try {
+            data = JSON.parse(event.data);
+        } catch (e) {
+            console.error('[Socket] Malformed event:', event.data);
+            return;
+        }
+        notify(PRESENCE_TYPES.has(data.type) ? 'presence' : 'notification', data);
+    });
+}
+
+function closeEventStream() {
+    if (events) {
+        events.close();
+        events = null;
+    }
+}
+
+function notify(type, ...args) {
+    for (const listener of listeners[type]) {
+        try {
+            listener(...args);
+        } catch (e) {
+            console.error(`[Socket] Error handling ${type}:`, e);
+        }
+    }
+}
+
+function dispatch(ws, frame) {
+    const payload = frame.payload || {};
+    const entry = payload.conversation && conversations.get(conversationKey(payload.conversation));
+    switch (frame.type) {
+        case 'welcome':
+            version = payload.version;
+            reconnectAttempts = 0;
+            closeEventStream();
+            for (const entry of conversations.values()) {
+                entry.subscribed = false;
+                sendFrame(ws, 'subscribe', { conversation: entry.conversation });
+            }
+            break;
+        case 'notification':
+        case 'presence':
+            notify(frame.type, payload.event);
+            break;
+        case 'chat':
+            if (entry) entry.onFrame(payload.event);
+            break;
+        case 'subscribed':
+            if (entry) {
+                entry.subscribed = true;
+                if (entry.onOpen) entry.onOpen();
+            }
+            break;
+        case 'error':
+            console.error('[Socket] Server refused a frame:', payload.code, payload.message, frame.id || '');
+            notify('error', payload, frame.id);
+            break;
+    }
+}
+
+// Listen for notification, presence or error frames; returns a function
+// removing the listener. Error listeners also get the id of the refused frame.
+export function onSocketEvent(type, listener) {
+    listeners[type].add(listener);
+    return () => listeners[type].delete(listener);
+}
+
+// Subscribe to a conversation ({ kind: 'user' | 'room', id }). The returned
+// channel sends room frames and reports OPEN once the server confirmed it.
+export function openConversation(conversation, { onFrame, onOpen, onClose }) {
+    const key = conversationKey(conversation);
+    const entry = { conversation, onFrame, onOpen, onClose, subscribed: false };
+    conversations.set(key, entry);
+    if (socket && socket.readyState === WebSocket.OPEN && version) {
+        sendFrame(socket, 'subscribe', { conversation });
+    } else {
+        connectSocket();
+    }
+
+    let closed = false;
+    return {
+        get readyState() {
+            if (closed) return WebSocket.CLOSED;
+            if (entry.subscribed && socket && socket.readyState === WebSocket.OPEN) return WebSocket.OPEN;
+            return WebSocket.CONNECTING;
+        },
+        // send a frame of this conversation; id is echoed by the server's reply
+        send(type, payload = {}, id) {
+            if (closed || !socket || socket.readyState !== WebSocket.OPEN || !version) {
+                throw new Error('Conversation is not connected');
+            }
+            sendFrame(socket, type, { ...payload, conversation }, id);
+        },
+        close() {
+            if (closed) return;
+            closed = true;
+            if (conversations.get(key) === entry) {
+                conversations.delete(key);
+                if (socket && socket.readyState === WebSocket.OPEN && version) {
+                    sendFrame(socket, 'unsubscribe', { conversation });
+                }
+            }
+        },
+    };
+}
+
+// Close the socket without reconnecting
+export function closeSocket() {
+    clearTimeout(reconnectTimer);
+    closeEventStream();
+    conversations.clear();
+    if (socket) {
+        const ws = socket;
+        socket = null;
+        try {
+            ws.close();
+        } catch (e) {}
+    }
+}
+
+export function getSocketStatus() {
+    if (events && events.readyState === EventSource.OPEN && version === 0) return 'connected';
+    if (!socket) return 'disconnected';
+    switch (socket.readyState) {
+        case WebSocket.CONNECTING:
+            return 'connecting';
+        case WebSocket.OPEN:
+            return 'connected';
+        case WebSocket.CLOSING:
+            return 'closing';
+        default:
+            return 'disconnected';
+    }
+}
@@ -1,37 +1,27 @@
-// WebSocket connection for real-time user updates
-let userWebSocket = null;
-let reconnectAttempts = 0;
-const MAX_RECONNECT_ATTEMPTS = 5;
-const RECONNECT_DELAY = 3000;  
+import { onSocketEvent, getSocketStatus } from "./socket.js"
 
-// Load all users via REST API
-export async function loadAllUsers(){
-    const apirout = '/api/all-users'
-    try{
-        const response = await fetch(apirout)
-        if(!response.ok){
-            throw new Error(`Response status: ${response.status}`);
-        }
-        const result = await response.json();
-        return result;
-    } catch (error) {
-        console.error('Error loading all users:', error.message);
-        return null;
-    }
-}
+// Removes the presence listener of the chat island
+let removePresenceListener = null;
 
-// Load online users via REST API
-export async function loadOnlineUsers(){
-    const apirout = '/api/online-users'
+// Load every page of the conversation list via REST API
+export async function loadConversations(){
+    const conversations = [];
+    let before = '';
     try{
-        const response = await fetch(apirout)
-        if(!response.ok){
-            throw new Error(`Response status: ${response.status}`);
-        }
-        const result = await response.json();
-        return result;
+        do {
+            const params = new URLSearchParams({ limit: '100' });
+            if (before) params.set('before', before);
+            const response = await fetch(`/api/conversations?${params}`);
+            if(!response.ok){
+                throw new Error(`Response status: ${response.status}`);
+            }
+            const result = await response.json();
+            conversations.push(...(result.conversations || []));
+            before = result.hasMore ? result.next_cursor : '';
+        } while (before);
+        return conversations;
     } catch (error) {
-        console.error('Error loading online users:', error.message);
+        console.error('Error loading conversations:', error.message);
         return null;
     }
 }
@@ -65,36 +55,17 @@ export async function loadUsersWithStatus(){
             await new Promise(resolve => setTimeout(resolve, waitTime));
         }
         lastApiCall = Date.now();
-        // Fetch current user first
-        const currentUserData = await getCurrentUser();
-        if (!currentUserData) return [];
-        // Delay between requests
-        await new Promise(resolve => setTimeout(resolve, 200));
-        // Fetch all users
-        const allUsersData = await loadAllUsers();
-        if (!allUsersData) return [];
-        
-        // Delay between requests
-        await new Promise(resolve => setTimeout(resolve, 200));
-        
-        // Fetch online users
-        const onlineUsersData = await loadOnlineUsers();
-        
-        // Extract user arrays
-        const currentUsername = currentUserData?.Username || currentUserData?.username || '';
-        const allUsers = allUsersData?.users || [];
-        const onlineUsers = onlineUsersData?.users || [];
-        
-        // Create a Set for faster lookup
-        const onlineUsersSet = new Set(onlineUsers);
-        
-        // Map all users with their online status, excluding current user
-        const usersWithStatus = allUsers
-            .filter(username => username !== currentUsername)
-            .map(username => ({
-                username: username,
-                isOnline: onlineUsersSet.has(username)
-            }));
+        // One request gives every peer with presence and last message
+        const conversations = await loadConversations();
+        if (!conversations) return [];
+
+        const usersWithStatus = conversations.map(c => ({
+            id: c.user_id,
+            username: c.username,
+            isOnline: c.online,
+            last_message: c.last_message && !c.last_message.is_deleted ? c.last_message.message : '',
+            last_message_at: c.last_activity || ''
+        }));
         
         return usersWithStatus;
     } catch (error) {
@@ -103,130 +74,56 @@ export async function loadUsersWithStatus(){
     }
 }
 
-// Initialize WebSocket connection for real-time user updates
-export function initUserWebSocket(onUsersUpdate) {
-    // Close existing connection if any
-    if (userWebSocket) {
-        userWebSocket.close();
-    }
+// Refresh the user list on presence events from the tab's socket
+export function initUserPresence(onUsersUpdate) {
+    closeUserPresence();
 
-    const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const host = window.location.hostname;
-    const port = window.location.port || (protocol === 'wss:' ? '443' : '80');
-    const wsUrl = `${protocol}//${host}:${port}/room?room=users_lobby`;    
-    try {
-        userWebSocket = new WebSocket(wsUrl);
-        
-        userWebSocket.addEv  entListener('open', () => {
-            reconnectAttempts = 0;
-            
-            // Request initial user list with status
+    let lastRefresh = 0;
+    const REFRESH_THROTTLE = 5000; // 5 seconds minimum between refreshes
+
+    removePresenceListener = onSocketEvent('presence', (data) => {
+        // user_joined and user_left are critical presence events - process immediately
+        if (data.type === 'user_joined' || data.type === 'user_left') {
+            console.log(`Presence event received: ${data.type} - ${data.username}`);
             loadUsersWithStatus().then(users => {
                 if (users && onUsersUpdate) {
                     onUsersUpdate(users);
                 }
-            }).catch(err => console.error('Error loading initial users:', err));
-        });
-        
-        let lastRefresh = 0;
-        const REFRESH_THROTTLE = 5000; // 5 seconds minimum between refreshes
-        
-        userWebSocket.addEventListener('message', (event) => {
-            try {
-                const data = JSON.parse(event.data);
-                
-                // Handle different message types
-                // user_joined and user_left are critical presence events - process immediately
-                if (data.type === 'user_joined' || data.type === 'user_left') {
-                    console.log(`Presence event received: ${data.type} - ${data.username}`);
-                    // Immediately refresh user list without throttle for presence events
-                    loadUsersWithStatus().then(users => {
-                        if (users && onUsersUpdate) {
-                            onUsersUpdate(users);
-                        }
-                    }).catch(err => console.error('Error refreshing users after presence event:', err));
-                    return;
-                }
-                
-                // Throttle user list refreshes for general updates to prevent rate limiting
-                const now = Date.now();
-                if (now - lastRefresh < REFRESH_THROTTLE) {
-                    return;
-                }
-                
-                // Handle users_update (general broadcast)
-                if (data.type === 'users_update') {
-                    lastRefresh = now;
-                    // Add delay before refresh to prevent rate limiting
-                    setTimeout(() => {
-                        loadUsersWithStatus().then(users => {
-                            if (users && onUsersUpdate) {
-                                onUsersUpdate(users);
-                            }
-                        }).catch(err => {
-                            console.log('Rate limited, skipping refresh');
-                        });
-                    }, 500);
-                }
-            } catch (error) {
-                console.error('Error parsing WebSocket message:', error);
-            }
-        });
-        
-        userWebSocket.addEventListener('error', (error) => {
-            console.error(' User WebSocket error:', error);
-        });
-        
-        userWebSocket.addEventListener('close', (event) => {
-            // Attempt to reconnect
-            if (reconnectAttempts < MAX_RECONNECT_ATTEMPTS) {
-                reconnectAttempts++;
-                setTimeout(() => {
-                    initUserWebSocket(onUsersUpdate);
-                }, RECONNECT_DELAY);
-            } else {
-                console.log(' Max reconnection attempts reached');
-            }
-        });
-        
-    } catch (error) {
-        console.error('Failed to create WebSocket:', error);
-    }
-    
-    return userWebSocket;
-}
+            }).catch(err => console.error('Error refreshing users after presence event:', err));
+            return;
+        }
 
-// Close WebSocket connection
-export function closeUserWebSocket() {
-    if (userWebSocket) {
-        userWebSocket.close();
-        userWebSocket = null;
-    }
+        // Throttle user list refreshes for general updates to prevent rate limiting
+        const now = Date.now();
+        if (now - lastRefresh < REFRESH_THROTTLE) {
+            return;
+        }
+
+        // Handle users_update (general broadcast)
+        if (data.type === 'users_update') {
+            lastRefresh = now;
+            // Add delay before refresh to prevent rate limiting
+            setTimeout(() => {
+                loadUsersWithStatus().then(users => {
+                    if (users && onUsersUpdate) {
+                        onUsersUpdate(users);
+                    }
+                }).catch(err => {
+                    console.log('Rate limited, skipping refresh');
+                });
+            }, 500);
+        }
+    });
 }
 
-// Send a Message Through WebSocket !! \\ 
-export function sendUserWebSocketMessage(message) {
-    if (userWebSocket && userWebSocket.readyState === WebSocket.OPEN) {
-        userWebSocket.send(JSON.stringify(message));
-        return true;
-    } else {
-        console.warn('WebSocket is not connected');
-        return false;
+// Stop listening for presence events
+export function closeUserPresence() {
+    if (removePresenceListener) {
+        removePresenceListener();
+        removePresenceListener = null;
     }
 }
 
 export function getUserWebSocketStatus() {
-    if (!userWebSocket) return 'disconnected';
-    switch (userWebSocket.readyState) {
-        case WebSocket.CONNECTING:
-            return 'connecting';
-        case WebSocket.OPEN:
-            return 'connected';
-        case WebSocket.CLOSING:
-            return 'closing';
-        case WebSocket.CLOSED:
-            return 'disconnected';
-        default:
-            return 'unknown';
-    }
-}
\ No newline at end of file
+    return getSocketStatus();
+}